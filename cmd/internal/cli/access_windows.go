@@ -0,0 +1,29 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import "os"
+
+// canWrite assumes directories are writable; Windows ACLs are
+// not worth second-guessing here.
+func canWrite(dir string) bool {
+	return true
+}
+
+// privateDir only checks that fi is a real directory; we rely on
+// the ACLs of the user's profile directory to keep others out.
+func privateDir(fi os.FileInfo) bool {
+	return fi.IsDir()
+}
@@ -23,16 +23,35 @@ import (
 )
 
 type Config struct {
-	DebugAWS      bool   `json:"-"`
-	Store         string `json:"object_store"`
-	Region        string `json:"aws_region"`
-	ECRRepository string `json:"ecr_repository"`
-	IAMRole       string `json:"iam_role"`
-	S3Concurrency int    `json:"s3_concurrency"`
-	Honeycomb     struct {
+	DebugAWS         bool   `json:"-"`
+	Socket           string `json:"-"`
+	Store            string `json:"object_store"`
+	Region           string `json:"aws_region"`
+	Profile          string `json:"aws_profile,omitempty"`
+	AssumeRole       string `json:"assume_role_arn,omitempty"`
+	ECRRepository    string `json:"ecr_repository"`
+	IAMRole          string `json:"iam_role"`
+	S3Concurrency    int    `json:"s3_concurrency"`
+	ShardStore       bool   `json:"shard_object_store,omitempty"`
+	Function         string `json:"default_function,omitempty"`
+	MaxBandwidth     int64  `json:"max_bandwidth,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+	ZstdDictionary   string `json:"zstd_dictionary,omitempty"`
+	Honeycomb        struct {
 		APIKey  string `json:"api_key,omitempty"`
 		Dataset string `json:"dataset,omitempty"`
 	} `json:"honeycomb,omitempty"`
+
+	// Regions are candidate AWS regions for the daemon to
+	// route invocations to, by measured latency times each
+	// region's cost weight.
+	Regions    []string           `json:"regions,omitempty"`
+	RegionCost map[string]float64 `json:"region_cost,omitempty"`
+
+	// TraceArgs has the runtime record each command's arguments
+	// on its trace spans. It takes effect when functions are
+	// next updated.
+	TraceArgs bool `json:"trace_command_args,omitempty"`
 }
 
 func WriteConfig(cfg *Config, configPath string) error {
@@ -45,6 +64,22 @@ func WriteConfig(cfg *Config, configPath string) error {
 	return ioutil.WriteFile(configPath, encoded, 0644)
 }
 
+// LoadConfig reads the user's llama configuration, applying any
+// overrides from the environment.
+func LoadConfig() (*Config, error) {
+	cfg, err := ReadConfig(ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	if store := os.Getenv("LLAMA_OBJECT_STORE"); store != "" {
+		cfg.Store = store
+	}
+	if fn := os.Getenv("LLAMA_FUNCTION"); fn != "" {
+		cfg.Function = fn
+	}
+	return cfg, nil
+}
+
 func ReadConfig(configPath string) (*Config, error) {
 	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
@@ -19,8 +19,10 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/mitchellh/go-homedir"
 	"github.com/nelhage/llama/store"
@@ -32,12 +34,45 @@ var initEnv sync.Once
 type GlobalState struct {
 	mu      sync.Mutex
 	session *session.Session
+	// regions caches sessions for regions other than the
+	// configured one. See RegionSession.
+	regions map[string]*session.Session
 
 	Config *Config
+	// LoadConfig re-reads the config file and reapplies any
+	// command-line overrides. It is used by Reload.
+	LoadConfig func() (*Config, error)
 
 	store store.Store
 }
 
+// Reload returns a GlobalState for a freshly loaded config. The new
+// state shares g's AWS session, and its store if possible, when
+// nothing they depend on has changed.
+func (g *GlobalState) Reload() (*GlobalState, error) {
+	cfg, err := g.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	next := &GlobalState{Config: cfg, LoadConfig: g.LoadConfig}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	old := g.Config
+	if cfg.Region == old.Region && cfg.Profile == old.Profile &&
+		cfg.AssumeRole == old.AssumeRole && cfg.DebugAWS == old.DebugAWS {
+		next.session = g.session
+		next.regions = g.regions
+		if cfg.Store == old.Store && cfg.ShardStore == old.ShardStore &&
+			cfg.MaxBandwidth == old.MaxBandwidth &&
+			cfg.CompressionLevel == old.CompressionLevel &&
+			cfg.ZstdDictionary == old.ZstdDictionary {
+			next.store = g.store
+		}
+	}
+	return next, nil
+}
+
 func (g *GlobalState) Session() (*session.Session, error) {
 	// AWS shared credentials default to being stored in ~/.aws
 	// directory, and the code path that looks them up depends on the
@@ -88,9 +123,56 @@ func (g *GlobalState) sessionLocked() (*session.Session, error) {
 	if g.Config.DebugAWS {
 		awscfg = awscfg.WithLogLevel(aws.LogDebugWithHTTPBody)
 	}
-	var err error
-	g.session, err = session.NewSession(awscfg)
-	return g.session, err
+	// Enable the shared config file so that SSO and
+	// assume-role profiles from ~/.aws/config work.
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awscfg,
+		Profile:           g.Config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if g.Config.AssumeRole != "" {
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, g.Config.AssumeRole),
+		})
+	}
+	g.session = sess
+	return g.session, nil
+}
+
+// RegionSession returns a session like Session's, but for the given
+// AWS region. Sessions are cached per region. An empty region means
+// the configured one.
+func (g *GlobalState) RegionSession(region string) (*session.Session, error) {
+	sess, err := g.Session()
+	if err != nil {
+		return nil, err
+	}
+	if region == "" || region == aws.StringValue(sess.Config.Region) {
+		return sess, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s, ok := g.regions[region]; ok {
+		return s, nil
+	}
+	if g.regions == nil {
+		g.regions = make(map[string]*session.Session)
+	}
+	s := sess.Copy(&aws.Config{Region: aws.String(region)})
+	g.regions[region] = s
+	return s, nil
+}
+
+// SocketPath returns the path to the daemon socket clients should
+// use, honoring the global -socket flag.
+func (g *GlobalState) SocketPath() string {
+	if g.Config.Socket != "" {
+		return g.Config.Socket
+	}
+	return DaemonSocketPath(g.Config)
 }
 
 func (g *GlobalState) MustSession() *session.Session {
@@ -112,7 +194,15 @@ func (g *GlobalState) Store() (store.Store, error) {
 		return nil, err
 	}
 	opts := s3store.Options{
-		DisableHeadCheck: true,
+		// Only objects we haven't seen recently get a HEAD
+		// check before upload. Objects may be expired or
+		// garbage-collected out from under a long-running
+		// daemon, so don't trust what we've seen forever.
+		SeenTTL:          time.Hour,
+		ShardKeys:        g.Config.ShardStore,
+		MaxBytesPerSec:   g.Config.MaxBandwidth,
+		CompressionLevel: g.Config.CompressionLevel,
+		Dictionary:       g.Config.ZstdDictionary,
 	}
 	g.store, err = s3store.FromSessionAndOptions(sess, g.Config.Store, opts)
 	if err != nil {
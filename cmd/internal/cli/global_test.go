@@ -0,0 +1,64 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	next := &Config{Region: "us-west-2", Function: "gcc"}
+	g := &GlobalState{
+		Config:     &Config{Region: "us-west-2", Function: "gcc"},
+		LoadConfig: func() (*Config, error) { c := *next; return &c, nil },
+	}
+	sess, err := g.Session()
+	require.NoError(t, err)
+
+	next.Function = "clang"
+	g2, err := g.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, "clang", g2.Config.Function)
+	sess2, err := g2.Session()
+	require.NoError(t, err)
+	assert.Same(t, sess, sess2, "session is kept when unaffected")
+
+	next.Region = "us-east-1"
+	g3, err := g2.Reload()
+	require.NoError(t, err)
+	sess3, err := g3.Session()
+	require.NoError(t, err)
+	assert.NotSame(t, sess, sess3, "region change rebuilds the session")
+}
+
+func TestRegionSession(t *testing.T) {
+	g := &GlobalState{Config: &Config{Region: "us-west-2"}}
+	sess, err := g.Session()
+	require.NoError(t, err)
+
+	same, err := g.RegionSession("us-west-2")
+	require.NoError(t, err)
+	assert.Same(t, sess, same)
+
+	east, err := g.RegionSession("us-east-1")
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", *east.Config.Region)
+	again, err := g.RegionSession("us-east-1")
+	require.NoError(t, err)
+	assert.Same(t, east, again, "sessions are cached per region")
+}
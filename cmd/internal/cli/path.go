@@ -15,9 +15,14 @@
 package cli
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/mitchellh/go-homedir"
 )
@@ -33,10 +38,129 @@ func ConfigDir() string {
 	return path.Join(dir, ".llama")
 }
 
+// ConfigPath returns the path to llama.json. If LLAMA_DIR is unset,
+// it lives under XDG_CONFIG_HOME if that is set and there is no
+// config in ~/.llama.
 func ConfigPath() string {
-	return path.Join(ConfigDir(), "llama.json")
+	legacy := path.Join(ConfigDir(), "llama.json")
+	if os.Getenv("LLAMA_DIR") != "" {
+		return legacy
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		if _, err := os.Stat(legacy); os.IsNotExist(err) {
+			return path.Join(xdg, "llama", "llama.json")
+		}
+	}
+	return legacy
 }
 
+// SocketPath returns the path to the daemon's socket. If LLAMA_DIR
+// is unset, it lives under XDG_RUNTIME_DIR if that is set.
 func SocketPath() string {
+	if os.Getenv("LLAMA_DIR") == "" {
+		if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+			return path.Join(xdg, "llama", "llama.sock")
+		}
+	}
 	return path.Join(ConfigDir(), "llama.sock")
 }
+
+// socketDirs lists the directories the daemon's socket may live in,
+// in order of preference. The later ones are fallbacks for when the
+// preferred directory isn't writable, e.g. inside a build sandbox.
+func socketDirs() []string {
+	dirs := []string{path.Dir(SocketPath())}
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+		dirs = append(dirs, path.Join(xdg, "llama"))
+	}
+	dirs = append(dirs, path.Join(os.TempDir(), fmt.Sprintf("llama-%d", os.Getuid())))
+	if dirs[1] == dirs[0] {
+		dirs = dirs[1:]
+	}
+	return dirs
+}
+
+// dirWritable reports whether we could create files in dir, creating
+// it first if need be. An existing dir must be private to us (see
+// privateDir), since anyone else who could write to it could replace
+// our socket.
+func dirWritable(dir string) bool {
+	fi, err := os.Lstat(dir)
+	if err == nil {
+		return privateDir(fi) && canWrite(dir)
+	}
+	for {
+		if !os.IsNotExist(err) {
+			return false
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+		if fi, err = os.Stat(dir); err == nil {
+			return fi.IsDir() && canWrite(dir)
+		}
+	}
+}
+
+// fingerprintEnv lists the environment variables that can change
+// which AWS account or region a daemon talks to.
+var fingerprintEnv = []string{
+	"AWS_PROFILE",
+	"AWS_DEFAULT_PROFILE",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_ACCESS_KEY_ID",
+}
+
+// DaemonSocketPath returns the socket path for the daemon serving
+// cfg. The name includes a fingerprint of the AWS configuration and
+// default function, so that e.g. builds using different AWS profiles,
+// regions, or functions each get their own daemon instead of sharing
+// one configured for the wrong account.
+//
+// If a daemon is already listening in one of the candidate socket
+// directories, that is where clients will find it; otherwise we use
+// the first directory we can write to. Either way, a directory that
+// isn't private to us is skipped, so that another user on a shared
+// host can't plant a socket for us to find.
+func DaemonSocketPath(cfg *Config) string {
+	fields := []string{cfg.Store, cfg.Region, cfg.Profile, cfg.AssumeRole, cfg.Function}
+	for _, env := range fingerprintEnv {
+		fields = append(fields, os.Getenv(env))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	name := "llama-" + hex.EncodeToString(sum[:4]) + ".sock"
+
+	dirs := socketDirs()
+	for _, dir := range dirs {
+		if fi, err := os.Lstat(dir); err != nil || !privateDir(fi) {
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			return path.Join(dir, name)
+		}
+	}
+	for _, dir := range dirs {
+		if dirWritable(dir) {
+			return path.Join(dir, name)
+		}
+	}
+	return path.Join(dirs[0], name)
+}
+
+// DaemonSockets lists the daemon sockets in every directory
+// DaemonSocketPath might choose, whether or not anything is still
+// listening on them.
+func DaemonSockets() []string {
+	var socks []string
+	for _, dir := range socketDirs() {
+		if fi, err := os.Lstat(dir); err != nil || !privateDir(fi) {
+			continue
+		}
+		matches, _ := filepath.Glob(path.Join(dir, "llama-*.sock"))
+		socks = append(socks, matches...)
+	}
+	return socks
+}
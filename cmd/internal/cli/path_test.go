@@ -0,0 +1,138 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXDGPaths(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("LLAMA_DIR", "")
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	t.Setenv("XDG_RUNTIME_DIR", "/xdg/run")
+
+	assert.Equal(t, "/xdg/config/llama/llama.json", ConfigPath())
+	assert.Equal(t, "/xdg/run/llama/llama.sock", SocketPath())
+
+	// An existing config in ~/.llama wins
+	os.MkdirAll(path.Join(home, ".llama"), 0755)
+	ioutil.WriteFile(path.Join(home, ".llama", "llama.json"), []byte("{}"), 0644)
+	assert.Equal(t, path.Join(home, ".llama", "llama.json"), ConfigPath())
+
+	t.Setenv("LLAMA_DIR", "/llama")
+	assert.Equal(t, "/llama/llama.json", ConfigPath())
+	assert.Equal(t, "/llama/llama.sock", SocketPath())
+}
+
+// privateTempDir returns a temporary directory that DaemonSocketPath
+// will use.
+func privateTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0700))
+	return dir
+}
+
+func TestDaemonSocketPath(t *testing.T) {
+	dir := privateTempDir(t)
+	t.Setenv("LLAMA_DIR", dir)
+	t.Setenv("AWS_PROFILE", "a")
+
+	cfg := Config{Store: "s3://bucket/obj/", Region: "us-west-2"}
+	sock := DaemonSocketPath(&cfg)
+	assert.Equal(t, dir, path.Dir(sock))
+	assert.Equal(t, sock, DaemonSocketPath(&cfg))
+
+	other := cfg
+	other.Region = "us-east-1"
+	assert.NotEqual(t, sock, DaemonSocketPath(&other))
+
+	t.Setenv("AWS_PROFILE", "b")
+	assert.NotEqual(t, sock, DaemonSocketPath(&cfg))
+}
+
+func TestDaemonSocketPathFunction(t *testing.T) {
+	t.Setenv("LLAMA_DIR", t.TempDir())
+
+	a := Config{Store: "s3://bucket/obj/", Function: "a"}
+	b := a
+	b.Function = "b"
+	assert.NotEqual(t, DaemonSocketPath(&a), DaemonSocketPath(&b))
+}
+
+func TestSocketFallback(t *testing.T) {
+	// LLAMA_DIR is under a regular file, so can never be created
+	notDir := path.Join(t.TempDir(), "file")
+	ioutil.WriteFile(notDir, nil, 0644)
+	t.Setenv("LLAMA_DIR", path.Join(notDir, "llama"))
+	xdg := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", xdg)
+
+	cfg := Config{Store: "s3://bucket/obj/"}
+	sock := DaemonSocketPath(&cfg)
+	assert.Equal(t, path.Join(xdg, "llama"), path.Dir(sock))
+
+	// A socket that already exists is preferred over a writable
+	// directory
+	os.MkdirAll(path.Dir(sock), 0700)
+	ioutil.WriteFile(sock, nil, 0600)
+	t.Setenv("LLAMA_DIR", privateTempDir(t))
+	assert.Equal(t, sock, DaemonSocketPath(&cfg))
+}
+
+func TestDaemonSockets(t *testing.T) {
+	dir := privateTempDir(t)
+	t.Setenv("LLAMA_DIR", dir)
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	a := DaemonSocketPath(&Config{Function: "a"})
+	b := DaemonSocketPath(&Config{Function: "b"})
+	for _, f := range []string{a, b, a + ".log", a + ".lock"} {
+		require.NoError(t, ioutil.WriteFile(f, nil, 0600))
+	}
+	assert.ElementsMatch(t, []string{a, b}, DaemonSockets())
+}
+
+func TestSocketDirNotPrivate(t *testing.T) {
+	notDir := path.Join(t.TempDir(), "file")
+	ioutil.WriteFile(notDir, nil, 0644)
+	t.Setenv("LLAMA_DIR", path.Join(notDir, "llama"))
+	xdg := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", xdg)
+
+	cfg := Config{Store: "s3://bucket/obj/"}
+	sock := DaemonSocketPath(&cfg)
+	require.NoError(t, os.MkdirAll(path.Dir(sock), 0700))
+	require.NoError(t, ioutil.WriteFile(sock, nil, 0600))
+
+	// Anyone could have put a socket in a directory others can
+	// write to, so neither it nor the directory is used.
+	require.NoError(t, os.Chmod(path.Dir(sock), 0777))
+	assert.NotEqual(t, path.Dir(sock), path.Dir(DaemonSocketPath(&cfg)))
+
+	// Nor is one reached through a symlink
+	require.NoError(t, os.Chmod(path.Dir(sock), 0700))
+	real := path.Join(t.TempDir(), "real")
+	require.NoError(t, os.Rename(path.Dir(sock), real))
+	require.NoError(t, os.Symlink(real, path.Dir(sock)))
+	assert.NotEqual(t, path.Dir(sock), path.Dir(DaemonSocketPath(&cfg)))
+}
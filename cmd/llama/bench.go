@@ -0,0 +1,221 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/daemon/server"
+)
+
+type BenchCommand struct {
+	n           int
+	concurrency int
+	sizes       string
+}
+
+func (*BenchCommand) Name() string     { return "bench" }
+func (*BenchCommand) Synopsis() string { return "Measure round-trip latency and throughput to Lambda" }
+func (*BenchCommand) Usage() string {
+	return `bench [flags] FUNCTION-NAME
+
+Runs a series of invocations of ` + "`cat`" + ` in FUNCTION-NAME, passing
+payloads of each size in and back out, and reports the latency of each
+phase of the invocation.
+`
+}
+
+func (c *BenchCommand) SetFlags(flags *flag.FlagSet) {
+	flags.IntVar(&c.n, "n", 20, "Number of invocations per payload size")
+	flags.IntVar(&c.concurrency, "j", 4, "Number of concurrent invocations")
+	flags.StringVar(&c.sizes, "sizes", "0,64k,1m,8m", "Comma-separated list of payload sizes")
+}
+
+type benchResult struct {
+	size  int
+	wall  time.Duration
+	times []daemon.Timing
+}
+
+func (c *BenchCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if flag.NArg() != 1 {
+		log.Printf("Usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	sizes, err := parseSizes(c.sizes)
+	if err != nil {
+		log.Printf("-sizes: %s", err.Error())
+		return subcommands.ExitUsageError
+	}
+
+	cl, err := server.DialWithAutostart(ctx, cli.MustState(ctx).SocketPath(), rpc.DefaultRPCPath)
+	if err != nil {
+		log.Fatalf("connecting to daemon: %s", err.Error())
+	}
+	defer cl.Close()
+
+	var results []benchResult
+	for _, size := range sizes {
+		log.Printf("Running %d invocations with %d-byte payloads...", c.n, size)
+		res, err := c.runSize(ctx, cl, flag.Arg(0), size)
+		if err != nil {
+			log.Printf("invoke: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		results = append(results, *res)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "size\tp50 e2e\tp90 e2e\tp99 e2e\tp50 upload\tp50 invoke\tp50 remote\tp50 fetch\tMB/s\n")
+	for _, r := range results {
+		field := func(f func(*daemon.Timing) time.Duration) []time.Duration {
+			out := make([]time.Duration, len(r.times))
+			for i := range r.times {
+				out[i] = f(&r.times[i])
+			}
+			return out
+		}
+		e2e := field(func(t *daemon.Timing) time.Duration { return t.E2E })
+		bytes := float64(2 * r.size * len(r.times))
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.2f\n",
+			r.size,
+			percentile(e2e, 50),
+			percentile(e2e, 90),
+			percentile(e2e, 99),
+			percentile(field(func(t *daemon.Timing) time.Duration { return t.Upload }), 50),
+			percentile(field(func(t *daemon.Timing) time.Duration { return t.Invoke }), 50),
+			percentile(field(func(t *daemon.Timing) time.Duration { return t.Remote.E2E }), 50),
+			percentile(field(func(t *daemon.Timing) time.Duration { return t.Fetch }), 50),
+			bytes/(1024*1024)/r.wall.Seconds(),
+		)
+	}
+	tw.Flush()
+
+	return subcommands.ExitSuccess
+}
+
+func (c *BenchCommand) runSize(ctx context.Context, cl *daemon.Client, function string, size int) (*benchResult, error) {
+	jobs := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for i := 0; i < c.n; i++ {
+			jobs <- struct{}{}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	out := benchResult{size: size}
+	start := time.Now()
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				// Use fresh random data each time, so that
+				// we can't hit in the object store's caches
+				stdin := make([]byte, size)
+				rand.Read(stdin)
+				reply, err := cl.InvokeWithFiles(&daemon.InvokeWithFilesArgs{
+					Function: function,
+					Args:     []string{"cat"},
+					Stdin:    stdin,
+				})
+				if err == nil && reply.InvokeErr != "" {
+					err = fmt.Errorf("%s", reply.InvokeErr)
+				} else if err == nil && len(reply.Stdout) != size {
+					err = fmt.Errorf("expected %d bytes of output, got %d", size, len(reply.Stdout))
+				}
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					out.times = append(out.times, reply.Timing)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	out.wall = time.Since(start)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &out, nil
+}
+
+// percentile returns the p'th percentile of ds, using the
+// nearest-rank method. It sorts ds in place.
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	rank := (p*len(ds) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return ds[rank-1]
+}
+
+// parseSizes parses a comma-separated list of byte counts, each with
+// an optional k, m, or g (binary) suffix.
+func parseSizes(spec string) ([]int, error) {
+	var out []int
+	for _, word := range strings.Split(spec, ",") {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			return nil, fmt.Errorf("empty size in %q", spec)
+		}
+		mult := 1
+		switch strings.ToLower(word[len(word)-1:]) {
+		case "k":
+			mult = 1 << 10
+		case "m":
+			mult = 1 << 20
+		case "g":
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			word = word[:len(word)-1]
+		}
+		n, err := strconv.Atoi(word)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad size: %q", word)
+		}
+		out = append(out, n*mult)
+	}
+	return out, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSizes(t *testing.T) {
+	sizes, err := parseSizes("0, 100,64k,1M,2g")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{0, 100, 64 << 10, 1 << 20, 2 << 30}, sizes)
+	}
+	for _, bad := range []string{"", "1,,2", "k", "-1", "1x"} {
+		_, err := parseSizes(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i))
+	}
+	assert.Equal(t, time.Duration(50), percentile(ds, 50))
+	assert.Equal(t, time.Duration(99), percentile(ds, 99))
+	assert.Equal(t, time.Duration(100), percentile(ds, 100))
+	assert.Equal(t, time.Duration(1), percentile(ds, 0))
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/daemon/server"
+)
+
+type CCBatchCommand struct {
+	concurrency int
+	llamacc     string
+}
+
+func (*CCBatchCommand) Name() string     { return "cc-batch" }
+func (*CCBatchCommand) Synopsis() string { return "Compile every entry in a compile_commands.json" }
+func (*CCBatchCommand) Usage() string {
+	return `cc-batch [flags] compile_commands.json
+
+Runs each command in a JSON compilation database through llamacc,
+in its directory, and reports the ones that fail. By default as many
+run at once as the daemon lets llamacc compile concurrently.
+`
+}
+
+func (c *CCBatchCommand) SetFlags(flags *flag.FlagSet) {
+	flags.IntVar(&c.concurrency, "j", 0, "Run this many compiles at once (default: the daemon's -cc-concurrency)")
+	flags.StringVar(&c.llamacc, "llamacc", "", "Path to llamacc (default: next to llama, or in $PATH)")
+}
+
+// compileCommand is an entry in a JSON compilation database, as
+// described at https://clang.llvm.org/docs/JSONCompilationDatabase.html
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+	Command   string   `json:"command"`
+}
+
+// argv returns the entry's command line, split from Command if
+// Arguments is unset.
+func (cc *compileCommand) argv() ([]string, error) {
+	if len(cc.Arguments) > 0 {
+		return cc.Arguments, nil
+	}
+	return splitCommand(cc.Command)
+}
+
+// splitCommand splits a compilation database's command string into
+// arguments. Arguments are separated by whitespace, and may be
+// quoted, with backslash escaping the next character.
+func splitCommand(cmd string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape: %q", cmd)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// llamaccArgv0 is what llamacc should see as its name to compile
+// like the given compiler: llamac++ for C++ compilers.
+func llamaccArgv0(compiler string) string {
+	if strings.HasSuffix(compiler, "++") || strings.HasSuffix(compiler, "cxx") {
+		return "llamac++"
+	}
+	return "llamacc"
+}
+
+func (c *CCBatchCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() != 1 {
+		log.Printf("Usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Printf("reading compilation database: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	var commands []compileCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		log.Printf("parsing %s: %s", flag.Arg(0), err.Error())
+		return subcommands.ExitFailure
+	}
+
+	llamacc := c.llamacc
+	if llamacc == "" {
+		if llamacc, err = findLlamacc(); err != nil {
+			log.Printf("finding llamacc: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	// Start the daemon now rather than in every llamacc, and
+	// ask it how many compiles to run at once.
+	sock := global.SocketPath()
+	client, err := server.DialWithAutostart(ctx, sock, rpc.DefaultRPCPath)
+	if err != nil {
+		log.Printf("connecting to daemon: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	jobs := c.concurrency
+	if jobs <= 0 {
+		cfg, err := client.GetConfig(&daemon.GetConfigArgs{})
+		if err != nil {
+			log.Printf("reading daemon config: %s", err.Error())
+			client.Close()
+			return subcommands.ExitFailure
+		}
+		jobs = int(cfg.Config.LlamaCCConcurrency)
+	}
+	client.Close()
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	work := make(chan int)
+	var mu sync.Mutex
+	var failed []string
+	done := 0
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				entry := &commands[i]
+				out, err := c.compileOne(ctx, llamacc, sock, entry)
+				mu.Lock()
+				done++
+				if err != nil {
+					failed = append(failed, entry.File)
+					log.Printf("[%d/%d] FAILED: %s: %s", done, len(commands), entry.File, err.Error())
+				} else {
+					log.Printf("[%d/%d] %s", done, len(commands), entry.File)
+				}
+				os.Stderr.Write(out)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range commands {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		log.Printf("%d of %d compiles failed", len(failed), len(commands))
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// compileOne runs one entry through llamacc, returning its combined
+// output.
+func (c *CCBatchCommand) compileOne(ctx context.Context, llamacc, sock string, entry *compileCommand) ([]byte, error) {
+	argv, err := entry.argv()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, llamacc, argv[1:]...)
+	cmd.Args[0] = llamaccArgv0(argv[0])
+	cmd.Dir = entry.Directory
+	cmd.Env = append(os.Environ(), "LLAMACC_SOCKET="+sock)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	return out.Bytes(), err
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommand(t *testing.T) {
+	args, err := splitCommand(`/usr/bin/c++ -DNAME=\"llama\" -I "my dir/include" -o out.o -c  'a b.cc'`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/usr/bin/c++", `-DNAME="llama"`, "-I", "my dir/include", "-o", "out.o", "-c", "a b.cc",
+	}, args)
+
+	args, err = splitCommand(`cc -DEMPTY="" -c x.c`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cc", "-DEMPTY=", "-c", "x.c"}, args)
+
+	_, err = splitCommand(`cc "-c x.c`)
+	assert.Error(t, err)
+	_, err = splitCommand("  ")
+	assert.Error(t, err)
+
+	entry := compileCommand{Arguments: []string{"gcc", "-c", "x.c"}, Command: "ignored"}
+	args, err = entry.argv()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gcc", "-c", "x.c"}, args)
+
+	assert.Equal(t, "llamac++", llamaccArgv0("/usr/bin/clang++"))
+	assert.Equal(t, "llamacc", llamaccArgv0("/usr/bin/cc"))
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+)
+
+type CCServerCommand struct {
+	socket  string
+	llamacc string
+}
+
+func (*CCServerCommand) Name() string     { return "cc-server" }
+func (*CCServerCommand) Synopsis() string { return "Serve llamacc compiles over a socket, for editors" }
+func (*CCServerCommand) Usage() string {
+	return `cc-server [flags]
+
+Runs a long-lived llamacc that accepts compile requests on a unix
+socket, so that editors compiling in the background don't start a
+process per compile. Clients speak JSON-RPC 1.0, calling
+CompileServer.Compile with {"Args": [...], "Dir": "..."}; see
+cmd/llamacc/serve.go. "Dir" must be absolute. Set
+"StderrTerminal": true for colored diagnostics. Compiles run
+concurrently.
+`
+}
+
+func (c *CCServerCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.socket, "socket", path.Join(path.Dir(cli.SocketPath()), "llamacc.sock"),
+		"Listen on this socket")
+	flags.StringVar(&c.llamacc, "llamacc", "", "Path to llamacc (default: next to llama, or in $PATH)")
+}
+
+// findLlamacc looks for llamacc alongside our own executable, then
+// in $PATH.
+func findLlamacc() (string, error) {
+	if exe, err := os.Executable(); err == nil {
+		sibling := path.Join(path.Dir(exe), "llamacc")
+		if _, err := os.Stat(sibling); err == nil {
+			return sibling, nil
+		}
+	}
+	return exec.LookPath("llamacc")
+}
+
+func (c *CCServerCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	llamacc := c.llamacc
+	if llamacc == "" {
+		var err error
+		if llamacc, err = findLlamacc(); err != nil {
+			log.Printf("finding llamacc: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+	if err := os.MkdirAll(path.Dir(c.socket), 0700); err != nil {
+		log.Printf("creating socket directory: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	cmd := exec.CommandContext(ctx, llamacc, "--llamacc-serve", c.socket)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("llamacc: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
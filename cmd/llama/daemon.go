@@ -22,6 +22,9 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -30,7 +33,8 @@ import (
 	"github.com/nelhage/llama/cmd/internal/cli"
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/daemon/server"
-	"golang.org/x/sys/unix"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/tracing"
 )
 
 type DaemonCommand struct {
@@ -38,10 +42,24 @@ type DaemonCommand struct {
 	ping             bool
 	shutdown         bool
 	stats            bool
+	config           bool
+	reloadConfig     bool
 	start, autostart bool
 	detach           bool
+	logFile          string
 	idleTimeout      time.Duration
 	ccConcurrency    int64
+	maxInFlight      int64
+	maxBandwidth     string
+	compressionLevel int
+	debugAddr        string
+	contentCache     time.Duration
+	mmapThreshold    string
+	statsd           string
+	statsdTags       string
+
+	maxInlineRequest  int
+	maxInlineResponse int
 }
 
 func (*DaemonCommand) Name() string     { return "daemon" }
@@ -56,34 +74,49 @@ func (c *DaemonCommand) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&c.shutdown, "shutdown", false, "Stop the running server")
 	flags.BoolVar(&c.start, "start", false, "Start the server")
 	flags.BoolVar(&c.stats, "stats", false, "Show server statistics")
+	flags.BoolVar(&c.config, "config", false, "Show the running server's effective configuration")
+	flags.BoolVar(&c.reloadConfig, "reload-config", false, "Make the running server re-read its config file")
 	flags.BoolVar(&c.autostart, "autostart", false, "Start the server if it is not already running")
 	flags.BoolVar(&c.detach, "detach", false, "Detach and run the server in the background")
-	flags.StringVar(&c.path, "path", cli.SocketPath(), "Path to daemon socket")
+	flags.StringVar(&c.path, "path", "", "Path to daemon socket (default: the global -socket)")
+	flags.StringVar(&c.logFile, "log-file", "",
+		"Write logs to this file, rotating it as it grows (default: next to the socket when started in the background)")
 	flags.DurationVar(&c.idleTimeout, "idle-timeout", 10*time.Minute, "Idle timeout")
 	flags.Int64Var(&c.ccConcurrency, "cc-concurrency", 0, "Configure llamacc concurrency limit")
-}
-
-func raiseRlimits() {
-	var limits unix.Rlimit
-	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limits); err != nil {
-		log.Printf("Warning: Unable to read RLIMIT_NOFILE: %s", err.Error())
-		return
-	}
-	target := uint64(65535)
-	limits.Cur = target
-	if limits.Cur > limits.Max {
-		limits.Cur = limits.Max
-	}
-	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &limits); err != nil {
-		log.Printf("Warning: setting RLIMIT_NOFILE: %s", err.Error())
-	}
+	flags.Int64Var(&c.maxInFlight, "max-in-flight", 0,
+		"Limit concurrent invocations from all clients (0 for no limit)")
+	flags.StringVar(&c.maxBandwidth, "max-bandwidth", "",
+		"Limit S3 uploads and downloads each to this many bytes per second, e.g. 10m (default: the config file's max_bandwidth)")
+	flags.IntVar(&c.compressionLevel, "compression-level", 0,
+		"Compress uploaded objects at this zstd level, 1-22 (default: the config file's compression_level)")
+	flags.StringVar(&c.debugAddr, "debug-addr", "",
+		"Serve net/http/pprof profiling handlers at this address, e.g. localhost:6060")
+	flags.DurationVar(&c.contentCache, "content-cache", 0,
+		"Cache uploaded files, reusing each for this long unless a stat shows it changed (0 to disable)")
+	flags.StringVar(&c.mmapThreshold, "mmap-threshold", "",
+		"Map uploaded files at least this large into memory instead of reading them, e.g. 1m")
+	flags.StringVar(&c.statsd, "statsd", "",
+		"Report span timings as metrics to the statsd (or DogStatsD) server at this address, e.g. localhost:8125")
+	flags.StringVar(&c.statsdTags, "statsd-tags", "",
+		"Comma-separated tags to add to every -statsd metric, e.g. env:prod,team:build")
+	flags.IntVar(&c.maxInlineRequest, "inline-request-bytes", protocol.MaxInlineBlob,
+		"Pass request blobs smaller than this inline instead of via S3")
+	flags.IntVar(&c.maxInlineResponse, "inline-response-bytes", protocol.MaxInlineBlob,
+		"Ask the runtime to return blobs smaller than this inline instead of via S3")
 }
 
 func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if c.ping || c.shutdown || c.stats {
+	explicit := c.path != "" || cli.MustState(ctx).Config.Socket != ""
+	if c.path == "" {
+		c.path = cli.MustState(ctx).SocketPath()
+	}
+	if c.ping || c.shutdown || c.stats || c.config || c.reloadConfig {
 		client, err := daemon.Dial(ctx, c.path)
 		defer client.Close()
 		if err != nil {
+			if c.reloadConfig && !explicit {
+				explainMovedDaemon(ctx, c.path)
+			}
 			log.Fatalf("Connecting to daemon: %s", err.Error())
 		}
 		if c.ping {
@@ -98,6 +131,32 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 				log.Fatalf("Shutting down daemon: %s", err.Error())
 			}
 			log.Printf("The daemon is exiting.")
+		} else if c.config || c.reloadConfig {
+			var cfg *daemon.Config
+			if c.reloadConfig {
+				reply, err := client.ReloadConfig(&daemon.ReloadConfigArgs{})
+				if err != nil {
+					log.Fatalf("Reloading config: %s", err.Error())
+				}
+				cfg = &reply.Config
+			} else {
+				reply, err := client.GetConfig(&daemon.GetConfigArgs{})
+				if err != nil {
+					log.Fatalf("Getting config: %s", err.Error())
+				}
+				cfg = &reply.Config
+			}
+			fmt.Fprintf(os.Stdout, "pid=%d\n", cfg.ServerPid)
+			fmt.Fprintf(os.Stdout, "store=%s\n", cfg.StoreURL)
+			fmt.Fprintf(os.Stdout, "region=%s\n", cfg.Region)
+			fmt.Fprintf(os.Stdout, "function=%s\n", cfg.Function)
+			fmt.Fprintf(os.Stdout, "s3_concurrency=%d\n", cfg.S3Concurrency)
+			fmt.Fprintf(os.Stdout, "max_bandwidth=%d\n", cfg.MaxBandwidth)
+			fmt.Fprintf(os.Stdout, "idle_timeout=%s\n", cfg.IdleTimeout)
+			fmt.Fprintf(os.Stdout, "cc_concurrency=%d\n", cfg.LlamaCCConcurrency)
+			fmt.Fprintf(os.Stdout, "max_in_flight=%d\n", cfg.MaxInFlight)
+			fmt.Fprintf(os.Stdout, "inline_request_bytes=%d\n", cfg.MaxInlineRequest)
+			fmt.Fprintf(os.Stdout, "inline_response_bytes=%d\n", cfg.MaxInlineResponse)
 		} else if c.stats {
 			stats, err := client.GetDaemonStats(&daemon.StatsArgs{})
 			if err != nil {
@@ -105,6 +164,12 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 			}
 			fmt.Fprintf(os.Stdout, "in_flight=%d\n", stats.Stats.InFlight)
 			fmt.Fprintf(os.Stdout, "max_in_flight=%d\n", stats.Stats.MaxInFlight)
+			fmt.Fprintf(os.Stdout, "goroutines=%d\n", stats.Stats.Goroutines)
+			fmt.Fprintf(os.Stdout, "max_goroutines=%d\n", stats.Stats.MaxGoroutines)
+			if stats.Stats.OpenFDs >= 0 {
+				fmt.Fprintf(os.Stdout, "open_fds=%d\n", stats.Stats.OpenFDs)
+				fmt.Fprintf(os.Stdout, "max_open_fds=%d\n", stats.Stats.MaxOpenFDs)
+			}
 			fmt.Fprintf(os.Stdout, "invocations=%d\n", stats.Stats.Invocations)
 			fmt.Fprintf(os.Stdout, "func_errors=%d\n", stats.Stats.FunctionErrors)
 			fmt.Fprintf(os.Stdout, "other_errors=%d\n", stats.Stats.OtherErrors)
@@ -114,43 +179,43 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 			fmt.Fprintf(tw, "  Lambda runtime\tms\t%d\n", stats.Stats.Usage.Lambda.Millis)
 			fmt.Fprintf(tw, "  Lambda runtime\tMB-ms\t%d\t$%.2f\n",
 				stats.Stats.Usage.Lambda.MB_Millis,
-				float64(stats.Stats.Usage.Lambda.MB_Millis)*0.0000166667/1000000,
+				float64(stats.Stats.Usage.Lambda.MB_Millis)*lambdaMBMsCost,
 			)
-			cost += float64(stats.Stats.Usage.Lambda.MB_Millis) * 0.0000166667 / 1000000
+			cost += float64(stats.Stats.Usage.Lambda.MB_Millis) * lambdaMBMsCost
 			fmt.Fprintf(tw, "  Lambda requests\t\t%d\t$%.2f\n",
 				stats.Stats.Usage.Lambda.Requests,
-				float64(stats.Stats.Usage.Lambda.Requests)*0.20/1000000,
+				float64(stats.Stats.Usage.Lambda.Requests)*lambdaRequestCost,
 			)
-			cost += float64(stats.Stats.Usage.Lambda.Requests) * 0.20 / 1000000
+			cost += float64(stats.Stats.Usage.Lambda.Requests) * lambdaRequestCost
 			fmt.Fprintf(tw, "  S3 Write requests[client]\t\t%d\t$%.2f\n",
 				stats.Stats.Usage.LocalS3.Write_Requests,
-				0.005/1000*float64(stats.Stats.Usage.LocalS3.Write_Requests),
+				s3WriteCost*float64(stats.Stats.Usage.LocalS3.Write_Requests),
 			)
-			cost += 0.005 / 1000 * float64(stats.Stats.Usage.LocalS3.Write_Requests)
+			cost += s3WriteCost * float64(stats.Stats.Usage.LocalS3.Write_Requests)
 			fmt.Fprintf(tw, "  S3 Read requests[client]\t\t%d\t$%.2f\n",
 				stats.Stats.Usage.LocalS3.Read_Requests,
-				0.0004/1000*float64(stats.Stats.Usage.LocalS3.Read_Requests),
+				s3ReadCost*float64(stats.Stats.Usage.LocalS3.Read_Requests),
 			)
-			cost += 0.0004 / 1000 * float64(stats.Stats.Usage.LocalS3.Read_Requests)
+			cost += s3ReadCost * float64(stats.Stats.Usage.LocalS3.Read_Requests)
 			fmt.Fprintf(tw, "  S3 Xfer in[client]\tMB\t%d\t$%.2f\n",
 				stats.Stats.Usage.LocalS3.Xfer_In/(1024*1024),
 				0.0,
 			)
 			fmt.Fprintf(tw, "  S3 Xfer out[client]\tMB\t%d\t$%.2f\n",
 				stats.Stats.Usage.LocalS3.Xfer_Out/(1024*1024),
-				float64(stats.Stats.Usage.LocalS3.Xfer_Out)*0.09/(1024*1024*1024),
+				float64(stats.Stats.Usage.LocalS3.Xfer_Out)*s3XferOutCost,
 			)
-			cost += float64(stats.Stats.Usage.LocalS3.Xfer_Out) * 0.09 / (1024 * 1024 * 1024)
+			cost += float64(stats.Stats.Usage.LocalS3.Xfer_Out) * s3XferOutCost
 			fmt.Fprintf(tw, "  S3 Write requests[remote]\t\t%d\t$%.2f\n",
 				stats.Stats.Usage.RemoteS3.Write_Requests,
-				0.005/1000*float64(stats.Stats.Usage.RemoteS3.Write_Requests),
+				s3WriteCost*float64(stats.Stats.Usage.RemoteS3.Write_Requests),
 			)
-			cost += 0.005 / 1000 * float64(stats.Stats.Usage.RemoteS3.Write_Requests)
+			cost += s3WriteCost * float64(stats.Stats.Usage.RemoteS3.Write_Requests)
 			fmt.Fprintf(tw, "  S3 Read requests[remote]\t\t%d\t$%.2f\n",
 				stats.Stats.Usage.RemoteS3.Read_Requests,
-				0.0004/1000*float64(stats.Stats.Usage.RemoteS3.Read_Requests),
+				s3ReadCost*float64(stats.Stats.Usage.RemoteS3.Read_Requests),
 			)
-			cost += 0.0004 / 1000 * float64(stats.Stats.Usage.RemoteS3.Read_Requests)
+			cost += s3ReadCost * float64(stats.Stats.Usage.RemoteS3.Read_Requests)
 			fmt.Fprintf(tw, "  S3 Xfer in[remote]\tMB\t%d\t$%.2f\n",
 				stats.Stats.Usage.RemoteS3.Xfer_In/(1024*1024),
 				0.0,
@@ -163,30 +228,148 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 				cost,
 			)
 			tw.Flush()
+			remote := &stats.Stats.Usage.RemoteS3
+			if lookups := remote.DiskCache_Hits + remote.DiskCache_Misses; lookups > 0 {
+				fmt.Fprintf(os.Stdout, "Remote disk cache: %d hits, %d misses (%.1f%% hit rate)\n",
+					remote.DiskCache_Hits, remote.DiskCache_Misses,
+					100*float64(remote.DiskCache_Hits)/float64(lookups),
+				)
+			}
 		}
 		return subcommands.ExitSuccess
 	} else if c.start || c.autostart {
-		raiseRlimits()
+		if c.logFile == "" && (c.detach || c.autostart) {
+			c.logFile = c.path + ".log"
+		}
+		var maxBandwidth int64
+		if c.maxBandwidth != "" {
+			sizes, err := parseSizes(c.maxBandwidth)
+			if err != nil || len(sizes) != 1 {
+				log.Printf("-max-bandwidth: expected a single size, got %q", c.maxBandwidth)
+				return subcommands.ExitUsageError
+			}
+			maxBandwidth = int64(sizes[0])
+		}
+		var mmapThreshold int64
+		if c.mmapThreshold != "" {
+			sizes, err := parseSizes(c.mmapThreshold)
+			if err != nil || len(sizes) != 1 {
+				log.Printf("-mmap-threshold: expected a single size, got %q", c.mmapThreshold)
+				return subcommands.ExitUsageError
+			}
+			mmapThreshold = int64(sizes[0])
+		}
+		if c.compressionLevel < 0 || c.compressionLevel > 22 {
+			log.Printf("-compression-level: must be 0 (default) or 1-22, got %d", c.compressionLevel)
+			return subcommands.ExitUsageError
+		}
 		if c.detach {
-			cmd := exec.Command("/proc/self/exe", "daemon", "-start",
+			exe, err := os.Executable()
+			if err != nil {
+				log.Fatalf("Starting daemon: %s", err.Error())
+			}
+			cmd := exec.Command(exe, "daemon", "-start",
 				"-idle-timeout", c.idleTimeout.String(),
 				"-path", c.path,
+				"-log-file", c.logFile,
+				"-cc-concurrency", strconv.FormatInt(c.ccConcurrency, 10),
+				"-max-in-flight", strconv.FormatInt(c.maxInFlight, 10),
+				"-inline-request-bytes", strconv.Itoa(c.maxInlineRequest),
+				"-inline-response-bytes", strconv.Itoa(c.maxInlineResponse),
 			)
-			cmd.SysProcAttr = &syscall.SysProcAttr{
-				Setsid: true,
+			if c.maxBandwidth != "" {
+				cmd.Args = append(cmd.Args, "-max-bandwidth", c.maxBandwidth)
+			}
+			if c.compressionLevel != 0 {
+				cmd.Args = append(cmd.Args, "-compression-level", strconv.Itoa(c.compressionLevel))
+			}
+			if c.debugAddr != "" {
+				cmd.Args = append(cmd.Args, "-debug-addr", c.debugAddr)
+			}
+			if c.contentCache != 0 {
+				cmd.Args = append(cmd.Args, "-content-cache", c.contentCache.String())
 			}
+			if c.mmapThreshold != "" {
+				cmd.Args = append(cmd.Args, "-mmap-threshold", c.mmapThreshold)
+			}
+			if c.statsd != "" {
+				cmd.Args = append(cmd.Args, "-statsd", c.statsd, "-statsd-tags", c.statsdTags)
+			}
+			cmd.SysProcAttr = daemon.DetachedProcAttr()
 			signal.Ignore(syscall.SIGHUP)
 			if err := cmd.Start(); err != nil {
 				log.Fatalf("Starting daemon: %s", err.Error())
 			}
 		} else {
+			if c.logFile != "" {
+				os.MkdirAll(filepath.Dir(c.logFile), 0700)
+				w, err := openRotatingFile(c.logFile, logFileMaxSize)
+				if err != nil {
+					log.Fatalf("opening log file: %s", err.Error())
+				}
+				log.SetOutput(w)
+				if err := w.captureStderr(); err != nil {
+					log.Printf("redirecting stderr to %s: %s", c.logFile, err.Error())
+				}
+			}
+			raiseRlimits()
+			if c.statsd != "" {
+				var tags []string
+				if c.statsdTags != "" {
+					tags = strings.Split(c.statsdTags, ",")
+				}
+				st, err := tracing.NewStatsdTracer(ctx, c.statsd, tags)
+				if err != nil {
+					log.Fatalf("starting daemon: %s", err)
+				}
+				defer st.Close()
+				if tr, ok := tracing.TracerFromContext(ctx); ok {
+					ctx = tracing.WithTracer(ctx, tracing.Tee(tr, st))
+				} else {
+					ctx = tracing.WithTracer(ctx, st)
+				}
+			}
 			global := cli.MustState(ctx)
+			override := func(cfg *cli.Config) {
+				if maxBandwidth > 0 {
+					cfg.MaxBandwidth = maxBandwidth
+				}
+				if c.compressionLevel != 0 {
+					cfg.CompressionLevel = c.compressionLevel
+				}
+			}
+			load := global.LoadConfig
+			global.LoadConfig = func() (*cli.Config, error) {
+				cfg, err := load()
+				if err == nil {
+					override(cfg)
+				}
+				return cfg, err
+			}
+			override(global.Config)
+			backend, err := daemonBackend(global)
+			if err != nil {
+				log.Fatalf("starting daemon: %s", err)
+			}
 			if err := server.Start(ctx, &server.StartArgs{
+				Backend: *backend,
+				Reload: func() (*server.Backend, error) {
+					next, err := global.Reload()
+					if err != nil {
+						return nil, err
+					}
+					global = next
+					return daemonBackend(global)
+				},
 				Path:               c.path,
-				Session:            global.MustSession(),
-				Store:              global.MustStore(),
 				IdleTimeout:        c.idleTimeout,
 				LlamaCCConcurrency: c.ccConcurrency,
+				MaxInFlight:        c.maxInFlight,
+				MaxInlineRequest:   c.maxInlineRequest,
+				MaxInlineResponse:  c.maxInlineResponse,
+				DebugAddr:          c.debugAddr,
+				ContentCacheTTL:    c.contentCache,
+				MmapThreshold:      mmapThreshold,
 			}); err != nil {
 				if c.autostart && err == server.ErrAlreadyRunning {
 					return subcommands.ExitSuccess
@@ -200,3 +383,60 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 
 	return subcommands.ExitSuccess
 }
+
+// defaultFunction is invoked for clients that don't name a function,
+// such as llamacc without LLAMACC_FUNCTION, unless the config file
+// sets default_function.
+const defaultFunction = "gcc"
+
+func daemonBackend(global *cli.GlobalState) (*server.Backend, error) {
+	sess, err := global.Session()
+	if err != nil {
+		return nil, err
+	}
+	st, err := global.Store()
+	if err != nil {
+		return nil, err
+	}
+	fn := global.Config.Function
+	if fn == "" {
+		fn = defaultFunction
+	}
+	return &server.Backend{
+		Session:       sess,
+		Store:         st,
+		StoreURL:      global.Config.Store,
+		S3Concurrency: global.Config.S3Concurrency,
+		MaxBandwidth:  global.Config.MaxBandwidth,
+		Function:      fn,
+		RegionSession: global.RegionSession,
+		Regions:       global.Config.Regions,
+		RegionCost:    global.Config.RegionCost,
+	}, nil
+}
+
+// explainMovedDaemon is called when -reload-config finds no daemon
+// at sockPath. If that's because the edited config selects a different
+// daemon than the one that is running, it explains that and exits.
+func explainMovedDaemon(ctx context.Context, sockPath string) {
+	var running []string
+	for _, other := range cli.DaemonSockets() {
+		if other == sockPath {
+			continue
+		}
+		if cl, err := daemon.Dial(ctx, other); err == nil {
+			cl.Close()
+			running = append(running, other)
+		}
+	}
+	if len(running) == 0 {
+		return
+	}
+	log.Printf("No daemon is listening at %s, where the current config says to find it.", sockPath)
+	log.Printf("The object store, region, AWS profile, and default function each select a separate daemon,")
+	log.Printf("so a change to them can't be applied to a running daemon with -reload-config.")
+	for _, other := range running {
+		log.Printf("A daemon is running at %s; stop it with `llama -socket %s daemon -shutdown`.", other, other)
+	}
+	log.Fatalf("The next client will start a daemon with the new settings.")
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/store/s3store"
+)
+
+type GCCommand struct {
+	minAge time.Duration
+	dryRun bool
+}
+
+func (*GCCommand) Name() string     { return "gc" }
+func (*GCCommand) Synopsis() string { return "Delete unreferenced objects from the object store" }
+func (*GCCommand) Usage() string {
+	return `gc [flags] ROOTS...
+
+Deletes every object in the object store that is not listed in one of
+the ROOTS files and is older than -min-age. Each ROOTS file lists one
+object ID per line; pass - to read from stdin.
+`
+}
+
+func (c *GCCommand) SetFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&c.minAge, "min-age", 24*time.Hour, "Never delete objects younger than this")
+	flags.BoolVar(&c.dryRun, "dry-run", false, "Report what would be deleted without deleting it")
+}
+
+func (c *GCCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() == 0 {
+		log.Printf("Usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	keep := make(map[string]struct{})
+	for _, path := range flag.Args() {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			fh, err := os.Open(path)
+			if err != nil {
+				log.Printf("reading roots: %s", err.Error())
+				return subcommands.ExitFailure
+			}
+			defer fh.Close()
+			r = fh
+		}
+		if err := readRoots(r, keep); err != nil {
+			log.Printf("reading roots: %s: %s", path, err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	st, ok := global.MustStore().(*s3store.Store)
+	if !ok {
+		log.Printf("gc: unsupported object store")
+		return subcommands.ExitFailure
+	}
+
+	cutoff := time.Now().Add(-c.minAge)
+	var (
+		garbage     []s3store.ObjectInfo
+		total       int
+		reclaimable int64
+	)
+	// Dictionaries needed by objects we keep must be kept too
+	dicts := make(map[string]struct{})
+	err := st.ListObjects(ctx, func(obj *s3store.ObjectInfo) error {
+		total++
+		if isGarbage(obj, keep, cutoff) {
+			garbage = append(garbage, *obj)
+		} else if dict := s3store.DictionaryOf(obj.Id); dict != "" {
+			dicts[objectHash(dict)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("listing objects: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	garbage = dropKept(garbage, dicts)
+	for _, obj := range garbage {
+		reclaimable += obj.Size
+	}
+
+	log.Printf("%d objects, %d unreferenced and older than %s (%d MB)",
+		total, len(garbage), c.minAge, reclaimable>>20)
+	if c.dryRun || len(garbage) == 0 {
+		return subcommands.ExitSuccess
+	}
+	if err := st.DeleteObjects(ctx, garbage); err != nil {
+		log.Printf("deleting objects: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	log.Printf("deleted %d objects", len(garbage))
+	return subcommands.ExitSuccess
+}
+
+// objectHash strips the encoding suffix (e.g. ":zstd") from an object
+// ID, so that roots may list either form.
+func objectHash(id string) string {
+	if colon := strings.IndexByte(id, ':'); colon >= 0 {
+		return id[:colon]
+	}
+	return id
+}
+
+// readRoots adds every object ID listed in r to keep. Blank lines and
+// lines starting with # are ignored.
+func readRoots(r io.Reader, keep map[string]struct{}) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keep[objectHash(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// dropKept removes objects whose hash is in keep from garbage.
+func dropKept(garbage []s3store.ObjectInfo, keep map[string]struct{}) []s3store.ObjectInfo {
+	out := garbage[:0]
+	for _, obj := range garbage {
+		if _, ok := keep[objectHash(obj.Id)]; !ok {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+func isGarbage(obj *s3store.ObjectInfo, keep map[string]struct{}, cutoff time.Time) bool {
+	if !obj.LastModified.Before(cutoff) {
+		return false
+	}
+	_, referenced := keep[objectHash(obj.Id)]
+	return !referenced
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/store/s3store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGarbage(t *testing.T) {
+	keep := make(map[string]struct{})
+	err := readRoots(strings.NewReader(`
+# build manifest
+aaaa:zstd
+  bbbb
+`), keep)
+	require.NoError(t, err)
+	assert.Len(t, keep, 2)
+
+	now := time.Now()
+	cutoff := now.Add(-time.Hour)
+	old := now.Add(-2 * time.Hour)
+
+	assert.False(t, isGarbage(&s3store.ObjectInfo{Id: "aaaa:zstd", LastModified: old}, keep, cutoff))
+	assert.False(t, isGarbage(&s3store.ObjectInfo{Id: "bbbb:zstd", LastModified: old}, keep, cutoff))
+	assert.True(t, isGarbage(&s3store.ObjectInfo{Id: "cccc:zstd", LastModified: old}, keep, cutoff))
+	assert.False(t, isGarbage(&s3store.ObjectInfo{Id: "cccc:zstd", LastModified: now}, keep, cutoff))
+}
+
+func TestGarbageKeepsDictionaries(t *testing.T) {
+	assert.Equal(t, "dddd:zstd", s3store.DictionaryOf("aaaa:zstd-dict-dddd"))
+	assert.Equal(t, "", s3store.DictionaryOf("aaaa:zstd"))
+
+	garbage := []s3store.ObjectInfo{{Id: "cccc:zstd"}, {Id: "dddd:zstd"}}
+	dicts := map[string]struct{}{"dddd": {}}
+	assert.Equal(t, []s3store.ObjectInfo{{Id: "cccc:zstd"}}, dropKept(garbage, dicts))
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+)
+
+type DoctorCommand struct{}
+
+func (*DoctorCommand) Name() string     { return "doctor" }
+func (*DoctorCommand) Synopsis() string { return "Check a llama function for common problems" }
+func (*DoctorCommand) Usage() string {
+	return `doctor FUNCTION-NAME...
+`
+}
+
+func (c *DoctorCommand) SetFlags(flags *flag.FlagSet) {}
+
+func (c *DoctorCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() == 0 {
+		log.Printf("Usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	status := subcommands.ExitSuccess
+	for _, name := range flag.Args() {
+		img, err := CheckImage(ctx, global.MustSession(), name)
+		if err != nil {
+			log.Printf("%s: %s", name, err.Error())
+			status = subcommands.ExitFailure
+			continue
+		}
+		if img.Stale() {
+			log.Printf("%s: function is running stale code!", name)
+			log.Printf("  deployed: %s", img.Deployed)
+			log.Printf("  %s: %s", img.Tag, img.Latest)
+			log.Printf("Redeploy it with `llama update-function -tag IMAGE %s` or `-build`.", name)
+			status = subcommands.ExitFailure
+		} else {
+			log.Printf("%s: function is running the latest image for %s", name, img.ImageURI)
+		}
+	}
+	return status
+}
+
+// ImageStatus describes the container image a function is deployed
+// from.
+type ImageStatus struct {
+	// ImageURI is the image the function was configured with,
+	// e.g. ACCOUNT.dkr.ecr.REGION.amazonaws.com/llama:gcc
+	ImageURI string
+	Tag      string
+	// Deployed is the digest Lambda resolved ImageURI to at
+	// deploy time.
+	Deployed string
+	// Latest is the digest the tag currently points at in
+	// ECR. It is empty if the function is pinned to a digest.
+	Latest string
+}
+
+func (s *ImageStatus) Stale() bool {
+	return s.Latest != "" && s.Latest != s.Deployed
+}
+
+// CheckImage compares the image digest a function is running with
+// the digest its image tag currently resolves to in ECR.
+func CheckImage(ctx context.Context, sess *session.Session, function string) (*ImageStatus, error) {
+	fn, err := lambda.New(sess).GetFunctionWithContext(ctx, &lambda.GetFunctionInput{
+		FunctionName: aws.String(function),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fn.Code == nil || fn.Code.ImageUri == nil {
+		return nil, fmt.Errorf("function is not deployed from a container image")
+	}
+	out := ImageStatus{ImageURI: *fn.Code.ImageUri}
+	if fn.Code.ResolvedImageUri != nil {
+		if at := strings.LastIndexByte(*fn.Code.ResolvedImageUri, '@'); at >= 0 {
+			out.Deployed = (*fn.Code.ResolvedImageUri)[at+1:]
+		}
+	}
+
+	registry, repo, tag, err := parseImageURI(out.ImageURI)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		return &out, nil
+	}
+	out.Tag = tag
+
+	images, err := ecr.New(sess).DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registry),
+		RepositoryName: aws.String(repo),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s: %w", out.ImageURI, err)
+	}
+	if len(images.ImageDetails) == 0 || images.ImageDetails[0].ImageDigest == nil {
+		return nil, fmt.Errorf("%s: tag not found in ECR", out.ImageURI)
+	}
+	out.Latest = *images.ImageDetails[0].ImageDigest
+	return &out, nil
+}
+
+// parseImageURI splits an ECR image URI into the registry (account)
+// ID, repository name, and tag. tag is empty if the URI refers to an
+// image by digest.
+func parseImageURI(uri string) (registry, repo, tag string, err error) {
+	slash := strings.IndexByte(uri, '/')
+	if slash < 0 {
+		return "", "", "", fmt.Errorf("malformed image URI: %q", uri)
+	}
+	host := uri[:slash]
+	dot := strings.Index(host, ".dkr.ecr.")
+	if dot < 0 {
+		return "", "", "", fmt.Errorf("not an ECR image: %q", uri)
+	}
+	registry = host[:dot]
+	repo = uri[slash+1:]
+	if at := strings.IndexByte(repo, '@'); at >= 0 {
+		return registry, repo[:at], "", nil
+	}
+	tag = "latest"
+	if colon := strings.LastIndexByte(repo, ':'); colon >= 0 {
+		repo, tag = repo[:colon], repo[colon+1:]
+	}
+	return registry, repo, tag, nil
+}
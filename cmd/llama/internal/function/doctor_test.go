@@ -0,0 +1,48 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageURI(t *testing.T) {
+	cases := []struct {
+		uri                 string
+		registry, repo, tag string
+		err                 bool
+	}{
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com/llama:gcc", "123456789012", "llama", "gcc", false},
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com/team/llama:gcc", "123456789012", "team/llama", "gcc", false},
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com/llama", "123456789012", "llama", "latest", false},
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com/llama@sha256:abcd", "123456789012", "llama", "", false},
+		{"ghcr.io/nelhage/llama:latest", "", "", "", true},
+		{"llama", "", "", "", true},
+	}
+	for _, tc := range cases {
+		registry, repo, tag, err := parseImageURI(tc.uri)
+		if tc.err {
+			assert.Error(t, err, tc.uri)
+			continue
+		}
+		if assert.NoError(t, err, tc.uri) {
+			assert.Equal(t, tc.registry, registry, tc.uri)
+			assert.Equal(t, tc.repo, repo, tc.uri)
+			assert.Equal(t, tc.tag, tag, tc.uri)
+		}
+	}
+}
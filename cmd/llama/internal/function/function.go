@@ -36,8 +36,14 @@ type UpdateFunctionCommand struct {
 	tag          string
 	memory       int64
 	timeout      time.Duration
+	storage      int64
 
-	create bool
+	create  bool
+	publish bool
+	alias   string
+
+	provisionedConcurrency int64
+	reservedConcurrency    int64
 }
 
 type functionConfig struct {
@@ -46,6 +52,7 @@ type functionConfig struct {
 	tag     string
 	memory  int64
 	timeout time.Duration
+	storage int64
 }
 
 func (*UpdateFunctionCommand) Name() string     { return "update-function" }
@@ -62,8 +69,16 @@ func (c *UpdateFunctionCommand) SetFlags(flags *flag.FlagSet) {
 
 	flags.Int64Var(&c.memory, "memory", 0, "Specify the function memory size, in MB")
 	flags.DurationVar(&c.timeout, "timeout", 0, "Specify the function timeout")
+	flags.Int64Var(&c.storage, "ephemeral-storage", 0, "Specify the size of the function's /tmp, in MB (512-10240)")
 
 	flags.BoolVar(&c.create, "create", false, "Create the function if it does not exist")
+	flags.BoolVar(&c.publish, "publish", false, "Publish a new version of the function after updating it")
+	flags.StringVar(&c.alias, "alias", "", "Point the named alias at the newly-published version (implies -publish)")
+
+	flags.Int64Var(&c.provisionedConcurrency, "provisioned-concurrency", -1,
+		"Keep this many execution environments warm for the published version (0 to remove; requires -publish or -alias)")
+	flags.Int64Var(&c.reservedConcurrency, "reserved-concurrency", -1,
+		"Reserve this much of the account's concurrency for the function (0 to remove)")
 }
 
 func (c *UpdateFunctionCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -74,6 +89,15 @@ func (c *UpdateFunctionCommand) Execute(ctx context.Context, flag *flag.FlagSet,
 		return subcommands.ExitUsageError
 	}
 
+	if c.storage != 0 && (c.storage < minEphemeralStorage || c.storage > maxEphemeralStorage) {
+		log.Printf("-ephemeral-storage must be between %d and %d MB", minEphemeralStorage, maxEphemeralStorage)
+		return subcommands.ExitUsageError
+	}
+	if c.provisionedConcurrency >= 0 && !c.publish && c.alias == "" {
+		log.Printf("-provisioned-concurrency requires -publish or -alias")
+		return subcommands.ExitUsageError
+	}
+
 	var cfg functionConfig
 	cfg.name = args[0]
 
@@ -93,6 +117,7 @@ func (c *UpdateFunctionCommand) Execute(ctx context.Context, flag *flag.FlagSet,
 
 	cfg.memory = c.memory
 	cfg.timeout = c.timeout
+	cfg.storage = c.storage
 
 	if c.create {
 		err = createOrUpdateFunction(ctx, global, &cfg)
@@ -105,6 +130,35 @@ func (c *UpdateFunctionCommand) Execute(ctx context.Context, flag *flag.FlagSet,
 		return subcommands.ExitFailure
 	}
 
+	if c.reservedConcurrency >= 0 {
+		if err := setReservedConcurrency(ctx, global, &cfg, c.reservedConcurrency); err != nil {
+			log.Printf("%s: setting reserved concurrency: %s", cfg.name, err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	if c.publish || c.alias != "" {
+		version, err := publishVersion(ctx, global, &cfg)
+		if err != nil {
+			log.Printf("%s: publishing version: %s", cfg.name, err.Error())
+			return subcommands.ExitFailure
+		}
+		qualifier := version
+		if c.alias != "" {
+			if err := updateAlias(ctx, global, &cfg, c.alias, version); err != nil {
+				log.Printf("%s: updating alias: %s", cfg.name, err.Error())
+				return subcommands.ExitFailure
+			}
+			qualifier = c.alias
+		}
+		if c.provisionedConcurrency >= 0 {
+			if err := setProvisionedConcurrency(ctx, global, &cfg, qualifier, c.provisionedConcurrency); err != nil {
+				log.Printf("%s: setting provisioned concurrency: %s", cfg.name, err.Error())
+				return subcommands.ExitFailure
+			}
+		}
+	}
+
 	return subcommands.ExitSuccess
 }
 
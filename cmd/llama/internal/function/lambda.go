@@ -22,6 +22,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/nelhage/llama/cmd/internal/cli"
 )
@@ -33,18 +34,32 @@ const (
 	defaultMemory = 1769
 
 	defaultTimeout = 60 * time.Second
+
+	minEphemeralStorage = 512
+	maxEphemeralStorage = 10240
 )
 
+// functionEnvironment returns the environment the llama runtime
+// needs to find the object store.
+func functionEnvironment(g *cli.GlobalState) *lambda.Environment {
+	vars := map[string]*string{
+		"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
+	}
+	if g.Config.ShardStore {
+		vars["LLAMA_SHARD_OBJECT_STORE"] = aws.String("1")
+	}
+	if g.Config.TraceArgs {
+		vars["LLAMA_TRACE_ARGS"] = aws.String("1")
+	}
+	return &lambda.Environment{Variables: vars}
+}
+
 func createOrUpdateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig) error {
 	client := lambda.New(g.MustSession())
 	args := &lambda.CreateFunctionInput{
 		FunctionName: aws.String(cfg.name),
 		Role:         aws.String(g.Config.IAMRole),
-		Environment: &lambda.Environment{
-			Variables: map[string]*string{
-				"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
-			},
-		},
+		Environment:  functionEnvironment(g),
 		Tags: map[string]*string{
 			"LlamaFunction": aws.String("true"),
 		},
@@ -66,7 +81,10 @@ func createOrUpdateFunction(ctx context.Context, g *cli.GlobalState, cfg *functi
 
 	_, err := client.CreateFunction(args)
 	if err == nil {
-		return waitForFunction(ctx, client, cfg, "Creating")
+		if err := waitForFunction(ctx, client, cfg, "Creating"); err != nil {
+			return err
+		}
+		return setEphemeralStorage(ctx, client, cfg)
 	}
 	if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 409 {
 		return updateFunction(ctx, g, cfg)
@@ -79,11 +97,7 @@ func updateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig
 	args := &lambda.UpdateFunctionConfigurationInput{
 		FunctionName: aws.String(cfg.name),
 		Role:         aws.String(g.Config.IAMRole),
-		Environment: &lambda.Environment{
-			Variables: map[string]*string{
-				"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
-			},
-		},
+		Environment:  functionEnvironment(g),
 	}
 	if cfg.memory != 0 {
 		args.MemorySize = &cfg.memory
@@ -98,6 +112,9 @@ func updateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig
 	if err := waitForFunction(ctx, client, cfg, "Updating"); err != nil {
 		return err
 	}
+	if err := setEphemeralStorage(ctx, client, cfg); err != nil {
+		return err
+	}
 
 	if cfg.tag != "" {
 		codeArgs := &lambda.UpdateFunctionCodeInput{
@@ -113,6 +130,122 @@ func updateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig
 	return nil
 }
 
+// The version of aws-sdk-go we depend on predates Lambda's support
+// for configurable ephemeral storage, so we issue the
+// UpdateFunctionConfiguration call for it by hand.
+type ephemeralStorage struct {
+	_    struct{} `type:"structure"`
+	Size *int64   `min:"512" type:"integer" required:"true"`
+}
+
+type updateEphemeralStorageInput struct {
+	_                struct{}          `type:"structure"`
+	FunctionName     *string           `location:"uri" locationName:"FunctionName" min:"1" type:"string" required:"true"`
+	EphemeralStorage *ephemeralStorage `type:"structure"`
+}
+
+func ephemeralStorageRequest(client *lambda.Lambda, cfg *functionConfig) *request.Request {
+	op := &request.Operation{
+		Name:       "UpdateFunctionConfiguration",
+		HTTPMethod: "PUT",
+		HTTPPath:   "/2015-03-31/functions/{FunctionName}/configuration",
+	}
+	input := &updateEphemeralStorageInput{
+		FunctionName:     aws.String(cfg.name),
+		EphemeralStorage: &ephemeralStorage{Size: aws.Int64(cfg.storage)},
+	}
+	return client.NewRequest(op, input, &lambda.FunctionConfiguration{})
+}
+
+func setEphemeralStorage(ctx context.Context, client *lambda.Lambda, cfg *functionConfig) error {
+	if cfg.storage == 0 {
+		return nil
+	}
+	req := ephemeralStorageRequest(client, cfg)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return fmt.Errorf("setting ephemeral storage: %w", err)
+	}
+	return waitForFunction(ctx, client, cfg, "Resizing /tmp for")
+}
+
+func publishVersion(ctx context.Context, g *cli.GlobalState, cfg *functionConfig) (string, error) {
+	client := lambda.New(g.MustSession())
+	out, err := client.PublishVersionWithContext(ctx, &lambda.PublishVersionInput{
+		FunctionName: aws.String(cfg.name),
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Published %s version %s", cfg.name, *out.Version)
+	return *out.Version, nil
+}
+
+func updateAlias(ctx context.Context, g *cli.GlobalState, cfg *functionConfig, alias, version string) error {
+	client := lambda.New(g.MustSession())
+	_, err := client.UpdateAliasWithContext(ctx, &lambda.UpdateAliasInput{
+		FunctionName:    aws.String(cfg.name),
+		Name:            aws.String(alias),
+		FunctionVersion: aws.String(version),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+		_, err = client.CreateAliasWithContext(ctx, &lambda.CreateAliasInput{
+			FunctionName:    aws.String(cfg.name),
+			Name:            aws.String(alias),
+			FunctionVersion: aws.String(version),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Pointed %s:%s at version %s", cfg.name, alias, version)
+	return nil
+}
+
+func setReservedConcurrency(ctx context.Context, g *cli.GlobalState, cfg *functionConfig, n int64) error {
+	client := lambda.New(g.MustSession())
+	if n == 0 {
+		_, err := client.DeleteFunctionConcurrencyWithContext(ctx, &lambda.DeleteFunctionConcurrencyInput{
+			FunctionName: aws.String(cfg.name),
+		})
+		return err
+	}
+	_, err := client.PutFunctionConcurrencyWithContext(ctx, &lambda.PutFunctionConcurrencyInput{
+		FunctionName:                 aws.String(cfg.name),
+		ReservedConcurrentExecutions: aws.Int64(n),
+	})
+	if err == nil {
+		log.Printf("Reserved %d concurrent executions for %s; other functions in the account can no longer use them.", n, cfg.name)
+	}
+	return err
+}
+
+func setProvisionedConcurrency(ctx context.Context, g *cli.GlobalState, cfg *functionConfig, qualifier string, n int64) error {
+	client := lambda.New(g.MustSession())
+	if n == 0 {
+		_, err := client.DeleteProvisionedConcurrencyConfigWithContext(ctx, &lambda.DeleteProvisionedConcurrencyConfigInput{
+			FunctionName: aws.String(cfg.name),
+			Qualifier:    aws.String(qualifier),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeProvisionedConcurrencyConfigNotFoundException {
+			return nil
+		}
+		return err
+	}
+	_, err := client.PutProvisionedConcurrencyConfigWithContext(ctx, &lambda.PutProvisionedConcurrencyConfigInput{
+		FunctionName:                    aws.String(cfg.name),
+		Qualifier:                       aws.String(qualifier),
+		ProvisionedConcurrentExecutions: aws.Int64(n),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Provisioning %d warm execution environments for %s:%s.", n, cfg.name, qualifier)
+	log.Printf("WARNING: provisioned concurrency is billed for as long as it is configured, even when idle.")
+	log.Printf("Pass -provisioned-concurrency 0 to remove it.")
+	return nil
+}
+
 func waitForFunction(ctx context.Context, client *lambda.Lambda, config *functionConfig, prompt string) error {
 	args := &lambda.GetFunctionInput{FunctionName: &config.name}
 	log.Printf("%s function %s...", prompt, config.name)
@@ -0,0 +1,43 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEphemeralStorageRequest(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.NoError(t, err)
+
+	req := ephemeralStorageRequest(lambda.New(sess), &functionConfig{name: "gcc", storage: 4096})
+	require.NoError(t, req.Build())
+	assert.Equal(t, "PUT", req.HTTPRequest.Method)
+	assert.Equal(t, "/2015-03-31/functions/gcc/configuration", req.HTTPRequest.URL.Path)
+	body, err := ioutil.ReadAll(req.GetBody())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"EphemeralStorage":{"Size":4096}}`, string(body))
+}
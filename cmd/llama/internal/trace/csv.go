@@ -55,28 +55,19 @@ func collectGlobal(tree *TraceTree) map[string]interface{} {
 	return global
 }
 
-func treeToCSV(w *csv.Writer, tree *TraceTree, extra []string) {
+func spansToCSV(w *csv.Writer, spans []flatSpan, extra []string) {
 	var words []string
-
-	global := collectGlobal(tree)
-
-	var walk func(t *TraceTree, path string)
-	walk = func(t *TraceTree, path string) {
-		if path == "" {
-			path = t.span.Name
-		} else {
-			path = fmt.Sprintf("%s>%s", path, t.span.Name)
-		}
+	for _, s := range spans {
 		words = append(words[:0],
-			t.span.TraceId, t.span.ParentId, t.span.SpanId,
-			path, fmt.Sprintf("%d.%09d", t.span.Start.UTC().Unix(), t.span.Start.Nanosecond()),
-			strconv.FormatInt(t.span.Duration.Nanoseconds(), 10),
+			s.span.TraceId, s.span.ParentId, s.span.SpanId,
+			s.path, fmt.Sprintf("%d.%09d", s.span.Start.UTC().Unix(), s.span.Start.Nanosecond()),
+			strconv.FormatInt(s.span.Duration.Nanoseconds(), 10),
 		)
-		fields := make(map[string]interface{}, len(global)+len(t.span.Fields))
-		for k, v := range global {
+		fields := make(map[string]interface{}, len(s.global)+len(s.span.Fields))
+		for k, v := range s.global {
 			fields[k] = v
 		}
-		for k, v := range t.span.Fields {
+		for k, v := range s.span.Fields {
 			fields[k] = v
 		}
 		out, err := json.Marshal(fields)
@@ -89,11 +80,7 @@ func treeToCSV(w *csv.Writer, tree *TraceTree, extra []string) {
 			words = append(words, stringify(v))
 		}
 		w.Write(words)
-		for _, child := range t.children {
-			walk(child, path)
-		}
 	}
-	walk(tree, "")
 }
 
 func (c *TraceCommand) WriteCSV(spans []tracing.Span, trees []*TraceTree) error {
@@ -116,9 +103,9 @@ func (c *TraceCommand) WriteCSV(spans []tracing.Span, trees []*TraceTree) error
 		}, extraColumns...)
 	w.Write(headers)
 
-	for _, tree := range trees {
-		treeToCSV(w, tree, extraColumns)
-	}
+	flat := flattenTrees(trees)
+	sortSpans(flat, c.sort)
+	spansToCSV(w, flat, extraColumns)
 
 	return nil
 }
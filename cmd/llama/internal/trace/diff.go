@@ -0,0 +1,121 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// pathStats totals the spans at one path in a set of traces
+type pathStats struct {
+	count int
+	total time.Duration
+}
+
+func (s *pathStats) mean() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	return s.total / time.Duration(s.count)
+}
+
+func aggregatePaths(spans []flatSpan) map[string]*pathStats {
+	out := make(map[string]*pathStats)
+	for _, s := range spans {
+		st, ok := out[s.path]
+		if !ok {
+			st = &pathStats{}
+			out[s.path] = st
+		}
+		st.count++
+		st.total += s.span.Duration
+	}
+	return out
+}
+
+// pathDelta compares the spans at one path between two sets of
+// traces
+type pathDelta struct {
+	path          string
+	before, after pathStats
+}
+
+// diffPaths compares every path in before and after, those whose
+// total time grew the most first.
+func diffPaths(before, after map[string]*pathStats) []pathDelta {
+	byPath := make(map[string]*pathDelta)
+	get := func(path string) *pathDelta {
+		d, ok := byPath[path]
+		if !ok {
+			d = &pathDelta{path: path}
+			byPath[path] = d
+		}
+		return d
+	}
+	for path, st := range before {
+		get(path).before = *st
+	}
+	for path, st := range after {
+		get(path).after = *st
+	}
+	out := make([]pathDelta, 0, len(byPath))
+	for _, d := range byPath {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		di := out[i].after.total - out[i].before.total
+		dj := out[j].after.total - out[j].before.total
+		if di != dj {
+			return di > dj
+		}
+		return out[i].path < out[j].path
+	})
+	return out
+}
+
+// change describes the relative change from before to after
+func change(before, after time.Duration) string {
+	if before == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*float64(after-before)/float64(before))
+}
+
+func writeDiff(w io.Writer, deltas []pathDelta) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PATH\tCOUNT\tMEAN\tMEAN CHANGE\tTOTAL\tTOTAL CHANGE\n")
+	for _, d := range deltas {
+		meanChange := change(d.before.mean(), d.after.mean())
+		totalChange := change(d.before.total, d.after.total)
+		if d.before.count == 0 {
+			meanChange, totalChange = "new", "new"
+		} else if d.after.count == 0 {
+			meanChange, totalChange = "gone", "gone"
+		}
+		fmt.Fprintf(tw, "%s\t%d -> %d\t%s -> %s\t%s\t%s -> %s\t%s\n",
+			d.path,
+			d.before.count, d.after.count,
+			d.before.mean().Round(time.Millisecond), d.after.mean().Round(time.Millisecond),
+			meanChange,
+			d.before.total.Round(time.Millisecond), d.after.total.Round(time.Millisecond),
+			totalChange,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildPaths(spans []tracing.Span) map[string]*pathStats {
+	return aggregatePaths(flattenTrees(buildTrees(spans)))
+}
+
+func TestDiffPaths(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	before := buildPaths([]tracing.Span{
+		{SpanId: "u1", ParentId: "r1", Name: "upload", Start: t0, Duration: time.Second},
+		{SpanId: "r1", Name: "llamacc", Start: t0, Duration: 4 * time.Second},
+		{SpanId: "u2", ParentId: "r2", Name: "upload", Start: t0, Duration: 3 * time.Second},
+		{SpanId: "p2", ParentId: "r2", Name: "preprocess", Start: t0, Duration: time.Second},
+		{SpanId: "r2", Name: "llamacc", Start: t0, Duration: 4 * time.Second},
+	})
+	after := buildPaths([]tracing.Span{
+		{SpanId: "u1", ParentId: "r1", Name: "upload", Start: t0, Duration: 2 * time.Second},
+		{SpanId: "u1b", ParentId: "r1", Name: "upload", Start: t0, Duration: 3600 * time.Millisecond},
+		{SpanId: "c1", ParentId: "r1", Name: "cache", Start: t0, Duration: 500 * time.Millisecond},
+		{SpanId: "r1", Name: "llamacc", Start: t0, Duration: 6 * time.Second},
+	})
+	assert.Equal(t, &pathStats{count: 2, total: 4 * time.Second}, before["llamacc>upload"])
+	assert.Equal(t, 2*time.Second, before["llamacc>upload"].mean())
+
+	deltas := diffPaths(before, after)
+	var paths []string
+	for _, d := range deltas {
+		paths = append(paths, d.path)
+	}
+	assert.Equal(t, []string{"llamacc>upload", "llamacc>cache", "llamacc>preprocess", "llamacc"}, paths)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeDiff(&buf, deltas))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 5, len(lines))
+	assert.Equal(t, []string{"llamacc>upload", "2", "->", "2", "2s", "->", "2.8s", "+40.0%", "4s", "->", "5.6s", "+40.0%"},
+		strings.Fields(lines[1]))
+	assert.Contains(t, lines[2], "new")
+	assert.Contains(t, lines[3], "gone")
+}
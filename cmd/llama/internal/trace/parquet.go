@@ -15,7 +15,6 @@
 package trace
 
 import (
-	"fmt"
 	"math"
 	"os"
 	"strings"
@@ -172,35 +171,27 @@ func collectParquetSchema(spans []tracing.Span) (map[string]fieldType, *parquets
 	return fields, root
 }
 
-func writeParquetTree(fw *goparquet.FileWriter, fieldTypes map[string]fieldType, tree *TraceTree) error {
-	global := collectGlobal(tree)
-
-	var walk func(t *TraceTree, path string) error
-	walk = func(t *TraceTree, path string) error {
-		if path == "" {
-			path = t.span.Name
-		} else {
-			path = fmt.Sprintf("%s>%s", path, t.span.Name)
-		}
+func writeParquetSpans(fw *goparquet.FileWriter, fieldTypes map[string]fieldType, spans []flatSpan) error {
+	for _, s := range spans {
 		columns := make(map[string]interface{})
 
-		columns["trace_id"] = []byte(t.span.TraceId)
-		columns["span_id"] = []byte(t.span.SpanId)
-		if t.span.ParentId != "" {
-			columns["parent_id"] = []byte(t.span.ParentId)
+		columns["trace_id"] = []byte(s.span.TraceId)
+		columns["span_id"] = []byte(s.span.SpanId)
+		if s.span.ParentId != "" {
+			columns["parent_id"] = []byte(s.span.ParentId)
 		}
-		columns["name"] = []byte(t.span.Name)
-		columns["path"] = []byte(path)
-		columns["start"] = t.span.Start.UnixNano() / 1000
-		columns["duration_us"] = t.span.Duration.Microseconds()
+		columns["name"] = []byte(s.span.Name)
+		columns["path"] = []byte(s.path)
+		columns["start"] = s.span.Start.UnixNano() / 1000
+		columns["duration_us"] = s.span.Duration.Microseconds()
 
 		for k, ty := range fieldTypes {
 			if ty == type_invalid {
 				continue
 			}
-			v := global[k]
+			v := s.global[k]
 			if v == nil {
-				v = t.span.Fields[k]
+				v = s.span.Fields[k]
 			}
 			if v == nil {
 				continue
@@ -233,14 +224,8 @@ func writeParquetTree(fw *goparquet.FileWriter, fieldTypes map[string]fieldType,
 		if err := fw.AddData(columns); err != nil {
 			return err
 		}
-		for _, child := range t.children {
-			if err := walk(child, path); err != nil {
-				return err
-			}
-		}
-		return nil
 	}
-	return walk(tree, "")
+	return nil
 }
 
 func (c *TraceCommand) WriteParquet(spans []tracing.Span, trees []*TraceTree) error {
@@ -260,10 +245,10 @@ func (c *TraceCommand) WriteParquet(spans []tracing.Span, trees []*TraceTree) er
 		goparquet.WithMaxRowGroupSize(2*1024*1024),
 	)
 
-	for _, tree := range trees {
-		if err := writeParquetTree(fw, fieldTypes, tree); err != nil {
-			return err
-		}
+	flat := flattenTrees(trees)
+	sortSpans(flat, c.sort)
+	if err := writeParquetSpans(fw, fieldTypes, flat); err != nil {
+		return err
 	}
 
 	return fw.Close()
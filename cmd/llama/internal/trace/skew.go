@@ -0,0 +1,128 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nelhage/llama/tracing"
+)
+
+// hostField names the span field that identifies the machine a span
+// was recorded on. Spans without it were recorded on the same
+// machine as their parent.
+const hostField = "worker_id"
+
+func hostOf(span *tracing.Span, parentHost string) string {
+	if h, ok := span.Fields[hostField].(string); ok && h != "" {
+		return h
+	}
+	return parentHost
+}
+
+// skewBounds accumulates the constraints on one host's clock
+// offset. Each child span recorded on the host must fit within its
+// parent, which bounds the offset to [lo, hi] for that pair.
+type skewBounds struct {
+	lo, hi time.Duration
+	mids   []time.Duration
+}
+
+func (b *skewBounds) add(lo, hi time.Duration) {
+	if len(b.mids) == 0 || lo > b.lo {
+		b.lo = lo
+	}
+	if len(b.mids) == 0 || hi < b.hi {
+		b.hi = hi
+	}
+	b.mids = append(b.mids, lo+(hi-lo)/2)
+}
+
+// estimate picks the smallest correction consistent with every
+// constraint, or, if they conflict, the median of each pair's
+// best guess.
+func (b *skewBounds) estimate() time.Duration {
+	if b.lo > b.hi {
+		sort.Slice(b.mids, func(i, j int) bool { return b.mids[i] < b.mids[j] })
+		return b.mids[len(b.mids)/2]
+	}
+	if b.lo > 0 {
+		return b.lo
+	}
+	if b.hi < 0 {
+		return b.hi
+	}
+	return 0
+}
+
+// correctSkew estimates each host's clock offset from the spans it
+// recorded under spans from other hosts, and shifts its spans to
+// match. The hosts of root spans are taken as the reference. It
+// returns the offsets it applied.
+func correctSkew(trees []*TraceTree) map[string]time.Duration {
+	offsets := make(map[string]time.Duration)
+	for _, t := range trees {
+		offsets[hostOf(t.span, "")] = 0
+	}
+	// Each pass resolves the hosts whose spans sit under spans
+	// from already-resolved hosts, for traces that cross more
+	// than one machine boundary.
+	for {
+		bounds := make(map[string]*skewBounds)
+		for _, t := range trees {
+			collectSkew(t, hostOf(t.span, ""), offsets, bounds)
+		}
+		if len(bounds) == 0 {
+			break
+		}
+		for host, b := range bounds {
+			offsets[host] = b.estimate()
+			if offsets[host] != 0 {
+				log.Printf("correcting clock skew host=%s d=%s", host, offsets[host])
+			}
+		}
+	}
+	for _, t := range trees {
+		applySkew(t, hostOf(t.span, ""), offsets)
+	}
+	return offsets
+}
+
+func collectSkew(tree *TraceTree, host string, offsets map[string]time.Duration, bounds map[string]*skewBounds) {
+	off, resolved := offsets[host]
+	for _, ch := range tree.children {
+		chHost := hostOf(ch.span, host)
+		if _, ok := offsets[chHost]; resolved && !ok {
+			start := tree.span.Start.Add(off)
+			end := start.Add(tree.span.Duration)
+			b := bounds[chHost]
+			if b == nil {
+				b = &skewBounds{}
+				bounds[chHost] = b
+			}
+			b.add(start.Sub(ch.span.Start), end.Sub(ch.span.Start.Add(ch.span.Duration)))
+		}
+		collectSkew(ch, chHost, offsets, bounds)
+	}
+}
+
+func applySkew(tree *TraceTree, host string, offsets map[string]time.Duration) {
+	tree.span.Start = tree.span.Start.Add(offsets[host])
+	for _, ch := range tree.children {
+		applySkew(ch, hostOf(ch.span, host), offsets)
+	}
+}
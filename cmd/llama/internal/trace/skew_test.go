@@ -0,0 +1,60 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrectSkew(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	remote := map[string]interface{}{hostField: "w1"}
+	// Listed parents first; reversed below, since spans are
+	// recorded as they end
+	spans := []tracing.Span{
+		{SpanId: "root", Name: "llamacc", Start: t0, Duration: 10 * time.Second},
+		{SpanId: "a", ParentId: "root", Name: "invoke", Start: t0.Add(time.Second), Duration: 4 * time.Second},
+		// The remote clock runs 3s ahead
+		{SpanId: "b", ParentId: "a", Name: "runtime.Execute", Fields: remote,
+			Start: t0.Add(5 * time.Second), Duration: 2 * time.Second},
+		{SpanId: "c", ParentId: "b", Name: "exec", Start: t0.Add(5500 * time.Millisecond), Duration: time.Second},
+		{SpanId: "d", ParentId: "root", Name: "invoke", Start: t0.Add(6 * time.Second), Duration: 3 * time.Second},
+		{SpanId: "e", ParentId: "d", Name: "runtime.Execute", Fields: remote,
+			Start: t0.Add(9500 * time.Millisecond), Duration: 2 * time.Second},
+	}
+	for i, j := 0, len(spans)-1; i < j; i, j = i+1, j-1 {
+		spans[i], spans[j] = spans[j], spans[i]
+	}
+	trees := buildTrees(spans)
+	require.Equal(t, 1, len(trees))
+	offsets := correctSkew(trees)
+
+	assert.Equal(t, time.Duration(0), offsets[""])
+	assert.Equal(t, -2500*time.Millisecond, offsets["w1"])
+	byId := make(map[string]*tracing.Span)
+	trees[0].EachSpan(func(s *tracing.Span) error {
+		byId[s.SpanId] = s
+		return nil
+	})
+	assert.Equal(t, t0.Add(time.Second), byId["a"].Start)
+	assert.Equal(t, t0.Add(2500*time.Millisecond), byId["b"].Start)
+	assert.Equal(t, t0.Add(3*time.Second), byId["c"].Start)
+	assert.Equal(t, t0.Add(7*time.Second), byId["e"].Start)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nelhage/llama/tracing"
+)
+
+// flatSpan is a span, along with its path from the root of its trace
+// tree and the tree's global fields.
+type flatSpan struct {
+	span   *tracing.Span
+	path   string
+	global map[string]interface{}
+}
+
+// flattenTrees lists every span in trees, in tree-walk order.
+func flattenTrees(trees []*TraceTree) []flatSpan {
+	var out []flatSpan
+	for _, tree := range trees {
+		global := collectGlobal(tree)
+		var walk func(t *TraceTree, path string)
+		walk = func(t *TraceTree, path string) {
+			if path == "" {
+				path = t.span.Name
+			} else {
+				path = fmt.Sprintf("%s>%s", path, t.span.Name)
+			}
+			out = append(out, flatSpan{span: t.span, path: path, global: global})
+			for _, child := range t.children {
+				walk(child, path)
+			}
+		}
+		walk(tree, "")
+	}
+	return out
+}
+
+var sortKeys = []string{"duration", "start", "name"}
+
+// sortSpans orders spans by key: longest duration first, or earliest
+// start, or name. Spans that tie, or all of them if key is "", keep
+// their order.
+func sortSpans(spans []flatSpan, key string) {
+	var less func(a, b *tracing.Span) bool
+	switch key {
+	case "":
+		return
+	case "duration":
+		less = func(a, b *tracing.Span) bool { return a.Duration > b.Duration }
+	case "start":
+		less = func(a, b *tracing.Span) bool { return a.Start.Before(b.Start) }
+	case "name":
+		less = func(a, b *tracing.Span) bool { return a.Name < b.Name }
+	default:
+		panic(fmt.Sprintf("sortSpans: unknown key %q", key))
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return less(spans[i].span, spans[j].span)
+	})
+}
+
+func validSortKey(key string) bool {
+	for _, k := range sortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
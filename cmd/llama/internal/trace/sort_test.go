@@ -0,0 +1,61 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortSpans(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	spans := []tracing.Span{
+		{SpanId: "c", ParentId: "root", Name: "upload", Start: t0.Add(2 * time.Second), Duration: 3 * time.Second},
+		{SpanId: "b", ParentId: "root", Name: "invoke", Start: t0.Add(time.Second), Duration: 7 * time.Second},
+		{SpanId: "root", Name: "llamacc", Start: t0, Duration: 10 * time.Second,
+			Fields: map[string]interface{}{"global.build_id": "x"}},
+	}
+	trees := buildTrees(spans)
+	flat := flattenTrees(trees)
+
+	order := func() []string {
+		var out []string
+		for _, s := range flat {
+			out = append(out, s.path)
+		}
+		return out
+	}
+	walked := order()
+	assert.ElementsMatch(t, []string{"llamacc", "llamacc>invoke", "llamacc>upload"}, walked)
+	assert.Equal(t, "llamacc", walked[0])
+	for _, s := range flat {
+		assert.Equal(t, "x", s.global["global.build_id"])
+	}
+
+	sortSpans(flat, "")
+	assert.Equal(t, walked, order())
+	sortSpans(flat, "duration")
+	assert.Equal(t, []string{"llamacc", "llamacc>invoke", "llamacc>upload"}, order())
+	sortSpans(flat, "name")
+	assert.Equal(t, []string{"llamacc>invoke", "llamacc", "llamacc>upload"}, order())
+	sortSpans(flat, "start")
+	assert.Equal(t, []string{"llamacc", "llamacc>invoke", "llamacc>upload"}, order())
+
+	assert.True(t, validSortKey("duration"))
+	assert.False(t, validSortKey("size"))
+}
@@ -33,7 +33,9 @@ import (
 
 type TraceCommand struct {
 	zstd        bool
+	diff        bool
 	fixup       bool
+	skew        bool
 	maxTrees    int
 	depth       int
 	csv         string
@@ -42,6 +44,7 @@ type TraceCommand struct {
 	trace       string
 	jaeger      string
 	addFields   string
+	sort        string
 
 	parquet string
 }
@@ -50,11 +53,17 @@ func (*TraceCommand) Name() string     { return "trace" }
 func (*TraceCommand) Synopsis() string { return "Manipulate llama trace files" }
 func (*TraceCommand) Usage() string {
 	return `trace OPTIONS file.trace
+trace OPTIONS -diff before.trace after.trace
+
+The second form compares the time spent in each span path between
+two traces, e.g. of two builds.
 `
 }
 func (c *TraceCommand) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&c.zstd, "zstd", false, "Read zstd-compressed trace files")
+	flags.BoolVar(&c.diff, "diff", false, "Compare time spent in each span path between two trace files")
 	flags.BoolVar(&c.fixup, "fixup", false, "Attempt to fix-up span timestamps to be internally consistent")
+	flags.BoolVar(&c.skew, "skew", false, "Estimate and remove clock skew between the machines that recorded spans")
 	flags.IntVar(&c.maxTrees, "max-trees", 0, "Render only the first N trees")
 	flags.IntVar(&c.depth, "depth", 0, "Render the trace tree only to depth N")
 	flags.StringVar(&c.trace, "trace", "", "Only examine specified trace")
@@ -63,6 +72,8 @@ func (c *TraceCommand) SetFlags(flags *flag.FlagSet) {
 
 	flags.StringVar(&c.csv, "csv", "", "Write annotated spans to CSV")
 	flags.StringVar(&c.csvColumns, "csv-columns", "", "Extra fields to explode into CSV columns")
+	flags.StringVar(&c.sort, "sort", "",
+		fmt.Sprintf("Order CSV and parquet rows by %s, instead of walking each trace tree", strings.Join(sortKeys, ", ")))
 
 	flags.StringVar(&c.traceViewer, "trace-viewer", "", "Write out in Chrome trace-viewer format")
 	flags.StringVar(&c.jaeger, "jaeger", "", "Write out in jaeger JSON format")
@@ -195,20 +206,9 @@ func (c *TraceCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 	if c.depth == 0 {
 		c.depth = 1 << 24
 	}
-	fname := flag.Arg(0)
-	fh, err := os.Open(fname)
-	if err != nil {
-		log.Fatalf("open(%q): %s", fname, err)
-	}
-	defer fh.Close()
-	var r io.Reader = fh
-	if c.zstd {
-		dec, err := zstd.NewReader(r)
-		if err != nil {
-			log.Fatalf("zstd: %s", err.Error())
-		}
-		defer dec.Close()
-		r = dec
+	if c.sort != "" && !validSortKey(c.sort) {
+		log.Printf("-sort: must be one of %s", strings.Join(sortKeys, ", "))
+		return subcommands.ExitUsageError
 	}
 	var extraFields map[string]string
 	if c.addFields != "" {
@@ -222,40 +222,27 @@ func (c *TraceCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 			extraFields[kv[:eq]] = kv[eq+1:]
 		}
 	}
-	decoder := json.NewDecoder(r)
-	var spans []tracing.Span
-	for {
-		var span tracing.Span
-		err := decoder.Decode(&span)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatalf("read json: %s", err.Error())
-		}
-		if span.SpanId == "" {
-			log.Printf("skipping bad span (n=%d): %v", len(spans), span)
-			continue
-		}
-		if c.trace != "" && span.TraceId != c.trace {
-			continue
+	if c.diff {
+		if flag.NArg() != 2 {
+			log.Printf("usage: trace -diff before.trace after.trace")
+			return subcommands.ExitUsageError
 		}
-		if extraFields != nil {
-			if span.Fields == nil {
-				span.Fields = make(map[string]interface{})
-			}
-			for k, v := range extraFields {
-				span.Fields[k] = v
+		var paths [2]map[string]*pathStats
+		for i := range paths {
+			spans, err := c.readSpans(flag.Arg(i), extraFields)
+			if err != nil {
+				log.Fatalf("%s", err.Error())
 			}
+			paths[i] = aggregatePaths(flattenTrees(c.buildTrees(spans)))
 		}
-		spans = append(spans, span)
+		writeDiff(os.Stdout, diffPaths(paths[0], paths[1]))
+		return subcommands.ExitSuccess
 	}
-	trees := buildTrees(spans)
-	if c.fixup {
-		for _, t := range trees {
-			fixupSpans(t)
-		}
+	spans, err := c.readSpans(flag.Arg(0), extraFields)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
 	}
+	trees := c.buildTrees(spans)
 	log.Printf("built %d trace trees", len(trees))
 	sort.Slice(trees, func(i, j int) bool { return trees[i].span.Start.Before(trees[j].span.Start) })
 	if c.maxTrees > 0 && len(trees) > c.maxTrees {
@@ -292,3 +279,65 @@ func (c *TraceCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 
 	return subcommands.ExitFailure
 }
+
+// readSpans reads the spans in the trace file fname that we're
+// examining, adding extraFields to each.
+func (c *TraceCommand) readSpans(fname string, extraFields map[string]string) ([]tracing.Span, error) {
+	fh, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open(%q): %w", fname, err)
+	}
+	defer fh.Close()
+	var r io.Reader = fh
+	if c.zstd {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+	decoder := json.NewDecoder(r)
+	var spans []tracing.Span
+	for {
+		var span tracing.Span
+		err := decoder.Decode(&span)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read json: %w", err)
+		}
+		if span.SpanId == "" {
+			log.Printf("skipping bad span (n=%d): %v", len(spans), span)
+			continue
+		}
+		if c.trace != "" && span.TraceId != c.trace {
+			continue
+		}
+		if extraFields != nil {
+			if span.Fields == nil {
+				span.Fields = make(map[string]interface{})
+			}
+			for k, v := range extraFields {
+				span.Fields[k] = v
+			}
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// buildTrees builds spans into trees, correcting them as requested.
+func (c *TraceCommand) buildTrees(spans []tracing.Span) []*TraceTree {
+	trees := buildTrees(spans)
+	if c.skew {
+		correctSkew(trees)
+	}
+	if c.fixup {
+		for _, t := range trees {
+			fixupSpans(t)
+		}
+	}
+	return trees
+}
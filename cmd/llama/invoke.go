@@ -17,51 +17,110 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/rpc"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"text/template"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/google/subcommands"
 	"github.com/nelhage/llama/cmd/internal/cli"
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/daemon/server"
 	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
+	protofiles "github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
 )
 
 type InvokeCommand struct {
-	stdin  bool
-	logs   bool
-	time   bool
-	files  files.List
-	output files.List
+	stdin     bool
+	stdinFile string
+	logs      bool
+	time      bool
+	files     files.List
+	output    files.List
+
+	timeout   time.Duration
+	qualifier string
+	shell     bool
+
+	measureOnly bool
+	archive     bool
+	pack        bool
+	noDaemon    bool
+	noClobber   bool
+	script      string
+	region      string
 }
 
 func (*InvokeCommand) Name() string     { return "invoke" }
 func (*InvokeCommand) Synopsis() string { return "Invoke a llama command" }
 func (*InvokeCommand) Usage() string {
 	return `invoke FUNCTION-NAME ARGS...
+invoke [OPTIONS] -- ARGS...
+
+The second form invokes $LLAMA_FUNCTION, or the config file's
+default_function.
 `
 }
 
+// withoutFunction reports whether the positional arguments args
+// all follow a "--" in the command line, meaning the user left out
+// the function name.
+func withoutFunction(cmdline, args []string) bool {
+	for i, arg := range cmdline {
+		if arg == "--" {
+			return len(cmdline)-i-1 == len(args)
+		}
+	}
+	return false
+}
+
 func (c *InvokeCommand) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&c.stdin, "stdin", false, "Read from stdin and pass it to the command")
+	flags.StringVar(&c.stdinFile, "stdin-file", "", "Pass the contents of this file to the command as stdin")
 	flags.BoolVar(&c.logs, "logs", false, "Display command invocation logs")
 	flags.BoolVar(&c.time, "time", false, "Display invocation timing")
 	flags.Var(&c.files, "f", "Pass a file through to the invocation")
 	flags.Var(&c.files, "file", "Pass a file through to the invocation")
 	flags.Var(&c.output, "o", "Fetch additional output files")
 	flags.Var(&c.output, "output", "Fetch additional output files")
+	flags.StringVar(&c.script, "script", "", "Run this local script remotely, passing it ARGS, instead of the function's command")
+	flags.BoolVar(&c.shell, "shell", false, "Join the arguments and run them using /bin/sh -c")
+	flags.StringVar(&c.qualifier, "qualifier", "", "Invoke a specific version or alias of the function")
+	flags.StringVar(&c.region, "region", "", "Invoke the function in this AWS region")
+	flags.DurationVar(&c.timeout, "timeout", 0, "Give up on the invocation after this long")
+	flags.BoolVar(&c.archive, "archive", false, "Send inputs and fetch outputs as single archives; faster for many small files")
+	flags.BoolVar(&c.pack, "pack", false, "Pack small input files into a few shared objects, making fewer S3 requests")
+	flags.BoolVar(&c.noClobber, "no-clobber", false, "Fail instead of overwriting output files that already exist")
+	flags.BoolVar(&c.noDaemon, "no-daemon", false, "Invoke directly from this process instead of through the daemon")
+	flags.BoolVar(&c.measureOnly, "measure-only", false, "Report what the invocation would upload and cost, without running it")
 }
 
 func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	global := cli.MustState(ctx)
 
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
 	var args daemon.InvokeWithFilesArgs
 
+	if c.stdin && c.stdinFile != "" {
+		log.Printf("-stdin and -stdin-file are mutually exclusive")
+		return subcommands.ExitUsageError
+	}
 	if c.stdin {
 		stdin, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
@@ -70,10 +129,46 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 		}
 		args.Stdin = stdin
 	}
+	if c.stdinFile != "" {
+		stdin, err := ioutil.ReadFile(c.stdinFile)
+		if err != nil {
+			log.Printf("reading stdin: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		args.Stdin = stdin
+	}
+
+	if c.script != "" {
+		if c.shell {
+			log.Printf("-script and -shell are mutually exclusive")
+			return subcommands.ExitUsageError
+		}
+		script, err := ioutil.ReadFile(c.script)
+		if err != nil {
+			log.Printf("reading script: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		args.Script = script
+	}
+
+	cmdArgs := flag.Args()
+	if withoutFunction(os.Args, cmdArgs) {
+		args.Function = global.Config.Function
+		if args.Function == "" {
+			log.Printf("no function named; set LLAMA_FUNCTION or default_function")
+			return subcommands.ExitUsageError
+		}
+	} else if len(cmdArgs) > 0 {
+		args.Function = cmdArgs[0]
+		cmdArgs = cmdArgs[1:]
+	} else {
+		log.Printf("Usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
 
 	var err error
 	var ioctx files.IOContext
-	args.Args, ioctx, err = prepareArgs(ctx, global, flag.Args()[1:])
+	args.Args, ioctx, err = prepareArgs(ctx, global, cmdArgs)
 	args.Files = c.files.Append(ioctx.Inputs...)
 	args.Outputs = c.output.Append(ioctx.Outputs...)
 
@@ -81,13 +176,17 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 		log.Println("preparing arguments: ", err.Error())
 		return subcommands.ExitFailure
 	}
-
-	cl, err := server.DialWithAutostart(ctx, cli.SocketPath(), rpc.DefaultRPCPath)
-	if err != nil {
-		log.Fatalf("connecting to daemon: %s", err.Error())
+	if c.shell {
+		args.Args = []string{"/bin/sh", "-c", strings.Join(args.Args, " ")}
 	}
-	args.Function = flag.Arg(0)
+
+	args.Qualifier = c.qualifier
+	args.Region = c.region
 	args.ReturnLogs = c.logs
+	args.ArchiveFiles = c.archive
+	args.ArchiveOutputs = c.archive
+	args.PackFiles = c.pack
+	args.NoClobber = c.noClobber
 
 	wd, err := files.WorkingDir()
 	if err != nil {
@@ -96,7 +195,28 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 	args.Files = args.Files.MakeAbsolute(wd)
 	args.Outputs = args.Outputs.MakeAbsolute(wd)
 
-	response, err := cl.InvokeWithFiles(&args)
+	if c.measureOnly {
+		if err := measureInvoke(ctx, global, &args); err != nil {
+			log.Printf("measuring: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	var response *daemon.InvokeWithFilesReply
+	if c.noDaemon {
+		backend, berr := daemonBackend(global)
+		if berr != nil {
+			log.Fatalf("initializing: %s", berr.Error())
+		}
+		response, err = server.InvokeDirect(ctx, backend, &args)
+	} else {
+		cl, derr := server.DialWithAutostart(ctx, global.SocketPath(), rpc.DefaultRPCPath)
+		if derr != nil {
+			log.Fatalf("connecting to daemon: %s", derr.Error())
+		}
+		response, err = cl.InvokeWithFilesContext(ctx, &args)
+	}
 	if err != nil {
 		log.Fatalf("invoke: %s", err.Error())
 	}
@@ -123,20 +243,80 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 		log.Printf("  exec:    %s", response.Timing.Remote.Exec)
 		log.Printf("  upload:  %s", response.Timing.Remote.Upload)
 		log.Printf("  network: %s", response.Timing.Invoke-response.Timing.Remote.E2E)
+		log.Printf("worker:")
+		log.Printf("  request:    %s", response.Worker.RequestId)
+		log.Printf("  log stream: %s", response.Worker.LogStream)
+		log.Printf("  worker id:  %s", response.Worker.WorkerId)
+		usage := &response.Usage
+		log.Printf("usage:")
+		log.Printf("  lambda:  %d ms, %d MB-ms", usage.Lambda.Millis, usage.Lambda.MB_Millis)
+		log.Printf("  s3:      %d reads, %d writes (remote)", usage.S3.Read_Requests, usage.S3.Write_Requests)
+		log.Printf("  cost:    $%.6f", invocationCost(usage))
 	}
 
 	if response.InvokeErr != "" {
 		log.Fatalf("invoke: %s", response.InvokeErr)
 	}
 
-	/*		if ir, ok := err.(*llama.ErrorReturn); ok {
-				if ir.Logs != nil {
-					fmt.Fprintf(os.Stderr, "==== invocation logs ====\n%s\n==== end logs ====\n", ir.Logs)
-				}
-			}
-	*/
+	return subcommands.ExitStatus(response.ExitCode())
+}
 
-	return subcommands.ExitStatus(response.ExitStatus)
+// measureInvoke hashes and sizes the invocation's inputs the way
+// the daemon would upload them, and prints the resulting S3 traffic
+// and an estimate of the Lambda cost.
+func measureInvoke(ctx context.Context, global *cli.GlobalState, args *daemon.InvokeWithFilesArgs) error {
+	meas := store.Measure()
+	maxInline := protocol.MaxInlineBlob
+	upload := args.Files.Upload
+	if args.PackFiles {
+		upload = args.Files.UploadPacked
+	}
+	inputs, err := upload(ctx, meas, maxInline, nil)
+	if err != nil {
+		return err
+	}
+	var inline, inlineBytes int
+	for _, f := range inputs {
+		if f.Err != "" {
+			return fmt.Errorf("%s: %s", f.Path, f.Err)
+		}
+		if f.Ref == "" {
+			inline++
+			inlineBytes += len(f.String) + base64.StdEncoding.EncodedLen(len(f.Bytes))
+		}
+	}
+	for _, data := range [][]byte{args.Stdin, args.Script} {
+		if data == nil {
+			continue
+		}
+		if _, err := protofiles.NewBlob(ctx, meas, data, maxInline); err != nil {
+			return err
+		}
+	}
+
+	var usage protocol.StoreUsage
+	meas.FetchAWSUsage(&usage)
+	s3Cost := float64(usage.Write_Requests)*s3WriteCost + float64(usage.Read_Requests)*s3ReadCost
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Inputs\t%d files\t%d inline (%.1f KB in request)\n",
+		len(inputs), inline, float64(inlineBytes)/1024)
+	fmt.Fprintf(tw, "Upload\t%d objects\t%.1f MB at most\n", meas.Objects, float64(meas.Bytes)/(1024*1024))
+	fmt.Fprintf(tw, "S3 requests\t%d PUT, %d HEAD\t$%.4f at most\n", usage.Write_Requests, usage.Read_Requests, s3Cost)
+
+	input := &lambda.GetFunctionConfigurationInput{FunctionName: &args.Function}
+	if args.Qualifier != "" {
+		input.Qualifier = &args.Qualifier
+	}
+	fn, err := lambda.New(global.MustSession()).GetFunctionConfigurationWithContext(ctx, input)
+	if err != nil {
+		tw.Flush()
+		return fmt.Errorf("looking up function %s: %w", args.Function, err)
+	}
+	mb := aws.Int64Value(fn.MemorySize)
+	fmt.Fprintf(tw, "Lambda\t%d MB\t$%.6f per second, plus $%.7f per request\n",
+		mb, float64(mb)*1000*lambdaMBMsCost, lambdaRequestCost)
+	return tw.Flush()
 }
 
 func prepareArgs(ctx context.Context, global *cli.GlobalState, args []string) ([]string, files.IOContext, error) {
@@ -0,0 +1,88 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// logFileMaxSize is how large a daemon log file grows before it is
+// rotated.
+const logFileMaxSize = 10 << 20
+
+// rotatingFile appends to a log file, moving it aside to PATH.1 once
+// it grows past maxSize. Only one old file is kept.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	fh      *os.File
+	size    int64
+
+	// If set, standard error follows the current file
+	stderr bool
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	fh, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	r.fh = fh
+	r.size = st.Size()
+	if r.stderr {
+		return redirectStderr(fh)
+	}
+	return nil
+}
+
+// captureStderr sends the process's standard error to the log file,
+// now and after each rotation, so that output that bypasses the log
+// package, such as a panic trace, isn't lost.
+func (r *rotatingFile) captureStderr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stderr = true
+	return redirectStderr(r.fh)
+}
+
+func (r *rotatingFile) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		r.fh.Close()
+		os.Rename(r.path, r.path+".1")
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.fh.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
@@ -40,10 +40,16 @@ func main() {
 	subcommands.Register(&bootstrap.BootstrapCommand{}, "config")
 	subcommands.Register(&ConfigCommand{}, "config")
 	subcommands.Register(&function.UpdateFunctionCommand{}, "config")
+	subcommands.Register(&function.DoctorCommand{}, "config")
 
 	subcommands.Register(&InvokeCommand{}, "")
 	subcommands.Register(&XargsCommand{}, "")
 	subcommands.Register(&DaemonCommand{}, "")
+	subcommands.Register(&BenchCommand{}, "")
+	subcommands.Register(&GCCommand{}, "")
+	subcommands.Register(&TrainDictCommand{}, "")
+	subcommands.Register(&CCServerCommand{}, "")
+	subcommands.Register(&CCBatchCommand{}, "")
 
 	subcommands.Register(&StoreCommand{}, "internals")
 	subcommands.Register(&GetCommand{}, "internals")
@@ -62,12 +68,14 @@ const defaultStoreConcurrency = 8
 func runLlama(ctx context.Context) int {
 	var regionOverride string
 	var storeOverride string
+	var socketOverride string
 	debugAWS := false
 	var storeConcurrency int
 	var trace string
 	var cpuProfile, memProfile string
 	flag.StringVar(&regionOverride, "region", "", "AWS region")
 	flag.StringVar(&storeOverride, "store", "", "Path to the llama object store. s3://BUCKET/PATH")
+	flag.StringVar(&socketOverride, "socket", "", "Path to the llama daemon's socket")
 	flag.BoolVar(&debugAWS, "debug-aws", false, "Log all AWS requests/responses")
 	flag.IntVar(&storeConcurrency, "s3-concurrency", defaultStoreConcurrency, "Maximum concurrent S3 uploads/downloads")
 	flag.StringVar(&trace, "trace", "", "Write tracing data to file")
@@ -122,27 +130,32 @@ func runLlama(ctx context.Context) int {
 		defer wt.Close()
 	}
 
-	cfg, err := cli.ReadConfig(cli.ConfigPath())
+	loadConfig := func() (*cli.Config, error) {
+		cfg, err := cli.LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		if storeOverride != "" {
+			cfg.Store = storeOverride
+		}
+		if storeConcurrency != defaultStoreConcurrency || cfg.S3Concurrency == 0 {
+			cfg.S3Concurrency = storeConcurrency
+		}
+		if regionOverride != "" {
+			cfg.Region = regionOverride
+		}
+		cfg.DebugAWS = debugAWS
+		cfg.Socket = socketOverride
+		return cfg, nil
+	}
+	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatalf("reading config file: %s", err.Error())
 	}
 
-	if storeOverride == "" {
-		storeOverride = os.Getenv("LLAMA_OBJECT_STORE")
-	}
-	if storeOverride != "" {
-		cfg.Store = storeOverride
-	}
-	if storeConcurrency != defaultStoreConcurrency || cfg.S3Concurrency == 0 {
-		cfg.S3Concurrency = storeConcurrency
-	}
-	if regionOverride != "" {
-		cfg.Region = regionOverride
-	}
-	cfg.DebugAWS = debugAWS
-
 	var state cli.GlobalState
 	state.Config = cfg
+	state.LoadConfig = loadConfig
 
 	ctx = cli.WithState(ctx, &state)
 
@@ -17,31 +17,44 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/nelhage/llama/cmd/internal/cli"
 	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/s3store"
 )
 
 type StoreCommand struct {
+	du    bool
+	byAge bool
 }
 
 func (*StoreCommand) Name() string     { return "store" }
 func (*StoreCommand) Synopsis() string { return "Store an object to the llama object store" }
 func (*StoreCommand) Usage() string {
 	return `store PATH
+store -du [-by-age]
 `
 }
 
 func (c *StoreCommand) SetFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&c.du, "du", false, "Report the size and number of objects in the store")
+	flags.BoolVar(&c.byAge, "by-age", false, "With -du, break usage down by object age")
 }
 
 func (c *StoreCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	global := cli.MustState(ctx)
 
+	if c.du {
+		return c.diskUsage(ctx, global)
+	}
+
 	for _, arg := range flag.Args() {
 		bytes, err := ioutil.ReadFile(arg)
 		if err != nil {
@@ -60,6 +73,74 @@ func (c *StoreCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 	return subcommands.ExitSuccess
 }
 
+// s3StorageCost is the monthly cost of S3 Standard storage, per GB
+const s3StorageCost = 0.023
+
+type usageBucket struct {
+	label   string
+	maxAge  time.Duration
+	objects int64
+	bytes   int64
+}
+
+func newUsageBuckets() []usageBucket {
+	return []usageBucket{
+		{label: "< 1 day", maxAge: 24 * time.Hour},
+		{label: "< 7 days", maxAge: 7 * 24 * time.Hour},
+		{label: "< 28 days", maxAge: 28 * 24 * time.Hour},
+		{label: "older"},
+	}
+}
+
+// addUsage accounts an object of the given age and size to the first
+// bucket it fits in. The last bucket catches everything else.
+func addUsage(buckets []usageBucket, age time.Duration, size int64) {
+	for i := range buckets {
+		if i == len(buckets)-1 || age < buckets[i].maxAge {
+			buckets[i].objects++
+			buckets[i].bytes += size
+			return
+		}
+	}
+}
+
+func (c *StoreCommand) diskUsage(ctx context.Context, global *cli.GlobalState) subcommands.ExitStatus {
+	st, ok := global.MustStore().(*s3store.Store)
+	if !ok {
+		log.Printf("store -du: unsupported object store")
+		return subcommands.ExitFailure
+	}
+
+	now := time.Now()
+	buckets := newUsageBuckets()
+	var total usageBucket
+	err := st.ListObjects(ctx, func(obj *s3store.ObjectInfo) error {
+		total.objects++
+		total.bytes += obj.Size
+		addUsage(buckets, now.Sub(obj.LastModified), obj.Size)
+		return nil
+	})
+	if err != nil {
+		log.Printf("listing objects: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "age\tobjects\tMB\t$/month\n")
+	if c.byAge {
+		for _, b := range buckets {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t$%.2f\n",
+				b.label, b.objects, b.bytes>>20,
+				float64(b.bytes)*s3StorageCost/(1024*1024*1024))
+		}
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t$%.2f\n",
+		total.objects, total.bytes>>20,
+		float64(total.bytes)*s3StorageCost/(1024*1024*1024))
+	tw.Flush()
+	return subcommands.ExitSuccess
+}
+
 type GetCommand struct {
 }
 
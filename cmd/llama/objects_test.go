@@ -0,0 +1,38 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddUsage(t *testing.T) {
+	buckets := newUsageBuckets()
+	addUsage(buckets, time.Hour, 10)
+	addUsage(buckets, 2*24*time.Hour, 20)
+	addUsage(buckets, 3*24*time.Hour, 30)
+	addUsage(buckets, 90*24*time.Hour, 40)
+
+	var objects, bytes []int64
+	for _, b := range buckets {
+		objects = append(objects, b.objects)
+		bytes = append(bytes, b.bytes)
+	}
+	assert.Equal(t, []int64{1, 2, 0, 1}, objects)
+	assert.Equal(t, []int64{10, 50, 0, 40}, bytes)
+}
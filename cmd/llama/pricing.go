@@ -0,0 +1,40 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "github.com/nelhage/llama/protocol"
+
+// AWS list prices in USD, used by `daemon -stats` and `invoke
+// -measure-only` to estimate costs.
+const (
+	// Lambda compute, per MB-millisecond
+	lambdaMBMsCost = 0.0000166667 / 1000000
+	// Lambda requests, per request
+	lambdaRequestCost = 0.20 / 1000000
+	// S3 PUT and GET requests
+	s3WriteCost = 0.005 / 1000
+	s3ReadCost  = 0.0004 / 1000
+	// S3 data transfer out to the internet, per byte
+	s3XferOutCost = 0.09 / (1024 * 1024 * 1024)
+)
+
+// invocationCost estimates the cost of the usage reported for a
+// single invocation.
+func invocationCost(u *protocol.UsageMetrics) float64 {
+	return float64(u.Lambda.MB_Millis)*lambdaMBMsCost +
+		float64(u.Lambda.Requests)*lambdaRequestCost +
+		float64(u.S3.Write_Requests)*s3WriteCost +
+		float64(u.S3.Read_Requests)*s3ReadCost
+}
@@ -0,0 +1,27 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// maxNofile returns the highest RLIMIT_NOFILE we should try. macOS
+// reports an unlimited hard limit, but caps each process at
+// kern.maxfilesperproc.
+func maxNofile(hard uint64) uint64 {
+	if perProc, err := unix.SysctlUint32("kern.maxfilesperproc"); err == nil && uint64(perProc) < hard {
+		return uint64(perProc)
+	}
+	return hard
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows,!darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// maxNofileCap bounds the limit we ask for if the hard limit is
+// unlimited.
+const maxNofileCap = 1 << 20
+
+// maxNofile returns the highest RLIMIT_NOFILE we should try.
+func maxNofile(hard uint64) uint64 {
+	if hard == unix.RLIM_INFINITY || hard > maxNofileCap {
+		return maxNofileCap
+	}
+	return hard
+}
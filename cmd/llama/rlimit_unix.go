@@ -0,0 +1,48 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// raiseRlimits raises the soft limit on open files as far as the OS
+// allows, since huge parallel builds can hold a lot of files and
+// connections open at once.
+func raiseRlimits() {
+	var limits unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limits); err != nil {
+		log.Printf("Warning: Unable to read RLIMIT_NOFILE: %s", err.Error())
+		return
+	}
+	current := limits.Cur
+	// The kernel may refuse limits it advertises as allowed (e.g.
+	// RLIM_INFINITY on macOS), so back off until one sticks.
+	for target := maxNofile(limits.Max); target > current; target /= 2 {
+		limits.Cur = target
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &limits); err == nil {
+			break
+		} else if target/2 <= current {
+			log.Printf("Warning: setting RLIMIT_NOFILE: %s", err.Error())
+		}
+	}
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limits); err == nil {
+		log.Printf("open file limit: %d", limits.Cur)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/s3store"
+)
+
+type TrainDictCommand struct {
+	samples  int
+	maxSize  int64
+	dictSize int
+}
+
+func (*TrainDictCommand) Name() string { return "train-dict" }
+func (*TrainDictCommand) Synopsis() string {
+	return "Train a zstd dictionary on objects in the object store"
+}
+func (*TrainDictCommand) Usage() string {
+	return `train-dict [flags]
+
+Samples small objects from the object store, trains a zstd dictionary
+on them using the zstd command-line tool, and stores the dictionary
+in the object store. Set "zstd_dictionary" in llama.json to the ID it
+prints to compress new objects with it.
+`
+}
+
+func (c *TrainDictCommand) SetFlags(flags *flag.FlagSet) {
+	flags.IntVar(&c.samples, "samples", 2000, "Train on at most this many objects")
+	flags.Int64Var(&c.maxSize, "max-size", 64<<10, "Only sample objects at most this large, compressed")
+	flags.IntVar(&c.dictSize, "dict-size", 110<<10, "Maximum dictionary size")
+}
+
+func (c *TrainDictCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	// The dictionary must itself be stored without one, so don't
+	// use the configured store.
+	st, err := s3store.FromSessionAndOptions(global.MustSession(), global.Config.Store,
+		s3store.Options{ShardKeys: global.Config.ShardStore})
+	if err != nil {
+		log.Printf("initializing store: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	ids, err := c.sample(ctx, st)
+	if err != nil {
+		log.Printf("listing objects: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	if len(ids) == 0 {
+		log.Printf("no objects smaller than %d bytes to train on", c.maxSize)
+		return subcommands.ExitFailure
+	}
+
+	dir, err := ioutil.TempDir("", "llama-train-dict")
+	if err != nil {
+		log.Printf("creating temporary directory: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	defer os.RemoveAll(dir)
+	samples := path.Join(dir, "samples")
+	if err := os.Mkdir(samples, 0700); err != nil {
+		log.Printf("creating temporary directory: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	gets := make([]store.GetRequest, len(ids))
+	for i, id := range ids {
+		gets[i].Id = id
+	}
+	st.GetObjects(ctx, gets)
+	written := 0
+	for _, get := range gets {
+		if get.Err != nil {
+			continue
+		}
+		if err := ioutil.WriteFile(path.Join(samples, strconv.Itoa(written)), get.Data, 0600); err != nil {
+			log.Printf("writing sample: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		written++
+	}
+	log.Printf("training on %d objects", written)
+
+	dictPath := path.Join(dir, "dict")
+	cmd := exec.CommandContext(ctx, "zstd", "--train", "-q", "-r", samples,
+		fmt.Sprintf("--maxdict=%d", c.dictSize), "-o", dictPath)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("running zstd --train: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	dict, err := ioutil.ReadFile(dictPath)
+	if err != nil {
+		log.Printf("reading dictionary: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	id, err := st.Store(ctx, dict)
+	if err != nil {
+		log.Printf("storing dictionary: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	fmt.Println(id)
+	return subcommands.ExitSuccess
+}
+
+// sample returns the IDs of up to c.samples objects no larger than
+// c.maxSize, chosen uniformly at random.
+func (c *TrainDictCommand) sample(ctx context.Context, st *s3store.Store) ([]string, error) {
+	var ids []string
+	seen := 0
+	err := st.ListObjects(ctx, func(obj *s3store.ObjectInfo) error {
+		if obj.Size > c.maxSize {
+			return nil
+		}
+		seen++
+		if len(ids) < c.samples {
+			ids = append(ids, obj.Id)
+		} else if i := rand.Intn(seen); i < c.samples {
+			ids[i] = obj.Id
+		}
+		return nil
+	})
+	return ids, err
+}
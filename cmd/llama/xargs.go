@@ -25,6 +25,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 
 	"github.com/aws/aws-sdk-go/service/lambda"
@@ -40,9 +41,14 @@ import (
 type XargsCommand struct {
 	logs        bool
 	files       files.List
+	outputs     stringList
 	concurrency int
+	qualifier   string
+	regions     string
 
-	lambda   *lambda.Lambda
+	// lambdas holds a client per region; jobs take turns
+	lambdas  []*lambda.Lambda
+	next     uint64
 	function string
 	fileMap  protocol.FileList
 }
@@ -58,13 +64,32 @@ func (c *XargsCommand) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&c.logs, "logs", false, "Display command invocation logs")
 	flags.Var(&c.files, "f", "Pass a file through to the invocation")
 	flags.Var(&c.files, "file", "Pass a file through to the invocation")
+	flags.Var(&c.outputs, "o", "Fetch an output file, as PATH or LOCAL:REMOTE; a template, like the arguments")
+	flags.Var(&c.outputs, "output", "Fetch an output file, as PATH or LOCAL:REMOTE; a template, like the arguments")
 	flags.IntVar(&c.concurrency, "j", 100, "Number of concurrent lambdas to execute")
+	flags.StringVar(&c.qualifier, "qualifier", "", "Invoke a specific version or alias of the function")
+	flags.StringVar(&c.regions, "region", "", "Spread invocations across these AWS regions (comma-separated)")
+}
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 type Invocation struct {
 	FormattedArgs   []string
 	TemplateContext jobContext
 	Templates       []*template.Template
+	// OutputTemplates each produce an output, in the same
+	// LOCAL:REMOTE syntax as -o
+	OutputTemplates []*template.Template
 	Args            *llama.InvokeArgs
 	OutputPaths     map[string]string
 	Result          *llama.InvokeResult
@@ -76,16 +101,28 @@ func (c *XargsCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 
 	var err error
 	if len(c.files) > 0 {
-		c.fileMap, err = c.files.Upload(ctx, global.MustStore(), c.fileMap)
+		c.fileMap, err = c.files.Upload(ctx, global.MustStore(), protocol.MaxInlineBlob, c.fileMap)
 		if err != nil {
 			log.Fatalf("files: %s", err.Error())
 		}
 	}
-	c.lambda = lambda.New(global.MustSession())
+	for _, region := range strings.Split(c.regions, ",") {
+		if region == "" {
+			continue
+		}
+		sess, err := global.RegionSession(region)
+		if err != nil {
+			log.Fatalf("region %s: %s", region, err.Error())
+		}
+		c.lambdas = append(c.lambdas, lambda.New(sess))
+	}
+	if len(c.lambdas) == 0 {
+		c.lambdas = []*lambda.Lambda{lambda.New(global.MustSession())}
+	}
 	c.function = flag.Arg(0)
 
 	submit := make(chan *Invocation)
-	go generateJobs(ctx, os.Stdin, flag.Args()[1:], submit)
+	go generateJobs(ctx, os.Stdin, flag.Args()[1:], c.outputs, submit)
 	results := make(chan *Invocation)
 
 	var wg sync.WaitGroup
@@ -145,10 +182,10 @@ func (c *XargsCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 	return code
 }
 
-func prepareTemplates(args []string) ([]*template.Template, error) {
+func prepareTemplates(name string, args []string) ([]*template.Template, error) {
 	var argTemplates []*template.Template
 	for i, arg := range args {
-		tpl, err := template.New(fmt.Sprintf("arg-%d", i)).Parse(arg)
+		tpl, err := template.New(fmt.Sprintf("%s-%d", name, i)).Parse(arg)
 		if err != nil {
 			return nil, fmt.Errorf("template parse error: %q: %w", arg, err)
 		}
@@ -157,8 +194,12 @@ func prepareTemplates(args []string) ([]*template.Template, error) {
 	return argTemplates, nil
 }
 
-func generateJobs(ctx context.Context, lines io.Reader, args []string, out chan<- *Invocation) {
-	argTemplates, err := prepareTemplates(args)
+func generateJobs(ctx context.Context, lines io.Reader, args []string, outputs []string, out chan<- *Invocation) {
+	argTemplates, err := prepareTemplates("arg", args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outputTemplates, err := prepareTemplates("output", outputs)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -182,7 +223,8 @@ func generateJobs(ctx context.Context, lines io.Reader, args []string, out chan<
 				Idx:  i,
 				Line: line,
 			},
-			Templates: argTemplates,
+			Templates:       argTemplates,
+			OutputTemplates: outputTemplates,
 		}
 		out <- &job
 	}
@@ -230,9 +272,18 @@ func prepareInvocation(ctx context.Context,
 		}
 		job.FormattedArgs = append(job.FormattedArgs, w.String())
 	}
+	for _, tpl := range job.OutputTemplates {
+		var w bytes.Buffer
+		if err := tpl.Execute(&w, &job.TemplateContext); err != nil {
+			return nil, err
+		}
+		if err := job.TemplateContext.Outputs.Set(w.String()); err != nil {
+			return nil, err
+		}
+	}
 
 	var allFiles protocol.FileList
-	allFiles, err := job.TemplateContext.Inputs.Upload(ctx, store, globalFiles)
+	allFiles, err := job.TemplateContext.Inputs.Upload(ctx, store, protocol.MaxInlineBlob, globalFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -258,6 +309,7 @@ func (c *XargsCommand) run(ctx context.Context, global *cli.GlobalState, job *In
 	}
 	job.Args = &llama.InvokeArgs{
 		Function:   c.function,
+		Qualifier:  c.qualifier,
 		ReturnLogs: c.logs,
 		Spec:       *spec,
 	}
@@ -265,7 +317,8 @@ func (c *XargsCommand) run(ctx context.Context, global *cli.GlobalState, job *In
 	if job.Err != nil {
 		return
 	}
-	job.Result, job.Err = llama.Invoke(ctx, c.lambda, st, job.Args)
+	n := atomic.AddUint64(&c.next, 1) - 1
+	job.Result, job.Err = llama.Invoke(ctx, c.lambdas[n%uint64(len(c.lambdas))], st, job.Args)
 
 	if job.Err == nil {
 		fetchList, extra := job.TemplateContext.Outputs.TransformToLocal(ctx, job.Result.Response.Outputs)
@@ -285,4 +338,13 @@ func (c *XargsCommand) run(ctx context.Context, global *cli.GlobalState, job *In
 			}
 		}
 	}
+	if job.Err == nil && job.Result.Response.ExitStatus == 0 {
+		var returned []string
+		for _, out := range job.Result.Response.Outputs {
+			returned = append(returned, out.Path)
+		}
+		if missing := job.TemplateContext.Outputs.Missing(returned); len(missing) > 0 {
+			job.Err = fmt.Errorf("command did not produce expected output: %s", strings.Join(missing, ", "))
+		}
+	}
 }
@@ -30,6 +30,7 @@ import (
 	"github.com/nelhage/llama/protocol/files"
 	"github.com/nelhage/llama/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func must(t *testing.T, e error) {
@@ -67,7 +68,7 @@ func generateAndPrepare(
 	input string, args []string) []*protocol.InvocationSpec {
 	read := strings.NewReader(input)
 	jobs := make(chan *Invocation)
-	go generateJobs(context.Background(), read, args, jobs)
+	go generateJobs(context.Background(), read, args, nil, jobs)
 	var specs []*protocol.InvocationSpec
 	for job := range jobs {
 		spec, err := prepareInvocation(ctx, st, files, job)
@@ -145,7 +146,7 @@ func TestPrepareInvocation_Files(t *testing.T) {
 		fileContents = "file 1\n"
 	)
 
-	blob, err := files.NewBlob(ctx, st, []byte(fileContents))
+	blob, err := files.NewBlob(ctx, st, []byte(fileContents), protocol.MaxInlineBlob)
 	must(t, err)
 	files := protocol.FileList{
 		{Path: "file.txt", File: protocol.File{Blob: *blob, Mode: 0644}},
@@ -206,3 +207,26 @@ func TestPrepareInvocation_Files(t *testing.T) {
 	gotFiles = readFiles(t, ctx, st, specs[0].Files)
 	assert.Equal(t, wantFiles, gotFiles, ".I and .AsFile")
 }
+
+func TestPrepareInvocation_OutputFlag(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	jobs := make(chan *Invocation)
+	go generateJobs(ctx, strings.NewReader("a\nb\n"), []string{"gen"},
+		[]string{"result-{{.Idx}}.bin:out.bin", "{{.Line}}.log"}, jobs)
+	var locals [][]string
+	for job := range jobs {
+		spec, err := prepareInvocation(ctx, st, nil, job)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"out.bin", job.TemplateContext.Line + ".log"}, spec.Outputs)
+		var local []string
+		for _, out := range job.TemplateContext.Outputs {
+			local = append(local, out.Local.Path)
+		}
+		locals = append(locals, local)
+	}
+	assert.Equal(t, [][]string{
+		{"result-0.bin", "a.log"},
+		{"result-1.bin", "b.log"},
+	}, locals)
+}
@@ -55,6 +55,7 @@ func initStore() (store.Store, error) {
 	opts := s3store.Options{
 		DiskCachePath:  cacheDir,
 		DiskCacheBytes: DiskCacheLimit,
+		ShardKeys:      os.Getenv("LLAMA_SHARD_OBJECT_STORE") != "",
 	}
 	s3, err := s3store.FromSessionAndOptions(session, url, opts)
 	if err != nil {
@@ -73,6 +74,8 @@ func main() {
 	client := http.Client{}
 	ctx := context.Background()
 
+	cleanStaleTempDirs(os.TempDir())
+
 	store, err := initStore()
 	if err != nil {
 		log.Printf("initialization error: %s", err.Error())
@@ -95,6 +98,8 @@ func main() {
 		store:    store,
 		cmdline:  cmdline,
 		workerId: hex.EncodeToString(workerId[:]),
+
+		traceArgs: os.Getenv("LLAMA_TRACE_ARGS") != "",
 	}
 
 	lambda.StartWithContext(ctx, runtime.RunOne)
@@ -17,17 +17,22 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 
 	"context"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/protocol/files"
 	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -80,8 +85,8 @@ func TestParseJob(t *testing.T) {
 
 	ctx := context.Background()
 	st := store.InMemory()
-	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA))
-	b_txt, _ := files.NewBlob(ctx, st, []byte(contentsB))
+	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA), protocol.MaxInlineBlob)
+	b_txt, _ := files.NewBlob(ctx, st, []byte(contentsB), protocol.MaxInlineBlob)
 
 	cmdline := []string{"/bin/echo", "Hello"}
 	spec := protocol.InvocationSpec{
@@ -119,6 +124,37 @@ func TestParseJob(t *testing.T) {
 	}
 }
 
+func TestParseJobArchive(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	archive, err := files.BuildArchive([]files.ArchiveEntry{
+		{Path: "include/a.h", Data: []byte("from archive\n")},
+		{Path: "b.txt", Data: []byte("overwritten\n")},
+	})
+	require.NoError(t, err)
+	blob, err := files.NewBlob(ctx, st, archive, 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, blob.Ref)
+
+	spec := protocol.InvocationSpec{
+		Archive: blob,
+		Files: protocol.FileList{
+			{Path: "b.txt", File: protocol.File{Blob: protocol.Blob{String: "from files\n"}}},
+		},
+	}
+	r := Runtime{store: st, cmdline: []string{"/bin/true"}}
+	job, err := r.parseJob(ctx, &spec)
+	require.NoError(t, err)
+	defer job.Cleanup()
+
+	data, err := ioutil.ReadFile(path.Join(job.Root, "include/a.h"))
+	require.NoError(t, err)
+	assert.Equal(t, "from archive\n", string(data))
+	data, err = ioutil.ReadFile(path.Join(job.Root, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "from files\n", string(data), "Files are written after the archive")
+}
+
 func TestRunOne(t *testing.T) {
 	const (
 		contentsA = "Hello, A\n"
@@ -126,7 +162,7 @@ func TestRunOne(t *testing.T) {
 
 	ctx := context.Background()
 	st := store.InMemory()
-	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA))
+	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA), protocol.MaxInlineBlob)
 
 	cmdline := []string{"/bin/sh", "-c"}
 	spec := protocol.InvocationSpec{
@@ -137,11 +173,14 @@ func TestRunOne(t *testing.T) {
 		Outputs: []string{"b.txt", "c.txt"},
 	}
 
-	r := Runtime{store: st, cmdline: cmdline}
+	r := Runtime{store: st, cmdline: cmdline, workerId: "w1"}
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "req1"})
 	resp, err := r.RunOne(ctx, &spec)
 	if err != nil {
 		t.Fatal("runOne", err)
 	}
+	assert.Equal(t, protocol.Worker{RequestId: "req1", WorkerId: "w1"}, resp.Worker)
+	assert.Equal(t, protocol.Version, resp.Version)
 
 	// c.txt is not created and will not be included in the
 	// outputs
@@ -154,6 +193,67 @@ func TestRunOne(t *testing.T) {
 	assert.Equal(t, contentsA+"World\n", string(b_txt))
 }
 
+func TestRunOne_TraceArgs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	src, _ := files.NewBlob(ctx, st, []byte("int x;\n"), protocol.MaxInlineBlob)
+
+	spec := protocol.InvocationSpec{
+		Trace: &tracing.Propagation{TraceId: "trace", ParentId: "parent"},
+		Args:  []string{"-o", "out.o", "src/x.c", strings.Repeat("-DX ", 500)},
+		Files: protocol.FileList{
+			{Path: "src/x.c", File: protocol.File{Blob: *src}},
+		},
+	}
+	r := Runtime{store: st, cmdline: []string{"true"}, traceArgs: true}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+
+	var exec *tracing.Span
+	for i, span := range resp.InlineSpans {
+		if span.Name == "exec" {
+			exec = &resp.InlineSpans[i]
+		}
+	}
+	require.NotNil(t, exec)
+	assert.Equal(t, "src/x.c", exec.Fields["input"])
+	args := exec.Fields["args"].(string)
+	assert.True(t, strings.HasPrefix(args, "true -o out.o src/x.c -DX"), args)
+	assert.Equal(t, maxTracedArgs+len("..."), len(args))
+	assert.Len(t, exec.Fields["args_hash"], 16)
+}
+
+func TestRunOne_ArchiveOutputs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args:           []string{`mkdir -p out; for i in 1 2 3; do echo $i > out/$i.txt; done`},
+		Outputs:        []string{"out/1.txt", "out/2.txt", "out/3.txt", "out/4.txt"},
+		ArchiveOutputs: true,
+	}
+
+	r := Runtime{store: st, cmdline: []string{"/bin/sh", "-c"}}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Outputs)
+	require.NotNil(t, resp.OutputArchive)
+
+	archive, err := files.Read(ctx, st, resp.OutputArchive)
+	require.NoError(t, err)
+	got := make(map[string]string)
+	err = files.ReadArchive(archive, func(ent *files.ArchiveEntry) error {
+		got[ent.Path] = string(ent.Data)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"out/1.txt": "1\n",
+		"out/2.txt": "2\n",
+		"out/3.txt": "3\n",
+	}, got)
+}
+
 func TestRunOne_NoCmdLine(t *testing.T) {
 	ctx := context.Background()
 	st := store.InMemory()
@@ -174,3 +274,160 @@ func TestRunOne_NoCmdLine(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, stdout, []byte("hello\n"))
 }
+
+func TestRunOne_Version(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Version: protocol.Version + 1,
+		Args:    []string{`echo`, `hello`},
+	}
+
+	r := Runtime{store: st}
+	_, err := r.RunOne(ctx, &spec)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update-function")
+
+	spec.Version = protocol.Version
+	_, err = r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+}
+
+func TestRunOne_Compressed(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec, err := protocol.CompressSpec(&protocol.InvocationSpec{
+		Version: protocol.Version,
+		Args:    []string{`echo`, `hello`},
+	})
+	require.NoError(t, err)
+
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, spec)
+	require.NoError(t, err)
+
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello\n"), stdout)
+}
+
+func TestRunOne_NestedOutput(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	// llamacc declares `-o` targets as outputs under _root/, and
+	// relies on the runtime to create their parent directories.
+	const out = "_root/home/me/src/build/obj/foo.o"
+	spec := protocol.InvocationSpec{
+		Args:    []string{"/bin/sh", "-c", "echo object > " + out},
+		Outputs: []string{out},
+	}
+
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	require.Equal(t, 1, len(resp.Outputs))
+	assert.Equal(t, out, resp.Outputs[0].Path)
+	data, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+	require.NoError(t, err)
+	assert.Equal(t, "object\n", string(data))
+}
+
+func TestRunOne_GlobOutputs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c",
+			"echo a > build/a.o; echo b > build/b.o; echo c > build/c.d; mkdir build/dir.o"},
+		Outputs: []string{"build/*.o", "build/a.o"},
+	}
+
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	var paths []string
+	for _, out := range resp.Outputs {
+		paths = append(paths, out.Path)
+	}
+	assert.Equal(t, []string{"build/a.o", "build/b.o"}, paths)
+}
+
+func TestRunOne_Script(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Script: &protocol.Blob{String: "#!/bin/sh\necho \"hello, $1\"\n"},
+		Args:   []string{"world"},
+	}
+
+	// The script replaces the function's usual command
+	r := Runtime{store: st, cmdline: []string{"/bin/false"}}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world\n", string(stdout))
+}
+
+func TestRunOne_Panic(t *testing.T) {
+	tmp := t.TempDir()
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	defer os.Setenv("TMPDIR", oldTmp)
+
+	ctx := context.Background()
+	spec := protocol.InvocationSpec{
+		Args: []string{`echo`, `hello`},
+	}
+
+	// With no store, fetching the job's inputs will panic.
+	r := Runtime{}
+	_, err := r.RunOne(ctx, &spec)
+	require.Error(t, err)
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr), "expected a PanicError, got %#v", err)
+
+	ents, err := ioutil.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, ents, "temp directory leaked")
+	assert.Equal(t, 1, r.tempDirsCleaned)
+}
+
+func TestCleanStaleTempDirs(t *testing.T) {
+	tmp := t.TempDir()
+	for _, d := range []string{"llama.123/in", "llama.cache.456", "other"} {
+		require.NoError(t, os.MkdirAll(path.Join(tmp, d), 0755))
+	}
+	cleanStaleTempDirs(tmp)
+	ents, err := ioutil.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ents))
+	assert.Equal(t, "other", ents[0].Name())
+}
+
+func TestCheckTempSpace(t *testing.T) {
+	tmp := t.TempDir()
+	assert.NoError(t, checkTempSpace(tmp, 1))
+	err := checkTempSpace(tmp, 1<<62)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ephemeral storage")
+}
+
+func TestRunOne_Signal(t *testing.T) {
+	ctx := context.Background()
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", "kill -TERM $$"},
+	}
+	r := Runtime{store: store.InMemory()}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, -1, resp.ExitStatus)
+	assert.Equal(t, int(syscall.SIGTERM), resp.Signal)
+}
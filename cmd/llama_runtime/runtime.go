@@ -19,6 +19,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,10 +29,14 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/golang/snappy"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/protocol/files"
@@ -43,6 +49,24 @@ type Runtime struct {
 	cmdline  []string
 	jobCount int
 	workerId string
+
+	// Counts of per-job temporary directories we have removed,
+	// or failed to remove, over the life of this container.
+	tempDirsCleaned int
+	tempDirsLeaked  int
+
+	// If set, record each command's arguments on its exec span
+	traceArgs bool
+}
+
+// PanicError is returned by RunOne if executing a job panics.
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("llama runtime panic: %v", p.Value)
 }
 
 type ParsedJob struct {
@@ -65,20 +89,35 @@ func (p *ParsedJob) TempPath(name string) (string, error) {
 
 const MaxInlineSpans = 100
 
-func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (*protocol.InvocationResponse, error) {
+func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (resp *protocol.InvocationResponse, err error) {
 	start := time.Now()
 
 	var tracer *tracing.MemoryTracer
-	var resp *protocol.InvocationResponse
-	var err error
 
 	r.jobCount += 1
 
+	defer func() {
+		if p := recover(); p != nil {
+			stack := string(debug.Stack())
+			log.Printf("panic executing job: %v\n%s", p, stack)
+			resp = nil
+			err = &PanicError{Value: p, Stack: stack}
+		}
+	}()
+
+	if err := checkVersion(job); err != nil {
+		return nil, err
+	}
+	if job, err = job.Decompress(); err != nil {
+		return nil, err
+	}
+
 	defer func() {
 		if resp == nil {
 			return
 		}
 		r.store.FetchAWSUsage(&resp.Usage.S3)
+		resp.Worker = r.worker(ctx)
 		mem, _ := strconv.ParseUint(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64)
 		resp.Usage.Lambda.Millis = uint64((time.Since(start) + 3*time.Millisecond/2 - 1).Milliseconds())
 		resp.Usage.Lambda.MB_Millis = resp.Usage.Lambda.Millis * mem
@@ -96,13 +135,26 @@ func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (*pr
 		)
 		span.AddField("job_count", r.jobCount)
 		span.AddField("worker_id", r.workerId)
+		if lc, ok := lambdacontext.FromContext(ctx); ok {
+			span.AddField("request_id", lc.AwsRequestID)
+		}
 		defer func() {
+			span.AddField("temp_dirs_cleaned", r.tempDirsCleaned)
+			span.AddField("temp_dirs_leaked", r.tempDirsLeaked)
+			// Count this span, too, so that the
+			// client can tell whether it has them all
+			stats := tracer.Stats()
+			total := stats.Submitted + 1
+			offload := total >= MaxInlineSpans
+			span.AddField("trace.spans", total)
+			span.AddField("trace.dropped", stats.Dropped)
+			span.AddField("trace.offloaded", offload)
 			span.End()
 			if resp == nil {
 				return
 			}
 			spans := tracer.Close()
-			if len(spans) < MaxInlineSpans {
+			if !offload {
 				resp.InlineSpans = spans
 			} else {
 				spandata, err := json.Marshal(spans)
@@ -117,7 +169,7 @@ func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (*pr
 					// would involve an entire
 					// additional layer of
 					// complexity...
-					resp.Spans, err = files.NewBlob(topctx, r.store, compressed)
+					resp.Spans, err = files.NewBlob(topctx, r.store, compressed, protocol.MaxInlineBlob)
 				}
 				if err != nil {
 					resp.Spans = &protocol.Blob{Err: err.Error()}
@@ -131,13 +183,33 @@ func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (*pr
 	return resp, err
 }
 
+func (r *Runtime) worker(ctx context.Context) protocol.Worker {
+	w := protocol.Worker{
+		LogStream: lambdacontext.LogStreamName,
+		WorkerId:  r.workerId,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		w.RequestId = lc.AwsRequestID
+	}
+	return w
+}
+
+func checkVersion(job *protocol.InvocationSpec) error {
+	if job.Version > protocol.Version {
+		return fmt.Errorf("llama runtime is too old (protocol version %d, client sent %d); "+
+			"redeploy the function with `llama update-function`",
+			protocol.Version, job.Version)
+	}
+	return nil
+}
+
 func (r *Runtime) executeJob(ctx context.Context, job *protocol.InvocationSpec) (*protocol.InvocationResponse, error) {
 	t_start := time.Now()
 	parsed, err := r.parseJob(ctx, job)
 	if err != nil {
 		return nil, err
 	}
-	defer parsed.Cleanup()
+	defer r.cleanup(parsed)
 
 	if err := os.MkdirAll(parsed.Root, 0755); err != nil {
 		return nil, err
@@ -176,6 +248,9 @@ func (r *Runtime) executeJob(ctx context.Context, job *protocol.InvocationSpec)
 
 	{
 		_, span := tracing.StartSpan(ctx, "exec")
+		if r.traceArgs {
+			addArgFields(span, parsed.Root, parsed.Args)
+		}
 		if err := cmd.Start(); err != nil {
 			return nil, fmt.Errorf("starting command: %q", err)
 		}
@@ -185,32 +260,60 @@ func (r *Runtime) executeJob(ctx context.Context, job *protocol.InvocationSpec)
 	t_wait := time.Now()
 
 	resp := protocol.InvocationResponse{
+		Version:    protocol.Version,
 		ExitStatus: cmd.ProcessState.ExitCode(),
 	}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		resp.Signal = int(ws.Signal())
+	}
+
+	maxInline := job.MaxInlineResponse
+	if maxInline == 0 {
+		maxInline = protocol.MaxInlineBlob
+	}
 
 	{
 		ctx, span := tracing.StartSpan(ctx, "upload")
-		resp.Stdout, err = files.NewBlob(ctx, r.store, stdout.Bytes())
-		if err != nil {
-			resp.Stdout = &protocol.Blob{Err: err.Error()}
-		}
-		resp.Stderr, err = files.NewBlob(ctx, r.store, stderr.Bytes())
-		if err != nil {
-			resp.Stderr = &protocol.Blob{Err: err.Error()}
-		}
-		for _, out := range job.Outputs {
-			file, err := files.ReadFile(ctx, r.store, path.Join(parsed.Root, out))
+		// Read every output first, so that we can upload them
+		// all in a single batch.
+		datas := [][]byte{stdout.Bytes(), stderr.Bytes()}
+		var outIdxs []int
+		var archived []files.ArchiveEntry
+		for _, out := range expandOutputs(parsed.Root, job.Outputs) {
+			data, mode, err := files.ReadLocal(path.Join(parsed.Root, out))
 			if err != nil {
 				if os.IsNotExist(err) {
 					continue
 				}
-				file = &protocol.File{
-					Blob: protocol.Blob{
-						Err: err.Error(),
-					},
-				}
+				resp.Outputs = append(resp.Outputs, protocol.FileAndPath{
+					Path: out,
+					File: protocol.File{Blob: protocol.Blob{Err: err.Error()}},
+				})
+				continue
 			}
-			resp.Outputs = append(resp.Outputs, protocol.FileAndPath{Path: out, File: *file})
+			if job.ArchiveOutputs {
+				archived = append(archived, files.ArchiveEntry{Path: out, Data: data, Mode: mode})
+				continue
+			}
+			datas = append(datas, data)
+			outIdxs = append(outIdxs, len(resp.Outputs))
+			resp.Outputs = append(resp.Outputs, protocol.FileAndPath{Path: out, File: protocol.File{Mode: mode}})
+		}
+		if len(archived) > 0 {
+			archive, err := files.BuildArchive(archived)
+			if err != nil {
+				return nil, fmt.Errorf("archiving outputs: %w", err)
+			}
+			datas = append(datas, archive)
+		}
+		blobs := files.NewBlobs(ctx, r.store, datas, maxInline)
+		resp.Stdout = &blobs[0]
+		resp.Stderr = &blobs[1]
+		for i, idx := range outIdxs {
+			resp.Outputs[idx].File.Blob = blobs[2+i]
+		}
+		if len(archived) > 0 {
+			resp.OutputArchive = &blobs[len(blobs)-1]
 		}
 		span.End()
 	}
@@ -225,6 +328,79 @@ func (r *Runtime) executeJob(ctx context.Context, job *protocol.InvocationSpec)
 	return &resp, nil
 }
 
+// expandOutputs replaces each glob pattern in outputs with the
+// regular files under root that it matches.
+func expandOutputs(root string, outputs []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, o := range outputs {
+		if !files.IsGlob(o) {
+			if !seen[o] {
+				seen[o] = true
+				out = append(out, o)
+			}
+			continue
+		}
+		matches, err := filepath.Glob(path.Join(root, o))
+		if err != nil {
+			log.Printf("expanding output %q: %s", o, err.Error())
+			continue
+		}
+		for _, m := range matches {
+			if st, err := os.Lstat(m); err != nil || !st.Mode().IsRegular() {
+				continue
+			}
+			rel, err := filepath.Rel(root, m)
+			if err != nil || seen[filepath.ToSlash(rel)] {
+				continue
+			}
+			seen[filepath.ToSlash(rel)] = true
+			out = append(out, filepath.ToSlash(rel))
+		}
+	}
+	return out
+}
+
+func (r *Runtime) cleanup(job *ParsedJob) {
+	if err := job.Cleanup(); err != nil {
+		r.tempDirsLeaked++
+		log.Printf("cleaning up %s: %s (%d leaked so far)", job.Root, err.Error(), r.tempDirsLeaked)
+	} else {
+		r.tempDirsCleaned++
+	}
+}
+
+// scriptName is where a spec's Script is written, relative to the
+// job's root.
+const scriptName = ".llama-script"
+
+// maxTracedArgs bounds the length of the command line recorded on
+// exec spans.
+const maxTracedArgs = 1024
+
+// addArgFields records on span the command line, truncated, along
+// with a hash of all of it, to tell apart commands that share a
+// long prefix. It also records the first argument naming a file in
+// the job's root, which for a compile is the source file.
+func addArgFields(span *tracing.SpanBuilder, root string, args []string) {
+	sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	span.AddField("args_hash", hex.EncodeToString(sum[:8]))
+	argv := strings.Join(args, " ")
+	if len(argv) > maxTracedArgs {
+		argv = argv[:maxTracedArgs] + "..."
+	}
+	span.AddField("args", argv)
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if st, err := os.Stat(path.Join(root, arg)); err == nil && st.Mode().IsRegular() {
+			span.AddField("input", arg)
+			break
+		}
+	}
+}
+
 func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (*ParsedJob, error) {
 
 	var err error
@@ -236,7 +412,18 @@ func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (
 		Root: temp,
 		Args: r.cmdline,
 	}
+	// If we fail, or panic, before handing the job to our
+	// caller, we're responsible for its temp directory.
+	ok := false
+	defer func() {
+		if !ok {
+			r.cleanup(&job)
+		}
+	}()
 
+	if spec.Script != nil {
+		job.Args = []string{path.Join(job.Root, scriptName)}
+	}
 	job.Args = append(job.Args, spec.Args...)
 
 	var gets []store.GetRequest
@@ -244,6 +431,12 @@ func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (
 	if spec.Stdin != nil {
 		gets = files.AppendGet(gets, spec.Stdin)
 	}
+	if spec.Script != nil {
+		gets = files.AppendGet(gets, spec.Script)
+	}
+	if spec.Archive != nil {
+		gets = files.AppendGet(gets, spec.Archive)
+	}
 	for i, file := range spec.Files {
 		spec.Files[i].Path = path.Join(job.Root, file.Path)
 		if err := os.MkdirAll(path.Dir(spec.Files[i].Path), 0755); err != nil {
@@ -253,6 +446,20 @@ func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (
 	}
 	r.store.GetObjects(ctx, gets)
 
+	var need uint64
+	for _, get := range gets {
+		need += uint64(len(get.Data))
+	}
+	for _, f := range spec.Files {
+		need += uint64(len(f.Bytes) + len(f.String))
+	}
+	if spec.Archive != nil {
+		need += uint64(len(spec.Archive.Bytes) + len(spec.Archive.String))
+	}
+	if err := checkTempSpace(temp, need); err != nil {
+		return nil, err
+	}
+
 	if spec.Stdin != nil {
 		var data []byte
 		var err error
@@ -263,6 +470,26 @@ func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (
 		job.Stdin = data
 	}
 
+	if spec.Script != nil {
+		script := protocol.File{Blob: *spec.Script, Mode: 0755}
+		err, gets = files.FetchFile(&script, job.Args[0], gets)
+		if err != nil {
+			return nil, fmt.Errorf("write script: %w", err)
+		}
+	}
+
+	if spec.Archive != nil {
+		var data []byte
+		var err error
+		data, err, gets = files.ReadBlob(spec.Archive, gets)
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		if err := files.ExtractArchive(data, job.Root); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, f := range spec.Files {
 		err, gets = files.FetchFile(&f.File, f.Path, gets)
 		if err != nil {
@@ -271,9 +498,13 @@ func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (
 	}
 
 	for _, f := range spec.Outputs {
+		if files.IsGlob(path.Dir(f)) {
+			continue
+		}
 		if err := os.MkdirAll(path.Join(job.Root, path.Dir(f)), 0755); err != nil {
 			return nil, fmt.Errorf("creating output directory for %q: %s", f, err)
 		}
 	}
+	ok = true
 	return &job, nil
 }
@@ -0,0 +1,61 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build llama.runtime
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// cleanStaleTempDirs removes temporary directories left behind by
+// previous runtime processes in this execution environment. Lambda
+// preserves /tmp across restarts of the runtime, so if we crash
+// mid-job, their contents would otherwise stick around forever.
+func cleanStaleTempDirs(dir string) {
+	stale, err := filepath.Glob(filepath.Join(dir, "llama.*"))
+	if err != nil {
+		return
+	}
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("removing stale temp dir %s: %s", path, err.Error())
+		}
+	}
+	if len(stale) > 0 {
+		log.Printf("removed %d stale temp dirs", len(stale))
+	}
+}
+
+// checkTempSpace returns an error if dir's filesystem has fewer than
+// need bytes available.
+func checkTempSpace(dir string, need uint64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		// If we can't tell, go ahead and try
+		return nil
+	}
+	avail := st.Bavail * uint64(st.Bsize)
+	if need > avail {
+		return fmt.Errorf("insufficient /tmp space: job inputs need %d MB but only %d MB are available; "+
+			"increase the function's ephemeral storage with `llama update-function -ephemeral-storage`",
+			need>>20, avail>>20)
+	}
+	return nil
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -125,6 +126,24 @@ func TestParseCompile(t *testing.T) {
 			},
 			false,
 		},
+		{
+			[]string{"LLAMACC_EXTRA_LOCAL_ARGS=-DLOCAL", "LLAMACC_EXTRA_REMOTE_ARGS=-DREMOTE,-ffile-prefix-map=/src=."},
+			[]string{
+				"cc", "-c", "hello.c", "-o", "hello.o",
+			},
+			Compilation{
+				Language:             "c",
+				PreprocessedLanguage: "cpp-output",
+				Input:                "hello.c",
+				Output:               "hello.o",
+				LocalArgs:            []string{"-DLOCAL"},
+				RemoteArgs:           []string{"-c", "-DREMOTE", "-ffile-prefix-map=/src=."},
+				Flag: Flags{
+					C: true,
+				},
+			},
+			false,
+		},
 	}
 	for i, tc := range tests {
 		tc := tc
@@ -145,6 +164,74 @@ func TestParseCompile(t *testing.T) {
 	}
 }
 
+func TestParseSaveTemps(t *testing.T) {
+	cfg := ParseConfig(nil)
+	for _, arg := range []string{"-save-temps", "-save-temps=obj", "-save-temps=cwd"} {
+		_, err := ParseCompile(&cfg, []string{"cc", arg, "-c", "hello.c"})
+		assert.Error(t, err, arg)
+	}
+}
+
+func TestParseMJ(t *testing.T) {
+	cfg := ParseConfig(nil)
+	for _, argv := range [][]string{
+		{"cc", "-c", "x.c", "-MJ", "x.json"},
+		{"cc", "-c", "x.c", "-MJx.json"},
+	} {
+		_, err := ParseCompile(&cfg, argv)
+		require.Error(t, err, "%q", argv)
+		assert.False(t, errors.Is(err, errDepsOnly), "%q: err=%v", argv, err)
+		assert.Contains(t, err.Error(), "-MJ", "%q", argv)
+	}
+}
+
+func TestParsePrecompiledHeader(t *testing.T) {
+	cfg := ParseConfig(nil)
+	comp, err := ParseCompile(&cfg, []string{"c++", "-x", "c++-header", "-O2", "pch.hpp"})
+	require.NoError(t, err)
+	assert.Equal(t, LangCxxHeader, comp.Language)
+	assert.Equal(t, "pch.hpp", comp.Input)
+	assert.Equal(t, "pch.hpp.gch", comp.Output)
+	assert.Equal(t, "c++", comp.RemoteCompiler(&cfg))
+
+	comp, err = ParseCompile(&cfg, []string{"cc", "-x", "c-header", "-c", "-o", "out/pch.h.gch", "pch.h"})
+	require.NoError(t, err)
+	assert.Equal(t, "pch.h", comp.Input)
+	assert.Equal(t, "out/pch.h.gch", comp.Output)
+
+	// Headers are only inputs when precompiling
+	_, err = ParseCompile(&cfg, []string{"cc", "-c", "pch.h"})
+	assert.Error(t, err)
+
+	comp, err = ParseCompile(&cfg, []string{"clang", "-include-pch", "pch.h.pch", "-include", "pch.h", "-c", "hello.c"})
+	require.NoError(t, err)
+	assert.Equal(t, []Include{{"-include-pch", "pch.h.pch"}, {"-include", "pch.h"}}, comp.Includes)
+}
+
+func TestParseDepsOnly(t *testing.T) {
+	cases := []struct {
+		argv     []string
+		depsOnly bool
+	}{
+		{[]string{"cc", "-M", "hello.c"}, true},
+		{[]string{"cc", "-MM", "-MT", "hello.o", "-MF", "hello.d", "hello.c"}, true},
+		{[]string{"cc", "-MM", "-MG", "-MQ", "$(obj)", "hello.c"}, true},
+		{[]string{"cc", "-M", "-c", "hello.c"}, true},
+		{[]string{"cc", "-MMD", "-MQ", "hello.o", "-c", "hello.c"}, false},
+		{[]string{"cc", "-MD", "-MP", "-c", "hello.c"}, false},
+		{[]string{"cc", "-MMx", "-c", "hello.c"}, false},
+	}
+	for _, tc := range cases {
+		cfg := ParseConfig(nil)
+		_, err := ParseCompile(&cfg, tc.argv)
+		if tc.depsOnly {
+			assert.True(t, errors.Is(err, errDepsOnly), "%q: err=%v", tc.argv, err)
+		} else {
+			assert.NoError(t, err, "%q", tc.argv)
+		}
+	}
+}
+
 func TestRewriteWp(t *testing.T) {
 	cases := []struct {
 		in  []string
@@ -168,3 +255,34 @@ func TestRewriteWp(t *testing.T) {
 		assert.Equal(t, tc.out, got)
 	}
 }
+
+func TestHasColorOption(t *testing.T) {
+	cases := []struct {
+		argv []string
+		want bool
+	}{
+		{[]string{"cc", "-c", "hello.c"}, false},
+		{[]string{"cc", "-fdiagnostics-color=never", "-c", "hello.c"}, true},
+		{[]string{"cc", "-fno-diagnostics-color", "-c", "hello.c"}, true},
+		{[]string{"clang", "-fcolor-diagnostics", "-c", "hello.c"}, true},
+	}
+	for _, tc := range cases {
+		cfg := ParseConfig(nil)
+		comp, err := ParseCompile(&cfg, tc.argv)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, comp.HasColorOption(), "%q", tc.argv)
+	}
+}
+
+func TestDirectivesOnly(t *testing.T) {
+	cfg := ParseConfig(nil)
+	full := ParseConfig([]string{"LLAMACC_FULL_PREPROCESS=1"})
+
+	c := Compilation{Language: LangC}
+	assert.True(t, c.DirectivesOnly(&cfg))
+	assert.False(t, c.DirectivesOnly(&full))
+
+	asm := Compilation{Language: LangAssemblerWithCpp}
+	assert.False(t, asm.DirectivesOnly(&cfg))
+	assert.False(t, asm.DirectivesOnly(&full))
+}
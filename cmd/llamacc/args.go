@@ -28,6 +28,8 @@ const (
 	LangCxx              Lang = "c++"
 	LangAssembler        Lang = "assembler"
 	LangAssemblerWithCpp Lang = "assembler-with-cpp"
+	LangCHeader          Lang = "c-header"
+	LangCxxHeader        Lang = "c++-header"
 )
 
 var knownLangs = map[string]Lang{
@@ -35,6 +37,18 @@ var knownLangs = map[string]Lang{
 	string(LangCxx):              LangCxx,
 	string(LangAssembler):        LangAssembler,
 	string(LangAssemblerWithCpp): LangAssemblerWithCpp,
+	string(LangCHeader):          LangCHeader,
+	string(LangCxxHeader):        LangCxxHeader,
+}
+
+// IsHeader returns whether compiling l produces a precompiled
+// header, rather than an object file.
+func (l Lang) IsHeader() bool {
+	return l == LangCHeader || l == LangCxxHeader
+}
+
+func (l Lang) isCxx() bool {
+	return l == LangCxx || l == LangCxxHeader
 }
 
 var extLangs = map[string]Lang{
@@ -46,6 +60,20 @@ var extLangs = map[string]Lang{
 	".S":   LangAssemblerWithCpp,
 }
 
+// headerExts are the extensions of headers we'll precompile. Headers
+// are only inputs after an explicit `-x c-header` or `-x c++-header`.
+var headerExts = map[string]bool{
+	".h":   true,
+	".H":   true,
+	".hh":  true,
+	".hpp": true,
+	".hxx": true,
+}
+
+// pchExts are the suffixes of precompiled headers that GCC and Clang
+// look for next to a header they include.
+var pchExts = []string{".gch", ".pch"}
+
 var preprocessedLang = map[Lang]string{
 	LangCxx:              "c++-cpp-output",
 	LangC:                "cpp-output",
@@ -63,6 +91,10 @@ type Compilation struct {
 	Flag                 Flags
 	Defs                 []Def
 	Includes             []Include
+
+	// Dir is the absolute directory the compiler runs in, which
+	// relative paths on its command line are relative to
+	Dir string
 }
 
 type Def struct {
@@ -76,31 +108,50 @@ type Include struct {
 }
 
 func (c *Compilation) LocalCompiler(cfg *Config) string {
-	if c.Language == "c++" {
+	if c.Language.isCxx() {
 		return cfg.LocalCXX
 	}
 	return cfg.LocalCC
 }
 
 func (c *Compilation) RemoteCompiler(cfg *Config) string {
-	if c.Language == "c++" {
+	if c.Language.isCxx() {
 		return "c++"
 	}
 	return "cc"
 }
 
-// LanguageExt returns the file extension for the current language.
-func (c *Compilation) LanguageExt() string {
-	for k, v := range extLangs {
-		if v == c.Language {
-			return k
+// DirectivesOnly returns whether local preprocessing should use
+// GCC's `-fdirectives-only` mode, leaving macro expansion to the
+// remote compiler. That mode only works for C-family languages, so
+// assembler is always fully preprocessed.
+func (c *Compilation) DirectivesOnly(cfg *Config) bool {
+	return !cfg.FullPreprocess && c.Language != LangAssemblerWithCpp
+}
+
+var colorOptions = []string{
+	"-fdiagnostics-color",
+	"-fno-diagnostics-color",
+	"-fcolor-diagnostics",
+	"-fno-color-diagnostics",
+}
+
+// HasColorOption returns whether the user explicitly configured
+// colored diagnostics on the command line.
+func (c *Compilation) HasColorOption() bool {
+	for _, arg := range c.UnknownArgs {
+		for _, opt := range colorOptions {
+			if strings.HasPrefix(arg, opt) {
+				return true
+			}
 		}
 	}
-
-	panic("unknown language extension")
+	return false
 }
 
 type Flags struct {
+	M   bool
+	MM  bool
 	MD  bool
 	MMD bool
 	MP  bool
@@ -178,6 +229,27 @@ var argSpecs = []argSpec{
 		c.Flag.MP = true
 		return filterRemote, nil
 	}, false},
+	{"-MQ", func(c *Compilation, _ string) (filterWhere, error) {
+		return filterRemote, nil
+	}, true},
+	{"-MG", func(c *Compilation, _ string) (filterWhere, error) {
+		return filterRemote, nil
+	}, false},
+	{"-MJ", func(c *Compilation, _ string) (filterWhere, error) {
+		// The compilation database entry would be written
+		// remotely and lost
+		return 0, errors.New("-MJ given")
+	}, true},
+	// -MM and -M only match exactly (see exactFlags), so that
+	// they don't catch other -M options.
+	{"-MM", func(c *Compilation, _ string) (filterWhere, error) {
+		c.Flag.MM = true
+		return filterRemote, nil
+	}, false},
+	{"-M", func(c *Compilation, _ string) (filterWhere, error) {
+		c.Flag.M = true
+		return filterRemote, nil
+	}, false},
 	{"-D", func(c *Compilation, arg string) (filterWhere, error) {
 		c.Defs = append(c.Defs, Def{"-D", arg})
 		return filterRemote, nil
@@ -197,6 +269,10 @@ var argSpecs = []argSpec{
 		c.Flag.S = true
 		return 0, errors.New("-S given")
 	}, false},
+	{"-save-temps", func(c *Compilation, arg string) (filterWhere, error) {
+		// The intermediates would be written remotely and lost
+		return 0, errors.New("-save-temps given")
+	}, false},
 	{"-x", func(c *Compilation, arg string) (filterWhere, error) {
 		lang, ok := knownLangs[arg]
 		if ok {
@@ -221,6 +297,9 @@ var argSpecs = []argSpec{
 	includeArg("-iwithprefixbefore"),
 	includeArg("-iwithprefix"),
 	includeArg("-isysroot"),
+	// -include-pch must precede -include, since specs match by
+	// prefix.
+	includeArg("-include-pch"),
 	includeArg("-include"),
 	{"-nostdinc", func(c *Compilation, _ string) (filterWhere, error) {
 		return filterRemote, nil
@@ -231,6 +310,13 @@ var argSpecs = []argSpec{
 	}, false},
 }
 
+// exactFlags holds the flags in argSpecs that must match an argument
+// exactly, rather than as a prefix.
+var exactFlags = map[string]bool{
+	"-M":  true,
+	"-MM": true,
+}
+
 func replaceExt(file string, newExt string) string {
 	if newExt[0] != '.' {
 		panic("replaceExt: provided extension must start with `.`")
@@ -281,6 +367,11 @@ func rewriteWp(args []string) []string {
 	return args
 }
 
+// errDepsOnly is returned by ParseCompile for a -M or -MM invocation,
+// which only generates dependencies. That is just preprocessing, so
+// we run it locally rather than remotely.
+var errDepsOnly = errors.New("dependency generation only (-M or -MM)")
+
 func ParseCompile(cfg *Config, argv []string) (Compilation, error) {
 	var out Compilation
 	args := argv[1:]
@@ -312,7 +403,7 @@ func ParseCompile(cfg *Config, argv []string) (Compilation, error) {
 		if strings.HasPrefix(arg, "-") {
 			found := false
 			for _, spec := range specs {
-				if !strings.HasPrefix(arg, spec.flag) {
+				if !strings.HasPrefix(arg, spec.flag) || (exactFlags[spec.flag] && arg != spec.flag) {
 					continue
 				}
 				var flagArg string
@@ -350,7 +441,7 @@ func ParseCompile(cfg *Config, argv []string) (Compilation, error) {
 				out.LocalArgs = append(out.LocalArgs, arg)
 				out.RemoteArgs = append(out.RemoteArgs, arg)
 			}
-		} else if smellsLikeInput(arg) {
+		} else if smellsLikeInput(arg) || (out.Language.IsHeader() && headerExts[path.Ext(arg)]) {
 			if out.Input != "" {
 				return out, fmt.Errorf("multiple inputs given: %s, %s", out.Input, arg)
 			}
@@ -362,13 +453,22 @@ func ParseCompile(cfg *Config, argv []string) (Compilation, error) {
 		}
 	}
 
+	out.LocalArgs = append(out.LocalArgs, cfg.ExtraLocalArgs...)
+	out.RemoteArgs = append(out.RemoteArgs, cfg.ExtraRemoteArgs...)
+
 	if out.Input == "" {
 		return out, errors.New("no supported input detected")
 	}
-	if !out.Flag.C {
+	if out.Flag.M || out.Flag.MM {
+		// -M and -MM imply -E, even alongside -c
+		return out, errDepsOnly
+	}
+	if !out.Flag.C && !out.Language.IsHeader() {
 		return out, errors.New("-c not detected")
 	}
-	if out.Output == "" {
+	if out.Output == "" && out.Language.IsHeader() {
+		out.Output = out.Input + ".gch"
+	} else if out.Output == "" {
 		out.Output = replaceExt(out.Input, ".o")
 	}
 	if (out.Flag.MD || out.Flag.MMD) && out.Flag.MF == "" {
@@ -383,7 +483,7 @@ func ParseCompile(cfg *Config, argv []string) (Compilation, error) {
 		out.Language = lang
 	}
 	out.PreprocessedLanguage = preprocessedLang[out.Language]
-	if out.PreprocessedLanguage == "" {
+	if out.PreprocessedLanguage == "" && !out.Language.IsHeader() {
 		return out, fmt.Errorf("Don't know what happens when we preprocess %s", out.Language)
 	}
 
@@ -15,7 +15,12 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -26,19 +31,42 @@ type Config struct {
 	FullPreprocess  bool
 	Function        string
 	LocalPreprocess bool
-	LocalFallback	bool
+	ShipAllIncludes bool
+	LocalFallback   bool
 	BuildID         string
+	// Socket overrides the path to the llama daemon's socket
+	Socket string
 
 	// FilteredWarnings is a list of warnings that we should always filter
 	// out of the compilation
 	FilteredWarnings []string
 
+	// ExtraLocalArgs and ExtraRemoteArgs are appended to every
+	// compiler command llamacc runs locally or remotely,
+	// respectively.
+	ExtraLocalArgs  []string
+	ExtraRemoteArgs []string
+
 	LocalCC  string
 	LocalCXX string
+
+	// Cutoffs for passing blobs inline in requests to and
+	// responses from Lambda. Zero means to use the daemon's
+	// configuration.
+	InlineRequestBytes  int
+	InlineResponseBytes int
+
+	// MinRemoteBytes, if nonzero, compiles inputs smaller than
+	// this locally, since they're not worth a trip to Lambda.
+	MinRemoteBytes int
+
+	// StderrTerminal is whether the compile's diagnostics end up
+	// on a terminal (see stderrIsTerminal). It comes from the
+	// caller, not the environment.
+	StderrTerminal bool
 }
 
 var DefaultConfig = Config{
-	Function: "gcc",
 	LocalCC:  "cc",
 	LocalCXX: "c++",
 }
@@ -53,6 +81,17 @@ func BoolConfigTrue(val string) bool {
 	}
 }
 
+// IntConfig parses an integer configuration value, logging and
+// returning 0 if it is malformed.
+func IntConfig(key, val string) int {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("llamacc: bad value for %s: %q", key, val)
+		return 0
+	}
+	return i
+}
+
 // StringArrayConfig splits a string configuration value using ","
 // as the separator and eliding empty elements.
 func StringArrayConfig(val string) []string {
@@ -97,8 +136,12 @@ func ParseConfig(env []string) Config {
 			out.FullPreprocess = BoolConfigTrue(val)
 		case "LOCAL_PREPROCESS":
 			out.LocalPreprocess = BoolConfigTrue(val)
+		case "SHIP_ALL_INCLUDES":
+			out.ShipAllIncludes = BoolConfigTrue(val)
 		case "BUILD_ID":
 			out.BuildID = val
+		case "SOCKET":
+			out.Socket = val
 		case "LOCAL_CC":
 			out.LocalCC = val
 		case "LOCAL_CXX":
@@ -107,9 +150,101 @@ func ParseConfig(env []string) Config {
 			out.LocalFallback = BoolConfigTrue(val)
 		case "FILTER_WARNINGS":
 			out.FilteredWarnings = StringArrayConfig(val)
+		case "EXTRA_LOCAL_ARGS":
+			out.ExtraLocalArgs = StringArrayConfig(val)
+		case "EXTRA_REMOTE_ARGS":
+			out.ExtraRemoteArgs = StringArrayConfig(val)
+		case "INLINE_REQUEST_BYTES":
+			out.InlineRequestBytes = IntConfig(ev[:eq], val)
+		case "INLINE_RESPONSE_BYTES":
+			out.InlineResponseBytes = IntConfig(ev[:eq], val)
+		case "MIN_REMOTE_BYTES":
+			out.MinRemoteBytes = IntConfig(ev[:eq], val)
+		case "CONFIG":
+			// Handled by LoadConfig
 		default:
 			log.Printf("llamacc: unknown env var: %s", ev)
 		}
 	}
 	return out
 }
+
+// ConfigFileName is the name of the per-project llamacc
+// configuration file.
+const ConfigFileName = ".llamacc"
+
+// LoadConfig parses llamacc's configuration from a config file and
+// then from the environment, with the environment taking
+// precedence. The config file is named by LLAMACC_CONFIG, or else is
+// the nearest `.llamacc` in wd or one of its parents.
+func LoadConfig(env []string, wd string) Config {
+	path := ""
+	for _, ev := range env {
+		if strings.HasPrefix(ev, "LLAMACC_CONFIG=") {
+			path = ev[len("LLAMACC_CONFIG="):]
+		}
+	}
+	if path == "" {
+		path = findConfigFile(wd)
+	}
+	if path == "" {
+		return ParseConfig(env)
+	}
+	fileEnv, err := readConfigFile(path)
+	if err != nil {
+		log.Printf("llamacc: reading config: %s", err.Error())
+		return ParseConfig(env)
+	}
+	return ParseConfig(append(fileEnv, env...))
+}
+
+func findConfigFile(dir string) string {
+	for {
+		path := filepath.Join(dir, ConfigFileName)
+		if st, err := os.Stat(path); err == nil && !st.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfigFile reads a config file consisting of KEY=VALUE lines,
+// using the same keys as the environment, with or without the
+// LLAMACC_ prefix. Blank lines and lines starting with `#` are
+// ignored. It returns the settings in environment format.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.IndexRune(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineno)
+		}
+		key := strings.TrimSpace(line[:eq])
+		val := strings.TrimSpace(line[eq+1:])
+		if !strings.HasPrefix(key, "LLAMACC_") {
+			key = "LLAMACC_" + key
+		}
+		out = append(out, key+"="+val)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
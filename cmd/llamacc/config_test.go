@@ -15,6 +15,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,3 +40,34 @@ func TestStringArrayConfig(t *testing.T) {
 	assert.Equal(t, []string{"b", "a"}, StringArrayConfig("b  ,\t a"))
 	assert.Equal(t, []string(nil), StringArrayConfig(",,,,"))
 }
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	sub := path.Join(dir, "src", "lib")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(path.Join(dir, ConfigFileName), []byte(`
+# project defaults
+FUNCTION = clang
+LLAMACC_FILTER_WARNINGS=error
+VERBOSE=1
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := LoadConfig([]string{"LLAMACC_VERBOSE=0"}, sub)
+	assert.Equal(t, "clang", cfg.Function)
+	assert.Equal(t, []string{"error"}, cfg.FilteredWarnings)
+	assert.False(t, cfg.Verbose, "environment takes precedence")
+
+	other := path.Join(t.TempDir(), "other")
+	err = ioutil.WriteFile(other, []byte("FUNCTION=gcc-11\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = LoadConfig([]string{"LLAMACC_CONFIG=" + other}, sub)
+	assert.Equal(t, "gcc-11", cfg.Function)
+	assert.Nil(t, cfg.FilteredWarnings)
+}
@@ -17,16 +17,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/tracing"
 )
 
-func detectDependencies(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation) ([]string, error) {
+func detectDependencies(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation, stderr io.Writer) ([]string, error) {
 	_, span := tracing.StartSpan(ctx, "detect_dependencies")
 	defer span.End()
 
@@ -36,8 +42,10 @@ func detectDependencies(ctx context.Context, client *daemon.Client, cfg *Config,
 		return nil, err
 	}
 	preprocessor.Path = ccpath
+	preprocessor.Dir = comp.Dir
 	preprocessor.Args = []string{comp.LocalCompiler(cfg)}
 	preprocessor.Args = append(preprocessor.Args, comp.UnknownArgs...)
+	preprocessor.Args = append(preprocessor.Args, cfg.ExtraLocalArgs...)
 	for _, opt := range comp.Defs {
 		preprocessor.Args = append(preprocessor.Args, opt.Opt)
 		preprocessor.Args = append(preprocessor.Args, opt.Def)
@@ -48,10 +56,13 @@ func detectDependencies(ctx context.Context, client *daemon.Client, cfg *Config,
 	}
 	// Use /dev/stdout instead of - because old GCC verions don't
 	// understand `-`. See #50
+	if comp.Language.IsHeader() {
+		preprocessor.Args = append(preprocessor.Args, "-x", string(comp.Language))
+	}
 	preprocessor.Args = append(preprocessor.Args, "-M", "-MF", "/dev/stdout", comp.Input)
 	var deps bytes.Buffer
 	preprocessor.Stdout = &deps
-	preprocessor.Stderr = os.Stderr
+	preprocessor.Stderr = stderr
 	if cfg.Verbose {
 		log.Printf("run cpp -MM: %q", preprocessor.Args)
 	}
@@ -69,13 +80,211 @@ func detectDependencies(ctx context.Context, client *daemon.Client, cfg *Config,
 	}
 
 	deplist, err := parseMakeDeps(deps.Bytes())
+	for _, inc := range comp.Includes {
+		if inc.Opt == "-include-pch" {
+			deplist = append(deplist, inc.Path)
+		}
+	}
+	// The scans below run in our own directory, not the compiler's
+	for i, dep := range deplist {
+		deplist[i] = toAbs(dep, comp.Dir)
+	}
 
 	deplist = removePaths(deplist, includePath.Paths)
 
+	if err == nil && (comp.Language == LangAssembler || comp.Language == LangAssemblerWithCpp) {
+		searchPath := []string{toAbs(".", comp.Dir)}
+		for _, inc := range comp.Includes {
+			if inc.Opt == "-I" {
+				searchPath = append(searchPath, toAbs(inc.Path, comp.Dir))
+			}
+		}
+		deplist = append(deplist, scanAssemblerDeps(deplist, searchPath)...)
+	}
+	if err == nil {
+		deplist = append(deplist, precompiledHeaders(deplist)...)
+	}
+
 	span.AddField("count", len(deplist))
 	return deplist, err
 }
 
+// maxIncludeClosureBytes bounds how much includeClosure will ship.
+const maxIncludeClosureBytes = 256 << 20
+
+// includeClosure lists every file under the input's directory and
+// each include directory, and any -include files, except those in
+// the compiler's own search path. It is a blunt alternative to
+// detectDependencies for toolchains whose -M output can't be
+// trusted.
+func includeClosure(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation) ([]string, error) {
+	_, span := tracing.StartSpan(ctx, "include_closure")
+	defer span.End()
+
+	ccpath, err := exec.LookPath(comp.LocalCompiler(cfg))
+	if err != nil {
+		return nil, err
+	}
+	includePath, err := client.GetCompilerIncludePath(&daemon.GetCompilerIncludePathArgs{
+		Compiler: ccpath,
+		Language: string(comp.Language),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{path.Dir(toAbs(comp.Input, comp.Dir))}
+	var deps []string
+	for _, inc := range comp.Includes {
+		if inc.Opt == "-include" || inc.Opt == "-include-pch" {
+			deps = append(deps, toAbs(inc.Path, comp.Dir))
+		} else {
+			dirs = append(dirs, toAbs(inc.Path, comp.Dir))
+		}
+	}
+	dirs = removePaths(dirs, includePath.Paths)
+
+	files, total, err := walkIncludeDirs(dirs, maxIncludeClosureBytes)
+	if err != nil {
+		return nil, err
+	}
+	deps = append(deps, files...)
+	deps = append(deps, precompiledHeaders(deps)...)
+
+	span.AddField("count", len(deps))
+	span.AddField("bytes", total)
+	return deps, nil
+}
+
+// walkIncludeDirs lists the regular files under dirs, skipping
+// hidden directories, and fails if they hold more than limit bytes.
+func walkIncludeDirs(dirs []string, limit int64) ([]string, int64, error) {
+	var out []string
+	var total int64
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && file == dir {
+					// Compilers ignore missing include
+					// directories, too
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if file != dir && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(file); err != nil || info.IsDir() {
+					return nil
+				}
+			}
+			if !info.Mode().IsRegular() || seen[file] {
+				return nil
+			}
+			seen[file] = true
+			total += info.Size()
+			if total > limit {
+				return fmt.Errorf("include directories hold over %d bytes", limit)
+			}
+			out = append(out, file)
+			return nil
+		})
+		if err != nil {
+			return nil, total, err
+		}
+	}
+	return out, total, nil
+}
+
+// precompiledHeaders returns the precompiled headers next to any
+// headers in deps, which the compiler will use in their place. A
+// precompiled header may also be a directory of alternatives, in
+// which case we ship all of them.
+func precompiledHeaders(deps []string) []string {
+	var out []string
+	for _, dep := range deps {
+		if !headerExts[path.Ext(dep)] {
+			continue
+		}
+		for _, ext := range pchExts {
+			pch := dep + ext
+			st, err := os.Stat(pch)
+			if err != nil {
+				continue
+			}
+			if !st.IsDir() {
+				out = append(out, pch)
+				continue
+			}
+			files, _, err := walkIncludeDirs([]string{pch}, maxIncludeClosureBytes)
+			if err != nil {
+				log.Printf("[llamacc] not shipping %s: %s", pch, err.Error())
+				continue
+			}
+			out = append(out, files...)
+		}
+	}
+	return out
+}
+
+var asmDirectiveRE = regexp.MustCompile(`(?m)^\s*(?:[\w.$]+:\s*)?\.(incbin|include)\s+"([^"]+)"`)
+
+// scanAssemblerDeps finds files referenced by `.incbin` and
+// `.include` directives in the given assembler sources and their
+// transitive `.include`s. The preprocessor's -M output doesn't know
+// about these, since they're handled by the assembler. Like gas,
+// we resolve relative paths against each directory in searchPath.
+// scanAssemblerDeps returns only files not already in deps.
+func scanAssemblerDeps(deps []string, searchPath []string) []string {
+	seen := make(map[string]bool, len(deps))
+	for _, dep := range deps {
+		seen[dep] = true
+	}
+	var out []string
+	queue := append([]string(nil), deps...)
+	for len(queue) > 0 {
+		src := queue[0]
+		queue = queue[1:]
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			continue
+		}
+		for _, m := range asmDirectiveRE.FindAllSubmatch(data, -1) {
+			dep := resolveAsmPath(string(m[2]), searchPath)
+			if dep == "" || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			out = append(out, dep)
+			if string(m[1]) == "include" {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return out
+}
+
+func resolveAsmPath(file string, searchPath []string) string {
+	if path.IsAbs(file) {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+		return ""
+	}
+	for _, dir := range searchPath {
+		p := path.Join(dir, file)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
 func removePaths(paths []string, remove []string) []string {
 	out := 0
 outer:
@@ -15,9 +15,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseMakeDeps(t *testing.T) {
@@ -51,3 +55,75 @@ func TestParseMakeDeps(t *testing.T) {
 		assert.Equal(t, tc.Deps, got)
 	}
 }
+
+func TestScanAssemblerDeps(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("piggy.S", `
+	.section ".rodata..compressed","a"
+input_data:
+	.incbin "vmlinux.bin.gz"
+	.include "macros.inc"
+	.incbin "missing.bin"
+`)
+	write("vmlinux.bin.gz", "")
+	write("inc/macros.inc", `label: .incbin "blob.bin"
+`)
+	write("inc/blob.bin", "")
+
+	got := scanAssemblerDeps([]string{path.Join(dir, "piggy.S")}, []string{dir, path.Join(dir, "inc")})
+	assert.Equal(t, []string{
+		path.Join(dir, "vmlinux.bin.gz"),
+		path.Join(dir, "inc/macros.inc"),
+		path.Join(dir, "inc/blob.bin"),
+	}, got)
+}
+
+func TestWalkIncludeDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.h", "sys/b.h", ".git/HEAD"} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, f)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, f), []byte("header"), 0644))
+	}
+	require.NoError(t, os.Symlink("a.h", path.Join(dir, "link.h")))
+	require.NoError(t, os.Symlink("sys", path.Join(dir, "linkdir")))
+
+	files, total, err := walkIncludeDirs([]string{dir, dir, path.Join(dir, "missing")}, 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		path.Join(dir, "a.h"),
+		path.Join(dir, "link.h"),
+		path.Join(dir, "sys/b.h"),
+	}, files)
+	assert.Equal(t, int64(18), total)
+
+	_, _, err = walkIncludeDirs([]string{dir}, 10)
+	assert.Error(t, err)
+}
+
+func TestPrecompiledHeaders(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.h", "a.h.gch", "b.hpp", "b.hpp.gch/one", "b.hpp.gch/two", "c.h", "d.c.gch"} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, f)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, f), []byte("pch"), 0644))
+	}
+	deps := []string{
+		path.Join(dir, "a.h"),
+		path.Join(dir, "b.hpp"),
+		path.Join(dir, "c.h"),
+		path.Join(dir, "d.c"),
+	}
+	assert.Equal(t, []string{
+		path.Join(dir, "a.h.gch"),
+		path.Join(dir, "b.hpp.gch/one"),
+		path.Join(dir, "b.hpp.gch/two"),
+	}, precompiledHeaders(deps))
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -34,7 +35,65 @@ import (
 	"github.com/nelhage/llama/tracing"
 )
 
-func runLlamaCC(cfg *Config, comp *Compilation) error {
+// errPreferLocal is returned when the daemon reports that remote
+// capacity is the bottleneck and local CPUs are idle.
+var errPreferLocal = errors.New("remote capacity is saturated")
+
+func socketPath(cfg *Config) (string, error) {
+	if cfg.Socket != "" {
+		return cfg.Socket, nil
+	}
+	global, err := cli.LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	return cli.DaemonSocketPath(global), nil
+}
+
+// acquireLocalSlot blocks until the daemon grants us a slot in its
+// local-compile pool, and returns a function that releases it. If no
+// daemon is running, we compile without one rather than start it.
+func acquireLocalSlot(cfg *Config) func() {
+	sock, err := socketPath(cfg)
+	if err != nil {
+		return func() {}
+	}
+	client, err := daemon.DialPath(context.Background(), sock, server.LocalCompilePath)
+	if err != nil {
+		if cfg.Verbose {
+			log.Printf("[llamacc] no local compile slot: %s", err.Error())
+		}
+		return func() {}
+	}
+	return func() { client.Close() }
+}
+
+// remoteExitError reports that the remote compiler failed, so that
+// llamacc can exit with the same status.
+type remoteExitError struct {
+	code int
+}
+
+func (e *remoteExitError) Error() string {
+	return fmt.Sprintf("invoke: exit %d", e.code)
+}
+
+// heldOutput collects what the compilers print, so that it can be
+// discarded if llamacc gives up and compiles locally instead. The
+// build then sees only the local compiler's output.
+type heldOutput struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (h *heldOutput) flush(stdout, stderr io.Writer) {
+	stdout.Write(h.stdout.Bytes())
+	stderr.Write(h.stderr.Bytes())
+	h.stdout.Reset()
+	h.stderr.Reset()
+}
+
+func runLlamaCC(cfg *Config, comp *Compilation, held *heldOutput) error {
 	var err error
 	ctx := context.Background()
 	mt := tracing.NewMemoryTracer(ctx)
@@ -44,7 +103,11 @@ func runLlamaCC(cfg *Config, comp *Compilation) error {
 		span.AddField("global.build_id", cfg.BuildID)
 	}
 
-	client, err := server.DialWithAutostart(ctx, cli.SocketPath(), server.LlamaCCPath)
+	sock, err := socketPath(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := server.DialWithAutostart(ctx, sock, server.LlamaCCPath)
 	if err != nil {
 		return err
 	}
@@ -55,13 +118,38 @@ func runLlamaCC(cfg *Config, comp *Compilation) error {
 		client.TraceSpans(&daemon.TraceSpansArgs{Spans: mt.Close()})
 	}()
 
+	if hint, err := client.GetSchedulingHint(&daemon.SchedulingHintArgs{}); err == nil && hint.PreferLocal {
+		span.AddField("prefer_local", true)
+		return errPreferLocal
+	}
+
 	if cfg.LocalPreprocess {
-		return buildLocalPreprocess(ctx, client, cfg, comp)
+		return buildLocalPreprocess(ctx, client, cfg, comp, held)
 	} else {
-		return buildRemotePreprocess(ctx, client, cfg, comp)
+		return buildRemotePreprocess(ctx, client, cfg, comp, held)
 	}
 }
 
+// stderrIsTerminal approximates the test GCC and Clang use to decide
+// whether to color diagnostics by default.
+func stderrIsTerminal() bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	st, err := os.Stderr.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// appendColorArgs asks the remote compiler for colored diagnostics
+// if the local one would have produced them, since the remote
+// compiler's stderr is never a terminal.
+func appendColorArgs(args []string, cfg *Config, comp *Compilation) []string {
+	if comp.HasColorOption() || !cfg.StderrTerminal {
+		return args
+	}
+	return append(args, "-fdiagnostics-color=always")
+}
+
 func toAbs(local, wd string) string {
 	if path.IsAbs(local) {
 		return local
@@ -82,8 +170,8 @@ func remap(local, wd string) files.Mapped {
 	}
 }
 
-func buildRemotePreprocess(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation) error {
-	args, err := constructRemotePreprocessInvoke(ctx, client, cfg, comp)
+func buildRemotePreprocess(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation, held *heldOutput) error {
+	args, err := constructRemotePreprocessInvoke(ctx, client, cfg, comp, held)
 	if err != nil {
 		return err
 	}
@@ -92,13 +180,14 @@ func buildRemotePreprocess(ctx context.Context, client *daemon.Client, cfg *Conf
 	if err != nil {
 		return err
 	}
-	os.Stdout.Write(out.Stdout)
-	os.Stderr.Write(out.Stderr)
-	if out.InvokeErr != "" {
-		return fmt.Errorf("invoke: %s", out.InvokeErr)
+	wd := comp.Dir
+	held.stdout.Write(out.Stdout)
+	held.stderr.Write(rewriteDiagnostics(out.Stderr, toRemote(comp.Input, wd), comp.Input))
+	if err := out.Err(); err != nil {
+		return fmt.Errorf("invoke: %w", err)
 	}
-	if out.ExitStatus != 0 {
-		return fmt.Errorf("invoke: exit %d", out.ExitStatus)
+	if code := out.ExitCode(); code != 0 {
+		return &remoteExitError{code: code}
 	}
 
 	if comp.Flag.MF != "" {
@@ -109,32 +198,51 @@ func buildRemotePreprocess(ctx context.Context, client *daemon.Client, cfg *Conf
 }
 
 func rewriteMF(ctx context.Context, comp *Compilation) error {
-	tmpMF := comp.Flag.MF + ".tmp"
+	mf := toAbs(comp.Flag.MF, comp.Dir)
+	tmpMF := mf + ".tmp"
 	data, err := ioutil.ReadFile(tmpMF)
 	if err != nil {
 		return err
 	}
 	data = bytes.ReplaceAll(data, []byte("_root/"), []byte("/"))
-	if err := ioutil.WriteFile(comp.Flag.MF, data, 0644); err != nil {
+	if err := ioutil.WriteFile(mf, data, 0644); err != nil {
 		return err
 	}
 	return os.Remove(tmpMF)
 }
 
-func constructRemotePreprocessInvoke(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation) (*daemon.InvokeWithFilesArgs, error) {
-	wd, err := files.WorkingDir()
-	if err != nil {
-		return nil, err
-	}
+// rewriteDiagnostics rewrites paths in the remote compiler's stderr
+// to refer to local files, so that editors can find the source of
+// errors. The remote input file is mapped back to the name it was
+// given on the command line, and other files to their absolute local
+// paths.
+func rewriteDiagnostics(stderr []byte, remoteInput, localInput string) []byte {
+	if len(stderr) == 0 {
+		return stderr
+	}
+	stderr = bytes.ReplaceAll(stderr, []byte(remoteInput), []byte(localInput))
+	return bytes.ReplaceAll(stderr, []byte("_root/"), []byte("/"))
+}
 
-	deps, err := detectDependencies(ctx, client, cfg, comp)
+func constructRemotePreprocessInvoke(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation, held *heldOutput) (*daemon.InvokeWithFilesArgs, error) {
+	wd := comp.Dir
+
+	var deps []string
+	var err error
+	if cfg.ShipAllIncludes {
+		deps, err = includeClosure(ctx, client, cfg, comp)
+	} else {
+		deps, err = detectDependencies(ctx, client, cfg, comp, &held.stderr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Detecting dependencies: %w", err)
 	}
 
 	args := daemon.InvokeWithFilesArgs{
-		Function:      cfg.Function,
-		DropSemaphore: true,
+		Function:          cfg.Function,
+		DropSemaphore:     true,
+		MaxInlineRequest:  cfg.InlineRequestBytes,
+		MaxInlineResponse: cfg.InlineResponseBytes,
 	}
 
 	args.Outputs = args.Outputs.Append(remap(comp.Output, wd))
@@ -150,25 +258,43 @@ func constructRemotePreprocessInvoke(ctx context.Context, client *daemon.Client,
 	args.Args = []string{comp.RemoteCompiler(cfg)}
 
 	if comp.Flag.SplitDwarf {
-		args.Outputs = args.Outputs.Append(remap(replaceExt(comp.Output, ".dwo"), wd))
+		// Without debug info, -gsplit-dwarf produces no .dwo
+		dwo := remap(replaceExt(comp.Output, ".dwo"), wd)
+		dwo.Optional = true
+		args.Outputs = args.Outputs.Append(dwo)
 		args.Args = append(args.Args, "-gsplit-dwarf")
 	}
 
+	// Map remote paths back to their local spelling in debug
+	// info and in __FILE__ and friends, so that the output
+	// matches a local build.
+	appendPrefixMap := func(mapped, local string) {
+		args.Args = append(args.Args,
+			fmt.Sprintf("-fdebug-prefix-map=%s=%s", mapped, local),
+			fmt.Sprintf("-fmacro-prefix-map=%s=%s", mapped, local),
+		)
+	}
 	appendInclude := func(opt, local string) {
 		mapped := toRemote(local, wd)
 		args.Args = append(args.Args, opt, mapped)
-		args.Args = append(args.Args, fmt.Sprintf("-fdebug-prefix-map=%s=%s", mapped, local))
+		appendPrefixMap(mapped, local)
 	}
 
 	appendInclude("-I", ".")
 	for _, inc := range comp.Includes {
 		appendInclude(inc.Opt, inc.Path)
 	}
+	// This must come after the include maps, which would
+	// otherwise rewrite `_root/$PWD/foo.c` to `./foo.c`.
+	appendPrefixMap(toRemote(comp.Input, wd), comp.Input)
 	for _, def := range comp.Defs {
 		args.Args = append(args.Args, def.Opt, def.Def)
 	}
 	args.Args = append(args.Args, "-c")
 	args.Args = append(args.Args, "-o", toRemote(comp.Output, wd))
+	if comp.Language.IsHeader() {
+		args.Args = append(args.Args, "-x", string(comp.Language))
+	}
 	args.Args = append(args.Args, toRemote(comp.Input, wd))
 	if comp.Flag.MD {
 		args.Args = append(args.Args, "-MD")
@@ -183,59 +309,82 @@ func constructRemotePreprocessInvoke(ctx context.Context, client *daemon.Client,
 		args.Args = append(args.Args, "-MF", toRemote(comp.Flag.MF+".tmp", wd))
 	}
 	args.Args = append(args.Args, comp.UnknownArgs...)
+	args.Args = append(args.Args, cfg.ExtraRemoteArgs...)
+	args.Args = appendColorArgs(args.Args, cfg, comp)
 	if cfg.Verbose {
 		log.Printf("[llamacc] compiling remotely: %#v", args)
 	}
 	return &args, nil
 }
 
-func buildLocalPreprocess(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation) error {
-	wd, err := files.WorkingDir()
-	if err != nil {
-		return err
+// errDirectivesOnly is returned when compilation fails in a way
+// that suggests the source doesn't tolerate -fdirectives-only.
+var errDirectivesOnly = errors.New("preprocessing failed in -fdirectives-only mode")
+
+func isDirectivesOnlyFailure(stderr []byte) bool {
+	return bytes.Contains(stderr, []byte("-fdirectives-only")) ||
+		bytes.Contains(stderr, []byte("-fpreprocessed"))
+}
+
+func buildLocalPreprocess(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation, held *heldOutput) error {
+	err := buildLocalPreprocessOnce(ctx, client, cfg, comp, held)
+	if errors.Is(err, errDirectivesOnly) {
+		if cfg.Verbose {
+			log.Printf("[llamacc] %s; retrying with full preprocessing", err.Error())
+		}
+		full := *cfg
+		full.FullPreprocess = true
+		err = buildLocalPreprocessOnce(ctx, client, &full, comp, held)
 	}
+	return err
+}
+
+func buildLocalPreprocessOnce(ctx context.Context, client *daemon.Client, cfg *Config, comp *Compilation, held *heldOutput) error {
+	wd := comp.Dir
 	ccpath, err := exec.LookPath(comp.LocalCompiler(cfg))
 	if err != nil {
 		return fmt.Errorf("find %s: %w", comp.LocalCompiler(cfg), err)
 	}
 
-	tmp, err := ioutil.TempFile("", fmt.Sprintf("llamacc-*%s", comp.LanguageExt()))
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		os.Remove(tmp.Name())
-		tmp.Close()
-	}()
-
 	var preprocessed bytes.Buffer
 	{
 		var preprocessor exec.Cmd
 		_, span := tracing.StartSpan(ctx, "preprocess")
 		preprocessor.Path = ccpath
+		preprocessor.Dir = comp.Dir
 		preprocessor.Args = []string{comp.LocalCompiler(cfg)}
 		preprocessor.Args = append(preprocessor.Args, comp.LocalArgs...)
-		if !cfg.FullPreprocess {
+		if comp.DirectivesOnly(cfg) {
 			preprocessor.Args = append(preprocessor.Args, "-fdirectives-only")
-
 		}
-		preprocessor.Args = append(preprocessor.Args, "-E", "-o", tmp.Name(), comp.Input)
+		preprocessor.Args = append(preprocessor.Args, "-E", comp.Input)
+		var stderr bytes.Buffer
 		preprocessor.Stdout = &preprocessed
-		preprocessor.Stderr = os.Stderr
+		preprocessor.Stderr = &stderr
 		if cfg.Verbose {
 			log.Printf("run cpp: %q", preprocessor.Args)
 		}
-		if err := preprocessor.Run(); err != nil {
+		err := preprocessor.Run()
+		span.End()
+		if err != nil && comp.DirectivesOnly(cfg) && isDirectivesOnlyFailure(stderr.Bytes()) {
+			return errDirectivesOnly
+		}
+		held.stderr.Write(stderr.Bytes())
+		if err != nil {
 			return err
 		}
-		span.End()
 	}
 
+	// The preprocessed source goes straight from memory to the
+	// remote, at the input's own path.
+	remoteInput := toRemote(comp.Input, wd)
 	args := daemon.InvokeWithFilesArgs{
 		Function: cfg.Function,
 		Files: []files.Mapped{
-			remap(tmp.Name(), wd),
+			{
+				Local:  files.LocalFile{Bytes: preprocessed.Bytes(), Mode: 0644},
+				Remote: remoteInput,
+			},
 		},
 		Outputs: []files.Mapped{
 			{
@@ -243,27 +392,33 @@ func buildLocalPreprocess(ctx context.Context, client *daemon.Client, cfg *Confi
 				Remote: comp.Output,
 			},
 		},
-		Stdin: preprocessed.Bytes(),
 		Trace: tracing.PropagationFromContext(ctx),
+
+		MaxInlineRequest:  cfg.InlineRequestBytes,
+		MaxInlineResponse: cfg.InlineResponseBytes,
 	}
 	args.Args = []string{comp.RemoteCompiler(cfg)}
 	args.Args = append(args.Args, comp.RemoteArgs...)
-	if !cfg.FullPreprocess {
+	args.Args = appendColorArgs(args.Args, cfg, comp)
+	if comp.DirectivesOnly(cfg) {
 		args.Args = append(args.Args, "-fdirectives-only", "-fpreprocessed")
 	}
-	args.Args = append(args.Args, "-x", comp.PreprocessedLanguage, "-o", comp.Output, toRemote(tmp.Name(), wd))
+	args.Args = append(args.Args, "-x", comp.PreprocessedLanguage, "-o", comp.Output, remoteInput)
 
 	out, err := client.InvokeWithFiles(&args)
 	if err != nil {
 		return err
 	}
-	os.Stdout.Write(out.Stdout)
-	os.Stderr.Write(out.Stderr)
-	if out.InvokeErr != "" {
-		return fmt.Errorf("invoke: %s", out.InvokeErr)
+	if out.ExitStatus != 0 && comp.DirectivesOnly(cfg) && isDirectivesOnlyFailure(out.Stderr) {
+		return errDirectivesOnly
 	}
-	if out.ExitStatus != 0 {
-		return fmt.Errorf("invoke: exit %d", out.ExitStatus)
+	held.stdout.Write(out.Stdout)
+	held.stderr.Write(rewriteDiagnostics(out.Stderr, remoteInput, comp.Input))
+	if err := out.Err(); err != nil {
+		return fmt.Errorf("invoke: %w", err)
+	}
+	if code := out.ExitCode(); code != 0 {
+		return &remoteExitError{code: code}
 	}
 
 	return nil
@@ -274,58 +429,113 @@ func checkSupported(cfg *Config, comp *Compilation) error {
 		!cfg.RemoteAssemble {
 		return errors.New("Assembly requested, and LLAMACC_REMOTE_ASSEMBLE unset")
 	}
+	if comp.Language.IsHeader() && cfg.LocalPreprocess {
+		// There's no preprocessed-header language to
+		// precompile preprocessed source as
+		return errors.New("precompiled header requested, and LLAMACC_LOCAL_PREPROCESS set")
+	}
+	if cfg.MinRemoteBytes > 0 {
+		if st, err := os.Stat(toAbs(comp.Input, comp.Dir)); err == nil && st.Size() < int64(cfg.MinRemoteBytes) {
+			return fmt.Errorf("input is smaller than LLAMACC_MIN_REMOTE_BYTES (%d < %d)",
+				st.Size(), cfg.MinRemoteBytes)
+		}
+	}
 	return nil
 }
 
 func main() {
-	cfg := ParseConfig(os.Environ())
+	if len(os.Args) == 3 && os.Args[1] == serveFlag {
+		if err := serve(os.Args[2]); err != nil {
+			log.Fatalf("llamacc: %s", err.Error())
+		}
+		return
+	}
+	wd, _ := files.WorkingDir()
+	cfg := LoadConfig(os.Environ(), wd)
+	cfg.StderrTerminal = stderrIsTerminal()
+	os.Exit(compile(&cfg, wd, os.Args, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// compile runs the compiler command line argv, as llamacc was
+// invoked, in the absolute directory dir, and returns the status to
+// exit with.
+func compile(cfg *Config, dir string, argv []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	var err error
 	var comp Compilation
+	// fallback is set if we are compiling locally because a
+	// remote attempt failed, rather than because we never tried
+	fallback := false
 	if cfg.Local {
 		err = errors.New("LLAMACC_LOCAL set")
 	}
 	if err == nil {
-		comp, err = ParseCompile(&cfg, os.Args)
+		comp, err = ParseCompile(cfg, argv)
+		comp.Dir = dir
 	}
 	if err == nil {
-		err = checkSupported(&cfg, &comp)
+		err = checkSupported(cfg, &comp)
 	}
 	if err == nil {
-		err = runLlamaCC(&cfg, &comp)
+		var held heldOutput
+		err = runLlamaCC(cfg, &comp, &held)
 		if err != nil {
 			if ex, ok := err.(*exec.ExitError); ok {
-				os.Exit(ex.ExitCode())
+				held.flush(stdout, stderr)
+				return ex.ExitCode()
 			}
-			if cfg.LocalFallback {
+			var invokeErr *daemon.InvokeError
+			var exitErr *remoteExitError
+			if cfg.LocalFallback || errors.Is(err, errPreferLocal) ||
+				errors.Is(err, server.ErrAutostartTimeout) {
+				fallback = true
 				goto RetryLocal
-			} else if strings.Contains(err.Error(), "timed out") {
+			} else if errors.As(err, &invokeErr) &&
+				(invokeErr.Category == daemon.Timeout || invokeErr.Category == daemon.Throttled) {
+				fallback = true
 				goto RetryLocal
+			} else if errors.As(err, &exitErr) {
+				// The compiler has reported why
+				held.flush(stdout, stderr)
+				return exitErr.code
 			} else {
-				fmt.Fprintf(os.Stderr, "Running llamacc: %s\n", err.Error())
-				os.Exit(1)
+				held.flush(stdout, stderr)
+				fmt.Fprintf(stderr, "Running llamacc: %s\n", err.Error())
+				return 1
 			}
 		}
-		os.Exit(0)
+		held.flush(stdout, stderr)
+		return 0
 	}
 RetryLocal:
 	if cfg.Verbose {
-		log.Printf("[llamacc] compiling locally: %s (%q)", err.Error(), os.Args)
+		log.Printf("[llamacc] compiling locally: %s (%q)", err.Error(), argv)
 	}
 
 	cc := cfg.LocalCC
-	if strings.HasSuffix(os.Args[0], "cxx") || strings.HasSuffix(os.Args[0], "c++") {
+	if strings.HasSuffix(argv[0], "cxx") || strings.HasSuffix(argv[0], "c++") {
 		cc = cfg.LocalCXX
 	}
 
-	cmd := exec.Command(cc, os.Args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
+	// Only fallbacks take a slot. Other local compiles, such as
+	// links and configure probes, would run locally without
+	// llamacc too, and shouldn't have to dial the daemon.
+	release := func() {}
+	if fallback {
+		release = acquireLocalSlot(cfg)
+	}
+	cmd := exec.Command(cc, argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	err = cmd.Run()
+	release()
+	if err != nil {
 		if ex, ok := err.(*exec.ExitError); ok {
-			os.Exit(ex.ExitCode())
+			return ex.ExitCode()
 		}
-		fmt.Fprintf(os.Stderr, "Running %s locally: %s\n", cc, err.Error())
-		os.Exit(1)
+		fmt.Fprintf(stderr, "Running %s locally: %s\n", cc, err.Error())
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,75 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteDiagnostics(t *testing.T) {
+	stderr := `In file included from _root/home/me/src/hello.c:1:
+_root/home/me/src/include/util.h:3:1: error: unknown type name 'strnig'
+_root/home/me/src/hello.c:5:2: warning: unused variable 'x'
+`
+	want := `In file included from src/hello.c:1:
+/home/me/src/include/util.h:3:1: error: unknown type name 'strnig'
+src/hello.c:5:2: warning: unused variable 'x'
+`
+	got := rewriteDiagnostics([]byte(stderr), "_root/home/me/src/hello.c", "src/hello.c")
+	assert.Equal(t, want, string(got))
+
+	assert.Nil(t, rewriteDiagnostics(nil, "_root/a.c", "a.c"))
+}
+
+func TestIsDirectivesOnlyFailure(t *testing.T) {
+	assert.True(t, isDirectivesOnlyFailure([]byte(
+		"foo.c:3:5: error: '__COUNTER__' expanded inside directive with -fdirectives-only\n")))
+	assert.False(t, isDirectivesOnlyFailure([]byte(
+		"foo.c:3:5: error: expected ';' before '}' token\n")))
+}
+
+func TestCheckSupported_MinRemoteBytes(t *testing.T) {
+	dir := t.TempDir()
+	small := path.Join(dir, "small.c")
+	big := path.Join(dir, "big.c")
+	ioutil.WriteFile(small, []byte("int x;\n"), 0644)
+	ioutil.WriteFile(big, bytes.Repeat([]byte("int x;\n"), 100), 0644)
+
+	cfg := Config{MinRemoteBytes: 100}
+	assert.Error(t, checkSupported(&cfg, &Compilation{Input: small, Language: "c"}))
+	assert.NoError(t, checkSupported(&cfg, &Compilation{Input: big, Language: "c"}))
+
+	cfg.MinRemoteBytes = 0
+	assert.NoError(t, checkSupported(&cfg, &Compilation{Input: small, Language: "c"}))
+}
+
+func TestAppendColorArgs(t *testing.T) {
+	args := []string{"cc", "-c", "hello.c"}
+	comp := Compilation{}
+	cfg := Config{}
+	assert.Equal(t, args, appendColorArgs(args, &cfg, &comp))
+
+	cfg.StderrTerminal = true
+	assert.Equal(t, []string{"cc", "-c", "hello.c", "-fdiagnostics-color=always"},
+		appendColorArgs(args[:3:3], &cfg, &comp))
+
+	comp.UnknownArgs = []string{"-fno-color-diagnostics"}
+	assert.Equal(t, args, appendColorArgs(args, &cfg, &comp))
+}
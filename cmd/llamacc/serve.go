@@ -0,0 +1,125 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path"
+
+	"github.com/gofrs/flock"
+	"github.com/nelhage/llama/daemon"
+)
+
+// serveFlag, as llamacc's only argument besides a socket path, runs
+// a compile server instead of compiling. See `llama cc-server`.
+const serveFlag = "--llamacc-serve"
+
+// CompileArgs asks the compile server to run one compiler command
+// line.
+type CompileArgs struct {
+	// Args is the command line llamacc would have been run
+	// with, starting with "llamacc" or "llamac++"
+	Args []string
+	// Dir is the directory to compile in
+	Dir string
+	// Env, if set, replaces the server's environment when
+	// reading LLAMACC_* settings
+	Env []string
+	// StderrTerminal says whether the client shows diagnostics
+	// on a terminal, so that they are colored as a local compile
+	// would color them
+	StderrTerminal bool
+}
+
+type CompileReply struct {
+	ExitStatus int
+	Stdout     []byte
+	Stderr     []byte
+}
+
+// CompileServer compiles on behalf of clients, such as editors, that
+// would otherwise run llamacc once per compile. Compiles run
+// concurrently, each in its own directory.
+type CompileServer struct{}
+
+func (s *CompileServer) Compile(in *CompileArgs, out *CompileReply) error {
+	if len(in.Args) == 0 {
+		return errors.New("no command line")
+	}
+	if !path.IsAbs(in.Dir) {
+		return errors.New("directory must be an absolute path")
+	}
+	env := in.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	if st, err := os.Stat(in.Dir); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("%s: not a directory", in.Dir)
+	}
+
+	cfg := LoadConfig(env, in.Dir)
+	cfg.StderrTerminal = in.StderrTerminal
+	var stdout, stderr bytes.Buffer
+	out.ExitStatus = compile(&cfg, in.Dir, in.Args, nil, &stdout, &stderr)
+	out.Stdout = stdout.Bytes()
+	out.Stderr = stderr.Bytes()
+	return nil
+}
+
+// serve runs a compile server on a unix socket at sockPath. Clients
+// call CompileServer.Compile using JSON-RPC 1.0, as implemented by
+// net/rpc/jsonrpc.
+func serve(sockPath string) error {
+	lk := flock.New(sockPath + ".lock")
+	ok, err := lk.TryLock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("a compile server is already running on " + sockPath)
+	}
+	defer lk.Unlock()
+	listener, err := daemon.Listen(sockPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("llamacc: serving compiles on %s", sockPath)
+	return serveListener(listener)
+}
+
+func serveListener(listener net.Listener) error {
+	srv := rpc.NewServer()
+	if err := srv.Register(&CompileServer{}); err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc/jsonrpc"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileServer(t *testing.T) {
+	dir := t.TempDir()
+	cc := path.Join(dir, "cc")
+	require.NoError(t, ioutil.WriteFile(cc,
+		[]byte("#!/bin/sh\npwd\necho \"$@\"\necho warning >&2\nexit 3\n"), 0755))
+	work := t.TempDir()
+
+	sock := path.Join(dir, "cc.sock")
+	listener, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- serveListener(listener) }()
+
+	client, err := jsonrpc.Dial("unix", sock)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var reply CompileReply
+	err = client.Call("CompileServer.Compile", &CompileArgs{
+		Args: []string{"llamacc", "-c", "hello.c"},
+		Dir:  work,
+		Env:  []string{"LLAMACC_LOCAL=1", "LLAMACC_LOCAL_CC=" + cc},
+	}, &reply)
+	require.NoError(t, err)
+	assert.Equal(t, 3, reply.ExitStatus)
+	assert.Equal(t, work+"\n-c hello.c\n", string(reply.Stdout))
+	assert.Equal(t, "warning\n", string(reply.Stderr))
+
+	err = client.Call("CompileServer.Compile", &CompileArgs{Dir: dir}, &reply)
+	assert.Error(t, err)
+	err = client.Call("CompileServer.Compile", &CompileArgs{
+		Args: []string{"llamacc", "-c", "hello.c"},
+		Dir:  "relative",
+	}, &reply)
+	assert.Error(t, err)
+
+	listener.Close()
+	assert.Error(t, <-done)
+}
+
+func TestCompileServerConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	// Each compile waits for the other to start, so they must
+	// run at the same time.
+	cc := path.Join(dir, "cc")
+	require.NoError(t, ioutil.WriteFile(cc, []byte(`#!/bin/sh
+touch started
+i=0
+while [ ! -e "$3/started" ]; do
+  i=$((i+1)); [ $i -gt 500 ] && exit 1
+  sleep 0.01
+done
+pwd
+`), 0755))
+	a, b := t.TempDir(), t.TempDir()
+
+	sock := path.Join(dir, "cc.sock")
+	listener, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer listener.Close()
+	go serveListener(listener)
+
+	client, err := jsonrpc.Dial("unix", sock)
+	require.NoError(t, err)
+	defer client.Close()
+
+	env := []string{"LLAMACC_LOCAL=1", "LLAMACC_LOCAL_CC=" + cc}
+	var ra, rb CompileReply
+	ca := client.Go("CompileServer.Compile", &CompileArgs{
+		Args: []string{"llamacc", "-c", "a.c", b}, Dir: a, Env: env,
+	}, &ra, nil)
+	cb := client.Go("CompileServer.Compile", &CompileArgs{
+		Args: []string{"llamacc", "-c", "b.c", a}, Dir: b, Env: env,
+	}, &rb, nil)
+	require.NoError(t, (<-ca.Done).Error)
+	require.NoError(t, (<-cb.Done).Error)
+	assert.Equal(t, 0, ra.ExitStatus)
+	assert.Equal(t, a+"\n", string(ra.Stdout))
+	assert.Equal(t, 0, rb.ExitStatus)
+	assert.Equal(t, b+"\n", string(rb.Stdout))
+}
@@ -14,8 +14,19 @@
 
 package daemon
 
-import "net/rpc"
+import (
+	"context"
+	"net/rpc"
+)
 
+// Client is a connection to the llama daemon. Calls are multiplexed
+// over a single connection and a Client is safe for concurrent use,
+// so a process should dial once and share its Client. The RPC
+// protocol takes over the connection after an initial HTTP CONNECT,
+// so there is no HTTP keepalive or transport-level pooling to tune:
+// each Client costs exactly one connect. (llamacc makes a second
+// connection, for a slot in the daemon's local-compile pool, when it
+// falls back to compiling locally.)
 type Client struct {
 	conn *rpc.Client
 }
@@ -42,12 +53,58 @@ func (c *Client) InvokeWithFiles(in *InvokeWithFilesArgs) (*InvokeWithFilesReply
 	return &out, err
 }
 
+// InvokeWithFilesContext is like InvokeWithFiles, but gives up
+// when ctx is done. If ctx has a deadline, it is also passed along to
+// the daemon. Because net/rpc offers no way to cancel an individual
+// call, the client's connection is closed on cancellation and may not
+// be reused.
+func (c *Client) InvokeWithFilesContext(ctx context.Context, in *InvokeWithFilesArgs) (*InvokeWithFilesReply, error) {
+	if dl, ok := ctx.Deadline(); ok && (in.Deadline.IsZero() || dl.Before(in.Deadline)) {
+		in.Deadline = dl
+	}
+	var out InvokeWithFilesReply
+	call := c.conn.Go("Daemon.InvokeWithFiles", in, &out, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return &out, call.Error
+	case <-ctx.Done():
+		c.conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// BatchInvokeWithFiles runs a batch of invocations in a single
+// round trip to the daemon.
+func (c *Client) BatchInvokeWithFiles(in *BatchInvokeWithFilesArgs) (*BatchInvokeWithFilesReply, error) {
+	var out BatchInvokeWithFilesReply
+	err := c.conn.Call("Daemon.BatchInvokeWithFiles", in, &out)
+	return &out, err
+}
+
+func (c *Client) GetSchedulingHint(in *SchedulingHintArgs) (*SchedulingHintReply, error) {
+	var out SchedulingHintReply
+	err := c.conn.Call("Daemon.GetSchedulingHint", in, &out)
+	return &out, err
+}
+
 func (c *Client) GetDaemonStats(in *StatsArgs) (*StatsReply, error) {
 	var out StatsReply
 	err := c.conn.Call("Daemon.GetDaemonStats", in, &out)
 	return &out, err
 }
 
+func (c *Client) GetConfig(in *GetConfigArgs) (*GetConfigReply, error) {
+	var out GetConfigReply
+	err := c.conn.Call("Daemon.GetConfig", in, &out)
+	return &out, err
+}
+
+func (c *Client) ReloadConfig(in *ReloadConfigArgs) (*ReloadConfigReply, error) {
+	var out ReloadConfigReply
+	err := c.conn.Call("Daemon.ReloadConfig", in, &out)
+	return &out, err
+}
+
 func (c *Client) TraceSpans(in *TraceSpansArgs) (*TraceSpansReply, error) {
 	var out TraceSpansReply
 	err := c.conn.Call("Daemon.TraceSpans", in, &out)
@@ -15,22 +15,38 @@
 package daemon
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"io"
+	"net/http"
 	"net/rpc"
 )
 
-func Dial(_ context.Context, sockPath string) (*Client, error) {
-	conn, err := rpc.DialHTTP("unix", sockPath)
+// connected is the response net/rpc's HTTP handler sends to a
+// successful CONNECT.
+const connected = "200 Connected to Go RPC"
+
+// DialPath connects to the daemon listening at sockPath, speaking
+// RPC over an HTTP CONNECT to urlPath, like rpc.DialHTTPPath, but
+// over whichever transport the daemon uses on this platform.
+func DialPath(_ context.Context, sockPath string, urlPath string) (*Client, error) {
+	conn, err := dialTransport(sockPath)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
-}
-
-func DialPath(_ context.Context, sockPath string, urlPath string) (*Client, error) {
-	conn, err := rpc.DialHTTPPath("unix", sockPath, urlPath)
+	io.WriteString(conn, "CONNECT "+urlPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != connected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return &Client{conn}, nil
+	return &Client{rpc.NewClient(conn)}, nil
+}
+
+func Dial(ctx context.Context, sockPath string) (*Client, error) {
+	return DialPath(ctx, sockPath, rpc.DefaultRPCPath)
 }
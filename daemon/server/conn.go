@@ -0,0 +1,84 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+
+	"github.com/nelhage/llama/daemon"
+)
+
+// connDaemon is the RPC receiver for a single client
+// connection. Its context is canceled when the client disconnects,
+// so that abandoned invocations stop costing us S3 and Lambda time.
+type connDaemon struct {
+	*Daemon
+	ctx context.Context
+}
+
+func (c *connDaemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.InvokeWithFilesReply) error {
+	return c.Daemon.invokeWithFiles(c.ctx, in, out)
+}
+
+func (c *connDaemon) BatchInvokeWithFiles(in *daemon.BatchInvokeWithFilesArgs, out *daemon.BatchInvokeWithFilesReply) error {
+	return c.Daemon.batchInvokeWithFiles(c.ctx, in, out)
+}
+
+// cancelOnErrorConn cancels a context once a read from the
+// underlying connection fails. net/rpc always has a read outstanding
+// for the next request, so this fires promptly when the peer hangs
+// up.
+type cancelOnErrorConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnErrorConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+// serveRPC is equivalent to rpc.Server.ServeHTTP, except that calls
+// on the connection see a context derived from the request's, which
+// is canceled when the client goes away.
+func (d *Daemon) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("rpc hijacking %s: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+
+	srv := rpc.NewServer()
+	srv.RegisterName("Daemon", &connDaemon{Daemon: d, ctx: ctx})
+	srv.ServeConn(&cancelOnErrorConn{Conn: conn, cancel: cancel})
+}
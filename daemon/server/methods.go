@@ -16,16 +16,23 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/llama"
 	"github.com/nelhage/llama/protocol"
@@ -47,15 +54,29 @@ func (d *Daemon) Shutdown(in daemon.ShutdownArgs, out *daemon.ShutdownReply) err
 	return nil
 }
 
-func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.InvokeWithFilesReply) error {
-	ctx := d.ctx
+func (d *Daemon) invokeWithFiles(ctx context.Context, in *daemon.InvokeWithFilesArgs, out *daemon.InvokeWithFilesReply) error {
+	if !in.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, in.Deadline)
+		defer cancel()
+	}
 	ctx, sb := tracing.StartPropagatedSpan(ctx, "InvokeWithFiles", in.Trace)
 	defer sb.End()
 	sb.AddField("function", in.Function)
 
 	if in.DropSemaphore {
 		d.releaseSem()
-		defer d.acquireSem(ctx)
+		defer d.acquireSem(d.ctx)
+	}
+
+	if d.inFlightSem != nil {
+		ctx, sb := tracing.StartSpan(ctx, "wait_in_flight")
+		err := d.inFlightSem.Acquire(ctx, 1)
+		sb.End()
+		if err != nil {
+			return err
+		}
+		defer d.inFlightSem.Release(1)
 	}
 
 	atomic.AddUint64(&d.stats.Invocations, 1)
@@ -91,32 +112,92 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		if !path.IsAbs(f.Local.Path) {
 			return fmt.Errorf("must pass absolute path: %s", f.Local.Path)
 		}
+		if in.NoClobber {
+			if _, err := os.Lstat(f.Local.Path); err == nil {
+				return fmt.Errorf("output %s already exists, refusing to overwrite it", f.Local.Path)
+			}
+		}
 	}
 
+	maxInline := d.maxInlineRequest
+	if in.MaxInlineRequest != 0 {
+		maxInline = in.MaxInlineRequest
+	}
+
+	be := d.currentBackend()
 	args := llama.InvokeArgs{
 		Function:   in.Function,
+		Qualifier:  in.Qualifier,
 		ReturnLogs: in.ReturnLogs,
 		Spec: protocol.InvocationSpec{
-			Args: in.Args,
+			Args:              in.Args,
+			MaxInlineResponse: d.maxInlineResponse,
+			ArchiveOutputs:    in.ArchiveOutputs,
 		},
 	}
+	if in.MaxInlineResponse != 0 {
+		args.Spec.MaxInlineResponse = in.MaxInlineResponse
+	}
+	if args.Function == "" {
+		args.Function = be.Function
+	}
+	if args.Function == "" {
+		return errors.New("no function specified, and no default_function configured")
+	}
+	region := in.Region
+	if region == "" {
+		region = d.regions.chosen(args.Function)
+	}
+	if region != "" {
+		sb.AddField("region", region)
+	}
+	lambdaClient, err := be.lambdaFor(region)
+	if err != nil {
+		return err
+	}
 
 	t_start := time.Now()
 
 	{
 		ctx, sb := tracing.StartSpan(ctx, "upload")
 		sb.AddField("files", len(in.Files))
+		ctx = d.uploadContext(ctx)
 		var err error
-		args.Spec.Files, err = in.Files.Upload(ctx, d.store, nil)
+		if in.ArchiveFiles {
+			args.Spec.Archive, err = in.Files.UploadAsArchive(ctx, be.Store, maxInline)
+		} else if in.PackFiles {
+			args.Spec.Files, err = in.Files.UploadPacked(ctx, be.Store, maxInline, nil)
+		} else {
+			args.Spec.Files, err = in.Files.Upload(ctx, be.Store, maxInline, nil)
+		}
 		if err != nil {
 			sb.AddField("error", fmt.Sprintf("upload: %s", err.Error()))
-			return err
+			*out = daemon.InvokeWithFilesReply{
+				InvokeErr:     fmt.Sprintf("uploading files: %s", err.Error()),
+				ErrorCategory: daemon.InfraError,
+			}
+			return nil
 		}
 		if in.Stdin != nil {
-			args.Spec.Stdin, err = files.NewBlob(ctx, d.store, in.Stdin)
+			args.Spec.Stdin, err = files.NewBlob(ctx, be.Store, in.Stdin, maxInline)
 			if err != nil {
 				sb.AddField("error", fmt.Sprintf("stdin: %s", err.Error()))
-				return err
+				*out = daemon.InvokeWithFilesReply{
+					InvokeErr:     fmt.Sprintf("uploading stdin: %s", err.Error()),
+					ErrorCategory: daemon.InfraError,
+				}
+				return nil
+			}
+		}
+		if in.Script != nil {
+			args.Spec.Script, err = files.NewBlob(ctx, be.Store, in.Script, maxInline)
+			if err != nil {
+				sb.AddField("error", fmt.Sprintf("script: %s", err.Error()))
+				*out = daemon.InvokeWithFilesReply{
+					InvokeErr:     fmt.Sprintf("uploading script: %s", err.Error()),
+					ErrorCategory: daemon.InfraError,
+				}
+				return nil
 			}
 		}
 		for _, out := range in.Outputs {
@@ -128,7 +209,7 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	t_invoke := time.Now()
 
 	atomic.AddUint64(&d.stats.Usage.Lambda.Requests, 1)
-	repl, invokeErr := llama.Invoke(ctx, d.lambda, d.store, &args)
+	repl, invokeErr := llama.Invoke(ctx, lambdaClient, be.Store, &args)
 	if invokeErr != nil {
 		sb.AddField("error", fmt.Sprintf("invoke: %s", invokeErr.Error()))
 		if _, ok := invokeErr.(*llama.ErrorReturn); ok {
@@ -139,7 +220,15 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	}
 
 	if invokeErr != nil && repl == nil {
-		return invokeErr
+		*out = daemon.InvokeWithFilesReply{
+			InvokeErr:     invokeErr.Error(),
+			ErrorCategory: classifyError(ctx, invokeErr),
+		}
+		if ret, ok := invokeErr.(*llama.ErrorReturn); ok {
+			out.Logs = ret.Logs
+			out.Usage.Lambda.Requests = 1
+		}
+		return nil
 	}
 
 	t_fetch := time.Now()
@@ -151,6 +240,8 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Write_Requests, repl.Response.Usage.S3.Write_Requests)
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Xfer_In, repl.Response.Usage.S3.Xfer_In)
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Xfer_Out, repl.Response.Usage.S3.Xfer_Out)
+	atomic.AddUint64(&d.stats.Usage.RemoteS3.DiskCache_Hits, repl.Response.Usage.S3.DiskCache_Hits)
+	atomic.AddUint64(&d.stats.Usage.RemoteS3.DiskCache_Misses, repl.Response.Usage.S3.DiskCache_Misses)
 
 	var gets []store.GetRequest
 
@@ -168,9 +259,14 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	*out = daemon.InvokeWithFilesReply{
 		Logs:       repl.Logs,
 		ExitStatus: repl.Response.ExitStatus,
+		Signal:     repl.Response.Signal,
+		Worker:     repl.Response.Worker,
+		Usage:      repl.Response.Usage,
 	}
+	out.Usage.Lambda.Requests = 1
 	if invokeErr != nil {
 		out.InvokeErr = invokeErr.Error()
+		out.ErrorCategory = classifyError(ctx, invokeErr)
 	}
 
 	if repl.Response.Stdout != nil {
@@ -181,13 +277,27 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		gets = files.AppendGet(gets, repl.Response.Stderr)
 	}
 
-	d.store.GetObjects(ctx, gets)
+	if repl.Response.OutputArchive != nil {
+		gets = files.AppendGet(gets, repl.Response.OutputArchive)
+	}
+
+	be.Store.GetObjects(ctx, gets)
 
-	for _, f := range fetchList {
+	var returned []string
+	for _, f := range repl.Response.Outputs {
+		returned = append(returned, f.Path)
+	}
+
+	for i := range fetchList {
+		f := &fetchList[i]
 		var err error
 		err, gets = files.FetchFile(&f.File, f.Path, gets)
+		if err != nil {
+			err = refetchOutput(ctx, be.Store, f, err)
+		}
 		if err != nil && out.InvokeErr == "" {
 			out.InvokeErr = err.Error()
+			out.ErrorCategory = daemon.InfraError
 		}
 	}
 
@@ -199,6 +309,32 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		out.Stderr, _, gets = files.ReadBlob(repl.Response.Stderr, gets)
 	}
 
+	if repl.Response.OutputArchive != nil {
+		var archive []byte
+		var err error
+		archive, err, gets = files.ReadBlob(repl.Response.OutputArchive, gets)
+		if err == nil {
+			var extracted, extra []string
+			extracted, extra, err = in.Outputs.ExtractArchive(archive)
+			returned = append(returned, extracted...)
+			for _, path := range extra {
+				log.Printf("Remote returned unexpected output: %s", path)
+			}
+		}
+		if err != nil && out.InvokeErr == "" {
+			out.InvokeErr = fmt.Sprintf("fetching outputs: %s", err.Error())
+			out.ErrorCategory = daemon.InfraError
+		}
+	}
+
+	// A command that failed may well not have written its outputs,
+	// but one that succeeded should have.
+	if missing := in.Outputs.Missing(returned); len(missing) > 0 &&
+		out.ExitStatus == 0 && out.InvokeErr == "" {
+		out.InvokeErr = fmt.Sprintf("command did not produce expected output: %s", strings.Join(missing, ", "))
+		out.ErrorCategory = daemon.MissingOutput
+	}
+
 	t_end := time.Now()
 
 	out.Timing.Remote = repl.Response.Times
@@ -215,8 +351,114 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	return nil
 }
 
+// outputFetchRetries is how many more times we try to fetch an
+// output whose first fetch failed.
+const outputFetchRetries = 2
+
+// refetchOutput retries a failed output fetch. Objects are
+// content-addressed, so fetching one again is always safe. If every
+// attempt fails, it removes the destination, so a build doesn't
+// mistake a stale or truncated file for the output.
+func refetchOutput(ctx context.Context, st store.Store, f *protocol.FileAndPath, err error) error {
+	if f.Blob.Ref != "" {
+		for i := 0; i < outputFetchRetries && err != nil && ctx.Err() == nil; i++ {
+			log.Printf("fetching output %s: %s; retrying", f.Path, err.Error())
+			gets := files.AppendGet(nil, &f.Blob)
+			st.GetObjects(ctx, gets)
+			err, _ = files.FetchFile(&f.File, f.Path, gets)
+		}
+	}
+	if err != nil {
+		os.Remove(f.Path)
+	}
+	return err
+}
+
+// timedOutPayload is how Lambda reports a function that exceeded its
+// configured timeout.
+var timedOutPayload = []byte("Task timed out")
+
+// classifyError categorizes an error from llama.Invoke. ctx is the
+// invocation's context.
+func classifyError(ctx context.Context, err error) daemon.ErrorCategory {
+	if ret, ok := err.(*llama.ErrorReturn); ok {
+		if bytes.Contains(ret.Payload, timedOutPayload) {
+			return daemon.Timeout
+		}
+		return daemon.FunctionError
+	}
+	if ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		return daemon.Timeout
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == lambda.ErrCodeTooManyRequestsException {
+		return daemon.Throttled
+	}
+	return daemon.InfraError
+}
+
+// batchInvokeWithFiles runs every job in a batch concurrently,
+// subject to the daemon's in-flight limit. Files shared between jobs
+// are only uploaded once, since the store deduplicates uploads.
+func (d *Daemon) batchInvokeWithFiles(ctx context.Context, in *daemon.BatchInvokeWithFilesArgs, out *daemon.BatchInvokeWithFilesReply) error {
+	ctx, sb := tracing.StartSpan(ctx, "BatchInvokeWithFiles")
+	defer sb.End()
+	sb.AddField("jobs", len(in.Jobs))
+
+	// The connection holds at most one llamacc semaphore slot, so
+	// release it once for the whole batch rather than per job.
+	drop := false
+	for i := range in.Jobs {
+		drop = drop || in.Jobs[i].DropSemaphore
+		in.Jobs[i].DropSemaphore = false
+	}
+	if drop {
+		d.releaseSem()
+		defer d.acquireSem(d.ctx)
+	}
+
+	out.Results = make([]daemon.BatchInvokeResult, len(in.Jobs))
+	var wg sync.WaitGroup
+	for i := range in.Jobs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := &out.Results[i]
+			if err := d.invokeWithFiles(ctx, &in.Jobs[i], &res.Reply); err != nil {
+				res.Err = err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return nil
+}
+
+// busyFraction is how close to -max-in-flight the daemon must be
+// before it suggests clients run work locally.
+const busyFraction = 0.9
+
+func (d *Daemon) GetSchedulingHint(in *daemon.SchedulingHintArgs, out *daemon.SchedulingHintReply) error {
+	out.InFlight = atomic.LoadUint64(&d.stats.InFlight)
+	out.MaxInFlight = d.maxInFlight
+	out.LocalBusy = atomic.LoadInt64(&d.localBusy)
+	out.PreferLocal = preferLocal(out, runtime.NumCPU())
+	return nil
+}
+
+// preferLocal decides whether remote execution is the bottleneck:
+// invocations are close to the in-flight limit, and there are fewer
+// llamacc processes using local CPU than there are CPUs.
+func preferLocal(hint *daemon.SchedulingHintReply, cpus int) bool {
+	if hint.MaxInFlight <= 0 {
+		return false
+	}
+	saturated := float64(hint.InFlight) >= busyFraction*float64(hint.MaxInFlight)
+	return saturated && hint.LocalBusy <= int64(cpus)
+}
+
 func (d *Daemon) GetDaemonStats(in *daemon.StatsArgs, out *daemon.StatsReply) error {
-	d.store.FetchAWSUsage(&d.stats.Usage.LocalS3)
+	d.currentBackend().Store.FetchAWSUsage(&d.stats.Usage.LocalS3)
+	goroutines, fds := d.sampleResources()
 
 	// TODO: We should really read this a field-at-a-time
 	// using `atomic.LoadUint64`, although I don't believe
@@ -225,6 +467,8 @@ func (d *Daemon) GetDaemonStats(in *daemon.StatsArgs, out *daemon.StatsReply) er
 	// snapshot of the entire stats struct. We could just
 	// use a mutex, I guess.
 	stats := d.stats
+	stats.Goroutines = uint64(goroutines)
+	stats.OpenFDs = int64(fds)
 
 	*out = daemon.StatsReply{
 		Stats: stats,
@@ -235,6 +479,57 @@ func (d *Daemon) GetDaemonStats(in *daemon.StatsArgs, out *daemon.StatsReply) er
 	return nil
 }
 
+func (d *Daemon) GetConfig(in *daemon.GetConfigArgs, out *daemon.GetConfigReply) error {
+	be := d.currentBackend()
+	out.Config = daemon.Config{
+		ServerPid:          os.Getpid(),
+		StoreURL:           be.StoreURL,
+		Region:             aws.StringValue(be.Session.Config.Region),
+		S3Concurrency:      be.S3Concurrency,
+		MaxBandwidth:       be.MaxBandwidth,
+		Function:           be.Function,
+		IdleTimeout:        d.idleTimeout,
+		LlamaCCConcurrency: d.ccConcurrency,
+		MaxInFlight:        d.maxInFlight,
+		MaxInlineRequest:   d.maxInlineRequest,
+		MaxInlineResponse:  d.maxInlineResponse,
+	}
+	return nil
+}
+
+// ReloadConfig re-reads the configuration and swaps in the new
+// backend. Invocations already in flight finish against the old one.
+func (d *Daemon) ReloadConfig(in *daemon.ReloadConfigArgs, out *daemon.ReloadConfigReply) error {
+	if d.reload == nil {
+		return errors.New("this daemon does not support reloading its config")
+	}
+	d.backendMu.Lock()
+	b, err := d.reload()
+	if err != nil {
+		d.backendMu.Unlock()
+		return fmt.Errorf("reloading config: %w", err)
+	}
+	old := d.backend
+	d.backend = newBackend(b)
+	if b.Session == old.Session {
+		d.backend.lambda = old.lambda
+	}
+	if b.Store != old.Store {
+		// Keep the old store's usage in our totals
+		old.Store.FetchAWSUsage(&d.stats.Usage.LocalS3)
+	}
+	d.backendMu.Unlock()
+
+	log.Printf("reloaded config: store=%s function=%s", b.StoreURL, b.Function)
+
+	var cfg daemon.GetConfigReply
+	if err := d.GetConfig(&daemon.GetConfigArgs{}, &cfg); err != nil {
+		return err
+	}
+	out.Config = cfg.Config
+	return nil
+}
+
 func (d *Daemon) TraceSpans(in *daemon.TraceSpansArgs, out *daemon.TraceSpansReply) error {
 	tracing.SubmitAll(d.ctx, in.Spans)
 	*out = daemon.TraceSpansReply{}
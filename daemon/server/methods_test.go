@@ -0,0 +1,127 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store/teststore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	ctx := context.Background()
+	expired, cancel := context.WithDeadline(ctx, time.Time{})
+	defer cancel()
+
+	cases := []struct {
+		ctx  context.Context
+		err  error
+		want daemon.ErrorCategory
+	}{
+		{ctx, &llama.ErrorReturn{Payload: []byte(`{"errorMessage":"2021-01-01T00:00:00.000Z abcd Task timed out after 60.00 seconds"}`)}, daemon.Timeout},
+		{ctx, &llama.ErrorReturn{Payload: []byte(`{"errorType":"Runtime.ExitError"}`)}, daemon.FunctionError},
+		{ctx, fmt.Errorf("Invoke(): %w", awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.", nil)), daemon.Throttled},
+		{ctx, fmt.Errorf("Invoke(): %w", awserr.New(lambda.ErrCodeServiceException, "oops", nil)), daemon.InfraError},
+		{expired, fmt.Errorf("Invoke(): %w", awserr.New("RequestCanceled", "canceled", context.DeadlineExceeded)), daemon.Timeout},
+		{ctx, errors.New("unmarshal: bad json"), daemon.InfraError},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, classifyError(tc.ctx, tc.err), tc.err.Error())
+	}
+}
+
+func TestUploadFilesError(t *testing.T) {
+	st := teststore.New(nil)
+	st.FailStore(1)
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	require.NoError(t, err)
+
+	data := make([]byte, 2*protocol.MaxInlineBlob)
+	rand.Read(data)
+	reply, err := InvokeDirect(context.Background(),
+		&Backend{Store: st, Session: sess, Function: "gcc"},
+		&daemon.InvokeWithFilesArgs{
+			Args:         []string{"true"},
+			ArchiveFiles: true,
+			Files: files.List{{
+				Local:  files.LocalFile{Bytes: data},
+				Remote: "input",
+			}},
+		})
+	require.NoError(t, err)
+	assert.Equal(t, daemon.InfraError, reply.ErrorCategory)
+	assert.Contains(t, reply.InvokeErr, "uploading files")
+}
+
+func TestPreferLocal(t *testing.T) {
+	cases := []struct {
+		hint daemon.SchedulingHintReply
+		want bool
+	}{
+		{daemon.SchedulingHintReply{InFlight: 95, MaxInFlight: 100, LocalBusy: 2}, true},
+		{daemon.SchedulingHintReply{InFlight: 50, MaxInFlight: 100, LocalBusy: 2}, false},
+		{daemon.SchedulingHintReply{InFlight: 100, MaxInFlight: 100, LocalBusy: 9}, false},
+		{daemon.SchedulingHintReply{InFlight: 1000, MaxInFlight: 0, LocalBusy: 0}, false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, preferLocal(&tc.hint, 8), "%+v", tc.hint)
+	}
+}
+
+func TestRefetchOutput(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st := teststore.New(nil)
+	id, err := st.Store(ctx, []byte("object code"))
+	require.NoError(t, err)
+
+	out := path.Join(dir, "out.o")
+	f := protocol.FileAndPath{File: protocol.File{Blob: protocol.Blob{Ref: id}}, Path: out}
+
+	// The first retry fails, and the second succeeds
+	st.FailGet(1)
+	err = refetchOutput(ctx, st, &f, errors.New("first failure"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.Count(teststore.OpGet, id))
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "object code", string(data))
+
+	require.NoError(t, ioutil.WriteFile(out, []byte("stale"), 0644))
+	st.FailGet(3, 4)
+	err = refetchOutput(ctx, st, &f, errors.New("first failure"))
+	assert.Error(t, err)
+	assert.Equal(t, 2+outputFetchRetries, st.Count(teststore.OpGet, id))
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err), "output should be removed, got %v", err)
+}
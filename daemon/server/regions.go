@@ -0,0 +1,160 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// regionProbeInterval is how often the daemon re-measures its
+// latency to each of the configured regions.
+const regionProbeInterval = 5 * time.Minute
+
+// regionProbeTimeout bounds a single latency probe.
+const regionProbeTimeout = 10 * time.Second
+
+// regionLatencyWeight is the weight of each new probe in a region's
+// running average latency.
+const regionLatencyWeight = 0.3
+
+// regionPicker tracks the measured latency to each candidate region
+// and the region invocations are currently routed to.
+type regionPicker struct {
+	mu sync.Mutex
+	// latency is a moving average per region. Regions whose
+	// last probe failed are absent.
+	latency map[string]time.Duration
+	current string
+	// function is the function we found in the candidate
+	// regions. Only its invocations are routed to current.
+	function string
+}
+
+func (p *regionPicker) record(region string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency == nil {
+		p.latency = make(map[string]time.Duration)
+	}
+	if old, ok := p.latency[region]; ok {
+		d = old + time.Duration(regionLatencyWeight*float64(d-old))
+	}
+	p.latency[region] = d
+}
+
+func (p *regionPicker) fail(region string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.latency, region)
+}
+
+// pick chooses the region with the lowest latency, weighted by its
+// cost (1 if unlisted), among regions in the candidates. It returns
+// "" if none have been measured.
+func (p *regionPicker) pick(candidates []string, cost map[string]float64) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := ""
+	var bestScore float64
+	for _, region := range candidates {
+		d, ok := p.latency[region]
+		if !ok {
+			continue
+		}
+		w, ok := cost[region]
+		if !ok {
+			w = 1
+		}
+		score := float64(d) * w
+		if best == "" || score < bestScore {
+			best, bestScore = region, score
+		}
+	}
+	return best
+}
+
+// route sets the region to use for invocations of function that
+// don't ask for one, and reports whether it changed.
+func (p *regionPicker) route(function, region string) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed = region != p.current
+	p.current = region
+	p.function = function
+	return changed
+}
+
+// chosen returns the region to send an invocation of function to,
+// or "" to use the home region. Other functions may not exist in the
+// regions we probed, so they always go to the home region.
+func (p *regionPicker) chosen(function string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if function != p.function {
+		return ""
+	}
+	return p.current
+}
+
+// probeRegions measures the latency of a cheap Lambda API call for
+// the default function in each configured region, and updates
+// which region new invocations go to.
+func (d *Daemon) probeRegions(ctx context.Context) {
+	be := d.currentBackend()
+	for _, region := range be.Regions {
+		cl, err := be.lambdaFor(region)
+		if err != nil {
+			log.Printf("probing region %s: %s", region, err.Error())
+			d.regions.fail(region)
+			continue
+		}
+		pctx, cancel := context.WithTimeout(ctx, regionProbeTimeout)
+		start := time.Now()
+		_, err = cl.GetFunctionConfigurationWithContext(pctx, &lambda.GetFunctionConfigurationInput{
+			FunctionName: &be.Function,
+		})
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			log.Printf("probing region %s: %s", region, err.Error())
+			d.regions.fail(region)
+			continue
+		}
+		d.regions.record(region, elapsed)
+	}
+	region := d.regions.pick(be.Regions, be.RegionCost)
+	if d.regions.route(be.Function, region) && region != "" {
+		log.Printf("routing invocations to region %s", region)
+	}
+}
+
+// watchRegions probes the configured regions until ctx is done.
+func (d *Daemon) watchRegions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.probeRegions(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
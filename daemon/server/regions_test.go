@@ -0,0 +1,57 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionPicker(t *testing.T) {
+	var p regionPicker
+	regions := []string{"us-west-2", "us-east-1", "eu-west-1"}
+	assert.Equal(t, "", p.pick(regions, nil))
+
+	p.record("us-west-2", 20*time.Millisecond)
+	p.record("us-east-1", 80*time.Millisecond)
+	p.record("eu-west-1", 150*time.Millisecond)
+	assert.Equal(t, "us-west-2", p.pick(regions, nil))
+
+	// Cheaper regions win despite somewhat higher latency
+	cost := map[string]float64{"us-west-2": 5}
+	assert.Equal(t, "us-east-1", p.pick(regions, cost))
+
+	// A single slow probe moves the average only part way
+	p.record("us-west-2", 220*time.Millisecond)
+	assert.Equal(t, 80*time.Millisecond, p.latency["us-west-2"])
+	assert.Equal(t, "us-west-2", p.pick(regions, nil))
+
+	p.fail("us-west-2")
+	assert.Equal(t, "us-east-1", p.pick(regions, nil))
+	assert.Equal(t, "eu-west-1", p.pick([]string{"eu-west-1"}, nil))
+}
+
+func TestRegionRouting(t *testing.T) {
+	var p regionPicker
+	assert.Equal(t, "", p.chosen("gcc"))
+
+	assert.True(t, p.route("gcc", "us-east-1"))
+	assert.False(t, p.route("gcc", "us-east-1"))
+	assert.Equal(t, "us-east-1", p.chosen("gcc"))
+	// We only know that the probed function exists there
+	assert.Equal(t, "", p.chosen("other"))
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// resourceSampleInterval is how often the daemon samples its
+// goroutine and open file counts, looking for leaks.
+const resourceSampleInterval = time.Minute
+
+// countOpenFDs returns the number of file descriptors this process
+// has open, or -1 if the platform doesn't let us list them.
+func countOpenFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if ents, err := ioutil.ReadDir(dir); err == nil {
+			return len(ents)
+		}
+	}
+	return -1
+}
+
+// growthWatch logs a warning each time a count doubles from the
+// level it last warned at, starting from its first sample. A count
+// that grows without bound is thus reported a logarithmic number of
+// times.
+type growthWatch struct {
+	name   string
+	warnAt int
+}
+
+// minWarnAt keeps small counts from warning on ordinary
+// fluctuations.
+const minWarnAt = 256
+
+func (w *growthWatch) check(n int) bool {
+	if n < 0 {
+		return false
+	}
+	if w.warnAt == 0 {
+		w.warnAt = 2 * n
+		if w.warnAt < minWarnAt {
+			w.warnAt = minWarnAt
+		}
+		return false
+	}
+	if n < w.warnAt {
+		return false
+	}
+	log.Printf("%s has grown to %d; the daemon may be leaking them", w.name, n)
+	w.warnAt = 2 * n
+	return true
+}
+
+// raiseMax sets *max to v if v is larger.
+func raiseMax(max *uint64, v uint64) {
+	for {
+		old := atomic.LoadUint64(max)
+		if v <= old || atomic.CompareAndSwapUint64(max, old, v) {
+			return
+		}
+	}
+}
+
+// sampleResources records the current goroutine and open file counts
+// in the daemon's stats, and returns them.
+func (d *Daemon) sampleResources() (goroutines, fds int) {
+	goroutines = runtime.NumGoroutine()
+	fds = countOpenFDs()
+	raiseMax(&d.stats.MaxGoroutines, uint64(goroutines))
+	if fds >= 0 {
+		raiseMax(&d.stats.MaxOpenFDs, uint64(fds))
+	}
+	return goroutines, fds
+}
+
+// watchResources samples the daemon's goroutine and open file counts
+// until ctx is done, warning if they keep growing.
+func (d *Daemon) watchResources(ctx context.Context, interval time.Duration) {
+	goroutines := growthWatch{name: "goroutines"}
+	fds := growthWatch{name: "open files"}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g, f := d.sampleResources()
+		goroutines.check(g)
+		fds.check(f)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrowthWatch(t *testing.T) {
+	w := growthWatch{name: "things"}
+	assert.False(t, w.check(300))
+	assert.False(t, w.check(599))
+	assert.True(t, w.check(600))
+	assert.False(t, w.check(1000))
+	assert.True(t, w.check(1200))
+	assert.False(t, w.check(-1))
+
+	small := growthWatch{name: "things"}
+	small.check(10)
+	assert.False(t, small.check(100), "small counts never warn")
+}
+
+func TestCountOpenFDs(t *testing.T) {
+	if n := countOpenFDs(); n != -1 {
+		assert.Greater(t, n, 0)
+	}
+}
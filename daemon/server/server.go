@@ -18,21 +18,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
-	"net/rpc"
 	"os"
 	"os/exec"
-	"path"
 	"runtime"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/gofrs/flock"
 	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/store"
 	"golang.org/x/sync/semaphore"
 )
@@ -41,18 +42,44 @@ type Daemon struct {
 	ctx context.Context
 
 	shutdown context.CancelFunc
-	store    store.Store
-	session  *session.Session
-	lambda   *lambda.Lambda
+
+	// backend is replaced wholesale by ReloadConfig; read it
+	// via currentBackend.
+	backendMu sync.RWMutex
+	backend   *backend
+	reload    func() (*Backend, error)
 
 	stats daemon.Stats
 
 	llamaccSem *semaphore.Weighted
+	// localBusy counts llamacc processes currently holding
+	// llamaccSem or localSem, i.e. using local CPU
+	localBusy int64
+	// localSem limits concurrent local compiles by llamacc
+	localSem *semaphore.Weighted
+	// inFlightSem limits concurrent invocations through the
+	// daemon from any client. nil means no limit.
+	inFlightSem *semaphore.Weighted
+
+	maxInlineRequest  int
+	maxInlineResponse int
+
+	idleTimeout   time.Duration
+	ccConcurrency int64
+	maxInFlight   int64
 
 	includePathCache struct {
 		sync.RWMutex
 		paths map[compilerAndLanguage][]string
 	}
+
+	// regions picks the region for invocations that don't name
+	// one, if Backend.Regions is set.
+	regions regionPicker
+
+	// contentCache, if non-nil, caches the files we upload
+	contentCache  *files.ContentCache
+	mmapThreshold int64
 }
 
 type compilerAndLanguage struct {
@@ -62,60 +89,166 @@ type compilerAndLanguage struct {
 
 var ErrAlreadyRunning = errors.New("daemon already running")
 
+// ErrAutostartTimeout is returned (wrapped) by DialWithAutostart
+// when a daemon it started never began accepting connections.
+var ErrAutostartTimeout = errors.New("timed out waiting for daemon to start")
+
+// defaultAutostartTimeout bounds how long DialWithAutostart waits
+// for a daemon to start, unless LLAMA_AUTOSTART_TIMEOUT overrides
+// it. A duration of 0 waits forever.
+const defaultAutostartTimeout = 30 * time.Second
+
+// autostartJitter bounds the random delay before a client tries to
+// start a daemon.
+const autostartJitter = 20 * time.Millisecond
+
+// jitter is seeded per process, so that clients started together
+// don't all pick the same delay.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))}
+
+func autostartDelay() time.Duration {
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(autostartJitter)))
+}
+
+func autostartTimeout() time.Duration {
+	if env := os.Getenv("LLAMA_AUTOSTART_TIMEOUT"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			return d
+		}
+	}
+	return defaultAutostartTimeout
+}
+
+// Backend is the part of the daemon's configuration that comes from
+// the user's config file, and can be replaced by ReloadConfig.
+type Backend struct {
+	Store   store.Store
+	Session *session.Session
+	// StoreURL, S3Concurrency and MaxBandwidth are
+	// informational, and only reported by GetConfig.
+	StoreURL      string
+	S3Concurrency int
+	MaxBandwidth  int64
+	// Function is invoked for clients that don't name one.
+	Function string
+
+	// RegionSession returns a session for invocations that ask
+	// for another AWS region. If it is nil, they fail.
+	RegionSession func(region string) (*session.Session, error)
+
+	// Regions, if set, are candidate regions for invocations
+	// that don't name one. The daemon periodically measures its
+	// latency to each, and picks the lowest after multiplying by
+	// the region's RegionCost (default 1).
+	Regions    []string
+	RegionCost map[string]float64
+}
+
+type backend struct {
+	Backend
+	lambda *lambda.Lambda
+}
+
+func newBackend(b *Backend) *backend {
+	return &backend{Backend: *b, lambda: lambda.New(b.Session)}
+}
+
+// lambdaFor returns a Lambda client for region, or the default one
+// if region is empty.
+func (be *backend) lambdaFor(region string) (*lambda.Lambda, error) {
+	if region == "" {
+		return be.lambda, nil
+	}
+	if be.RegionSession == nil {
+		return nil, fmt.Errorf("cannot invoke in region %s", region)
+	}
+	sess, err := be.RegionSession(region)
+	if err != nil {
+		return nil, err
+	}
+	return lambda.New(sess), nil
+}
+
 type StartArgs struct {
+	Backend
+	// Reload, if set, is called by ReloadConfig to re-read
+	// the configuration.
+	Reload func() (*Backend, error)
+
 	Path               string
-	Store              store.Store
-	Session            *session.Session
 	IdleTimeout        time.Duration
 	LlamaCCConcurrency int64
+	// MaxInFlight limits the number of concurrent invocations
+	// from all clients. Zero means no limit.
+	MaxInFlight int64
+
+	// Cutoffs below which blobs are passed inline in requests
+	// and responses. Zero means protocol.MaxInlineBlob.
+	MaxInlineRequest  int
+	MaxInlineResponse int
+
+	// DebugAddr, if set, is a TCP address on which to serve the
+	// net/http/pprof handlers.
+	DebugAddr string
+
+	// ContentCacheTTL, if nonzero, caches the files clients upload,
+	// reusing each for this long while its mtime and size don't
+	// change.
+	ContentCacheTTL time.Duration
+	// MmapThreshold, if positive, maps uploaded files of at least
+	// this many bytes into memory instead of reading them.
+	MmapThreshold int64
 }
 
 const (
 	LlamaCCPath = "/llamacc"
+	// LocalCompilePath is dialed by llamacc while it compiles
+	// locally. The connection holds a slot in a pool sized to the
+	// machine's core count, so that mass local fallback doesn't
+	// oversubscribe the CPU.
+	LocalCompilePath = "/local"
 )
 
 func Start(ctx context.Context, args *StartArgs) error {
-	if err := os.MkdirAll(path.Dir(args.Path), 0700); err != nil {
+	if err := makeSocketDir(args.Path); err != nil {
 		return err
 	}
 
 	lk := flock.New(args.Path + ".lock")
 	ok, err := lk.TryLock()
 	if err != nil {
-		return err
+		return socketError(args.Path, err)
 	}
 	if !ok {
 		return ErrAlreadyRunning
 	}
 	defer lk.Unlock()
 
-	// Unlink the socket if it already exists. We have the
-	// exclusive lock, so we know no one is listening.
-	os.Remove(args.Path)
-	listener, err := net.Listen("unix", args.Path)
-
+	// We have the exclusive lock, so we know no one else is
+	// listening.
+	listener, err := daemon.Listen(args.Path)
 	if err != nil {
-		return err
+		return socketError(args.Path, err)
 	}
 
 	srvCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	concurrency := args.LlamaCCConcurrency
-	if concurrency == 0 {
-		concurrency = 2 * int64(runtime.NumCPU())
+	if args.DebugAddr != "" {
+		if err := serveDebug(srvCtx, args.DebugAddr); err != nil {
+			return fmt.Errorf("debug address: %w", err)
+		}
 	}
 
-	daemon := Daemon{
-		ctx:      srvCtx,
-		shutdown: cancel,
-		store:    args.Store,
-		session:  args.Session,
-		lambda:   lambda.New(args.Session),
+	daemon := newDaemon(srvCtx, cancel, args)
 
-		llamaccSem: semaphore.NewWeighted(concurrency),
-	}
-	daemon.includePathCache.paths = make(map[compilerAndLanguage][]string)
+	go daemon.watchResources(srvCtx, resourceSampleInterval)
+	go daemon.watchRegions(srvCtx, regionProbeInterval)
 
 	extend := make(chan struct{})
 	go func() {
@@ -124,15 +257,23 @@ func Start(ctx context.Context, args *StartArgs) error {
 	}()
 
 	var httpSrv http.Server
-	var rpcSrv rpc.Server
-	rpcSrv.Register(&daemon)
+	httpSrv.BaseContext = func(net.Listener) context.Context { return srvCtx }
 	httpSrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == LlamaCCPath {
 			daemon.acquireSem(srvCtx)
 			defer daemon.releaseSem()
+		} else if r.URL.Path == LocalCompilePath {
+			if err := daemon.localSem.Acquire(r.Context(), 1); err != nil {
+				return
+			}
+			atomic.AddInt64(&daemon.localBusy, 1)
+			defer func() {
+				atomic.AddInt64(&daemon.localBusy, -1)
+				daemon.localSem.Release(1)
+			}()
 		}
 		extend <- struct{}{}
-		rpcSrv.ServeHTTP(w, r)
+		daemon.serveRPC(w, r)
 	})
 	go func() {
 		httpSrv.Serve(listener)
@@ -143,55 +284,144 @@ func Start(ctx context.Context, args *StartArgs) error {
 	return nil
 }
 
+func newDaemon(ctx context.Context, cancel context.CancelFunc, args *StartArgs) *Daemon {
+	concurrency := args.LlamaCCConcurrency
+	if concurrency == 0 {
+		concurrency = 2 * int64(runtime.NumCPU())
+	}
+
+	d := &Daemon{
+		ctx:      ctx,
+		shutdown: cancel,
+		backend:  newBackend(&args.Backend),
+		reload:   args.Reload,
+
+		llamaccSem: semaphore.NewWeighted(concurrency),
+		localSem:   semaphore.NewWeighted(int64(runtime.NumCPU())),
+
+		maxInlineRequest:  args.MaxInlineRequest,
+		maxInlineResponse: args.MaxInlineResponse,
+
+		idleTimeout:   args.IdleTimeout,
+		ccConcurrency: concurrency,
+		maxInFlight:   args.MaxInFlight,
+
+		mmapThreshold: args.MmapThreshold,
+	}
+	if args.MaxInFlight > 0 {
+		d.inFlightSem = semaphore.NewWeighted(args.MaxInFlight)
+	}
+	if d.maxInlineRequest == 0 {
+		d.maxInlineRequest = protocol.MaxInlineBlob
+	}
+	if d.maxInlineResponse == 0 {
+		d.maxInlineResponse = protocol.MaxInlineBlob
+	}
+	if args.ContentCacheTTL > 0 {
+		d.contentCache = files.NewContentCache(args.ContentCacheTTL)
+	}
+	d.includePathCache.paths = make(map[compilerAndLanguage][]string)
+	return d
+}
+
+// uploadContext returns a context in which uploads read files as
+// the daemon is configured to: through its content cache, or mapping
+// large ones into memory.
+func (d *Daemon) uploadContext(ctx context.Context) context.Context {
+	if d.contentCache != nil {
+		ctx = files.WithContentCache(ctx, d.contentCache)
+	}
+	if d.mmapThreshold > 0 {
+		ctx = files.WithMmapThreshold(ctx, d.mmapThreshold)
+	}
+	return ctx
+}
+
+// InvokeDirect performs a single invocation in-process, exactly as a
+// daemon configured with b would, for callers that would rather not
+// start one.
+func InvokeDirect(ctx context.Context, b *Backend, in *daemon.InvokeWithFilesArgs) (*daemon.InvokeWithFilesReply, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := newDaemon(ctx, cancel, &StartArgs{Backend: *b})
+	// There is no llamacc semaphore to release
+	in.DropSemaphore = false
+	var out daemon.InvokeWithFilesReply
+	err := d.invokeWithFiles(ctx, in, &out)
+	return &out, err
+}
+
 func DialWithAutostart(ctx context.Context, sockPath string, urlPath string) (*daemon.Client, error) {
 	cl, err := daemon.DialPath(ctx, sockPath, urlPath)
 	if err == nil {
 		return cl, nil
 	}
-	cmd := exec.Command("llama", "daemon", "-autostart", "-path", sockPath)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
+	if errors.Is(err, os.ErrPermission) {
+		// The daemon is running, but we may not talk to it;
+		// starting another won't help.
+		return nil, fmt.Errorf("connecting to daemon at %s: %w", sockPath, err)
 	}
-	if err := cmd.Start(); err != nil {
+	if err := checkSocketDir(sockPath); err != nil {
 		return nil, err
 	}
+	var timeout <-chan time.Time
+	if d := autostartTimeout(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
-	exitStatus := make(chan error)
-	connected := make(chan *daemon.Client)
-	shutdown := make(chan struct{})
-	go func() {
-		defer close(exitStatus)
-		exitStatus <- cmd.Wait()
-	}()
-	go func() {
-		for {
-			cl, err := daemon.DialPath(ctx, sockPath, urlPath)
-			if err == nil {
-				connected <- cl
-				return
-			}
-			select {
-			case <-shutdown:
-				return
-			case <-time.After(10 * time.Millisecond):
-				// Try again
+	// A parallel build may start many clients at once, all finding
+	// no daemon. Stagger them, and only let the one holding the
+	// spawn lock start a daemon; the rest wait for it to come up.
+	// The daemon's own lock would keep extra daemons from
+	// running, but not from being spawned.
+	time.Sleep(autostartDelay())
+	spawnLock := flock.New(sockPath + ".autostart.lock")
+	defer spawnLock.Unlock()
+
+	var exitStatus chan error
+	spawned := false
+	for {
+		cl, err := daemon.DialPath(ctx, sockPath, urlPath)
+		if err == nil {
+			return cl, nil
+		}
+		if !spawned {
+			if locked, err := spawnLock.TryLock(); err != nil {
+				return nil, fmt.Errorf("Starting server: %w", err)
+			} else if locked {
+				// Whoever held the lock may have just
+				// finished starting a daemon.
+				if cl, err := daemon.DialPath(ctx, sockPath, urlPath); err == nil {
+					return cl, nil
+				}
+				cmd := exec.Command("llama", "daemon", "-autostart", "-path", sockPath)
+				cmd.SysProcAttr = daemon.DetachedProcAttr()
+				if err := cmd.Start(); err != nil {
+					return nil, err
+				}
+				spawned = true
+				exitStatus = make(chan error, 1)
+				go func() {
+					exitStatus <- cmd.Wait()
+				}()
 			}
 		}
-	}()
-	for {
 		select {
-		case cl = <-connected:
-			return cl, nil
 		case err := <-exitStatus:
-			if err == nil {
-				// The autostart exited 0, so someone
-				// else must have raced to autostart.
-				exitStatus = nil
-				break
+			if err != nil {
+				return nil, fmt.Errorf("Starting server: %s", err.Error())
 			}
-			// Stop the goroutine that's trying to connect
-			close(shutdown)
-			return nil, fmt.Errorf("Starting server: %s", err.Error())
+			// The autostart exited 0, so someone else must
+			// have raced to autostart.
+			exitStatus = nil
+		case <-timeout:
+			return nil, fmt.Errorf("%s: %w", sockPath, ErrAutostartTimeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			// Try again
 		}
 	}
 }
@@ -225,10 +455,18 @@ loop:
 	}
 }
 
+func (d *Daemon) currentBackend() *backend {
+	d.backendMu.RLock()
+	defer d.backendMu.RUnlock()
+	return d.backend
+}
+
 func (d *Daemon) acquireSem(ctx context.Context) {
 	d.llamaccSem.Acquire(ctx, 1)
+	atomic.AddInt64(&d.localBusy, 1)
 }
 
 func (d *Daemon) releaseSem() {
+	atomic.AddInt64(&d.localBusy, -1)
 	d.llamaccSem.Release(1)
 }
@@ -16,16 +16,23 @@ package server_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/daemon/server"
+	"github.com/nelhage/llama/files"
 )
 
 func TestDialWithAutostart(t *testing.T) {
@@ -107,3 +114,182 @@ func TestDialWithAutostart(t *testing.T) {
 	}
 
 }
+
+func TestAutostartSpawnsOnce(t *testing.T) {
+	llama, err := exec.LookPath("llama")
+	if err != nil {
+		t.Skip("Need a llama binary in the path to run autostart tests")
+	}
+	dir := t.TempDir()
+	sock := path.Join(dir, "llama.sock")
+	spawns := path.Join(dir, "spawns")
+	// Record each spawn before starting the real daemon
+	wrapper := fmt.Sprintf("#!/bin/sh\necho >> %s\nexec %s \"$@\"\n", spawns, llama)
+	bin := path.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(bin, "llama"), []byte(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath)
+	os.Setenv("LLAMA_DIR", dir)
+	os.Setenv("LLAMA_OBJECT_STORE", "s3://dummy-store/")
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cl, err := server.DialWithAutostart(ctx, sock, "/")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cl.Close()
+		}()
+	}
+	wg.Wait()
+	if cl, err := daemon.Dial(ctx, sock); err == nil {
+		cl.Shutdown(&daemon.ShutdownArgs{})
+		cl.Close()
+	}
+
+	data, err := ioutil.ReadFile(spawns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("spawned %d daemons, expected 1", n)
+	}
+}
+
+func TestDialWithAutostartTimeout(t *testing.T) {
+	dir := t.TempDir()
+	// A "daemon" that starts but never listens
+	fake := "#!/bin/sh\nexec sleep 5\n"
+	if err := ioutil.WriteFile(path.Join(dir, "llama"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	defer os.Unsetenv("LLAMA_AUTOSTART_TIMEOUT")
+	os.Setenv("LLAMA_AUTOSTART_TIMEOUT", "200ms")
+
+	_, err := server.DialWithAutostart(context.Background(), path.Join(dir, "llama.sock"), "/")
+	if !errors.Is(err, server.ErrAutostartTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestBatchInvokeWithFiles(t *testing.T) {
+	if _, err := exec.LookPath("llama"); err != nil {
+		t.Skip("Need a llama binary in the path to run autostart tests")
+	}
+	dir := t.TempDir()
+	sock := path.Join(dir, "llama.sock")
+	ctx := context.Background()
+
+	os.Setenv("LLAMA_DIR", dir)
+	os.Setenv("LLAMA_OBJECT_STORE", "s3://dummy-store/")
+
+	cl, err := server.DialWithAutostart(ctx, sock, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cl.Shutdown(&daemon.ShutdownArgs{})
+		cl.Close()
+	}()
+
+	existing := path.Join(dir, "existing.o")
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// All jobs fail validation before reaching AWS
+	reply, err := cl.BatchInvokeWithFiles(&daemon.BatchInvokeWithFilesArgs{
+		Jobs: []daemon.InvokeWithFilesArgs{
+			{Function: "f", Outputs: files.List{{Local: files.LocalFile{Path: "rel"}, Remote: "a"}}},
+			{Function: "f", Outputs: files.List{{Remote: "b"}}},
+			{Function: "f", NoClobber: true, Outputs: files.List{{Local: files.LocalFile{Path: existing}, Remote: "c"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 3 {
+		t.Fatalf("got %d results, expected 3", len(reply.Results))
+	}
+	if !strings.Contains(reply.Results[0].Err, "absolute path") {
+		t.Errorf("results[0]: unexpected error %q", reply.Results[0].Err)
+	}
+	if !strings.Contains(reply.Results[1].Err, `"b"`) {
+		t.Errorf("results[1]: unexpected error %q", reply.Results[1].Err)
+	}
+	if !strings.Contains(reply.Results[2].Err, "already exists") {
+		t.Errorf("results[2]: unexpected error %q", reply.Results[2].Err)
+	}
+}
+
+func TestLocalCompilePool(t *testing.T) {
+	if _, err := exec.LookPath("llama"); err != nil {
+		t.Skip("Need a llama binary in the path to run autostart tests")
+	}
+	dir := t.TempDir()
+	sock := path.Join(dir, "llama.sock")
+	ctx := context.Background()
+
+	os.Setenv("LLAMA_DIR", dir)
+	os.Setenv("LLAMA_OBJECT_STORE", "s3://dummy-store/")
+
+	cl, err := server.DialWithAutostart(ctx, sock, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cl.Shutdown(&daemon.ShutdownArgs{})
+		cl.Close()
+	}()
+
+	var held []*daemon.Client
+	for i := 0; i < runtime.NumCPU(); i++ {
+		slot, err := daemon.DialPath(ctx, sock, server.LocalCompilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, slot)
+	}
+
+	got := make(chan *daemon.Client)
+	go func() {
+		slot, err := daemon.DialPath(ctx, sock, server.LocalCompilePath)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- slot
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("acquired a local slot while the pool was full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	held[0].Close()
+	select {
+	case slot := <-got:
+		if slot != nil {
+			slot.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a released slot")
+	}
+	for _, slot := range held[1:] {
+		slot.Close()
+	}
+}
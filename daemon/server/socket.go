@@ -0,0 +1,64 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// socketError explains a failure to create the daemon's socket at
+// sockPath, and how to pick somewhere else.
+func socketError(sockPath string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("cannot create daemon socket %s: %s is not writable "+
+			"(set LLAMA_DIR or pass -socket to use another directory): %w",
+			sockPath, path.Dir(sockPath), err)
+	}
+	return fmt.Errorf("cannot create daemon socket %s: %w", sockPath, err)
+}
+
+// makeSocketDir creates the directory holding sockPath, and makes
+// sure that only we can get into it, even if it already existed.
+func makeSocketDir(sockPath string) error {
+	dir := path.Dir(sockPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return socketError(sockPath, err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return socketError(sockPath, err)
+	}
+	return nil
+}
+
+// checkSocketDir verifies that we can create the directory holding
+// sockPath and write to it, so that a doomed autostart fails with a
+// useful error instead of an exit status.
+func checkSocketDir(sockPath string) error {
+	dir := path.Dir(sockPath)
+	if err := makeSocketDir(sockPath); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(dir, ".llama-probe-*")
+	if err != nil {
+		return socketError(sockPath, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
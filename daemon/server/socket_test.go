@@ -0,0 +1,51 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketError(t *testing.T) {
+	err := socketError("/run/user/1000/llama/llama.sock",
+		fmt.Errorf("mkdir /run/user/1000/llama: %w", os.ErrPermission))
+	assert.True(t, errors.Is(err, os.ErrPermission))
+	assert.Contains(t, err.Error(), "/run/user/1000/llama is not writable")
+	assert.Contains(t, err.Error(), "LLAMA_DIR")
+}
+
+func TestCheckSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkSocketDir(path.Join(dir, "sub", "llama.sock")))
+
+	// An existing directory is made private
+	require.NoError(t, os.Mkdir(path.Join(dir, "open"), 0755))
+	require.NoError(t, checkSocketDir(path.Join(dir, "open", "llama.sock")))
+	fi, err := os.Stat(path.Join(dir, "open"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	file := path.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	assert.Error(t, checkSocketDir(path.Join(file, "llama.sock")))
+}
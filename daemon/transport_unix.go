@@ -0,0 +1,41 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package daemon
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Listen listens for daemon connections on a unix socket at
+// sockPath. The caller must hold the daemon's lock, so any existing
+// socket is stale and is removed.
+func Listen(sockPath string) (net.Listener, error) {
+	os.Remove(sockPath)
+	return net.Listen("unix", sockPath)
+}
+
+func dialTransport(sockPath string) (net.Conn, error) {
+	return net.Dial("unix", sockPath)
+}
+
+// DetachedProcAttr returns process attributes that detach a child
+// daemon from the caller's terminal and session.
+func DetachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On Windows, the daemon listens on a loopback TCP port instead of a
+// unix socket. The "socket" path is a file holding the address and a
+// random token; clients must send the token before speaking RPC, so
+// that other local users can't drive the daemon. Windows ignores the
+// file's Unix mode, so we rely on the ACL it inherits to keep others
+// from reading it. The default socket directories are all under the
+// user's profile directory, which only the user can read.
+
+const (
+	tokenBytes       = 16
+	handshakeTimeout = 5 * time.Second
+)
+
+type tokenListener struct {
+	net.Listener
+	token []byte
+}
+
+func (l *tokenListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tokenConn{Conn: conn, token: l.token}, nil
+}
+
+// tokenConn checks the client's token on the first Read, so that a
+// client that never sends one only holds up its own connection.
+type tokenConn struct {
+	net.Conn
+	token []byte
+
+	once sync.Once
+	err  error
+}
+
+var errBadToken = errors.New("daemon connection: bad token")
+
+func (c *tokenConn) handshake() {
+	got := make([]byte, len(c.token)+1)
+	c.Conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, err := io.ReadFull(c.Conn, got)
+	c.Conn.SetReadDeadline(time.Time{})
+	if err == nil && subtle.ConstantTimeCompare(got[:len(c.token)], c.token) != 1 {
+		err = errBadToken
+	}
+	if err != nil {
+		c.Conn.Close()
+		c.err = err
+	}
+}
+
+func (c *tokenConn) Read(p []byte) (int, error) {
+	c.once.Do(c.handshake)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// Listen listens for daemon connections on a loopback TCP port,
+// recording how to reach it in sockPath.
+func Listen(sockPath string) (net.Listener, error) {
+	var raw [tokenBytes]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(raw[:])
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(sockPath)
+	info := fmt.Sprintf("%s %s\n", listener.Addr().String(), token)
+	if err := ioutil.WriteFile(sockPath, []byte(info), 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &tokenListener{Listener: listener, token: []byte(token)}, nil
+}
+
+func dialTransport(sockPath string) (net.Conn, error) {
+	fh, err := os.Open(sockPath)
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(fh).ReadString('\n')
+	fh.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", sockPath, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("reading %s: malformed daemon address", sockPath)
+	}
+	conn, err := net.Dial("tcp", fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, fields[1]+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DetachedProcAttr returns process attributes that detach a child
+// daemon from the caller's console.
+func DetachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -15,6 +15,7 @@
 package daemon
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/nelhage/llama/files"
@@ -33,25 +34,158 @@ type ShutdownReply struct{}
 type InvokeWithFilesArgs struct {
 	Trace      *tracing.Propagation
 	Function   string
+	Qualifier  string
 	ReturnLogs bool
 	Args       []string
 	Stdin      []byte
-	Files      files.List
-	Outputs    files.List
+	// Script, if set, is run remotely in place of the function's
+	// usual command, with Args as its arguments.
+	Script  []byte
+	Files   files.List
+	Outputs files.List
 
 	// If true, release the llamacc semaphore to allow other
 	// llamacc processes to use CPU while we talk to AWS
 	DropSemaphore bool
+
+	// If nonzero, override the daemon's configured cutoffs for
+	// passing blobs inline in the request and response.
+	MaxInlineRequest  int
+	MaxInlineResponse int
+
+	// If nonzero, the daemon abandons the invocation after this
+	// deadline.
+	Deadline time.Time
+
+	// If true, send Files as a single archive instead of one
+	// blob per file. Worthwhile for many small files.
+	ArchiveFiles bool
+	// If true, pack Files into a few shared objects, passing
+	// each as a slice of one. Ignored if ArchiveFiles is set.
+	PackFiles bool
+	// If true, ask for Outputs to be returned as a single
+	// archive.
+	ArchiveOutputs bool
+
+	// If true, refuse to run if any of Outputs already exists
+	// locally, rather than overwrite it.
+	NoClobber bool
+
+	// Region, if set, invokes Function in this AWS region
+	// instead of the daemon's.
+	Region string
 }
 
 type InvokeWithFilesReply struct {
-	InvokeErr  string
-	ExitStatus int
-	Stdout     []byte
-	Stderr     []byte
-	Logs       []byte
+	InvokeErr     string
+	ErrorCategory ErrorCategory
+	ExitStatus    int
+	Stdout        []byte
+	Stderr        []byte
+	Logs          []byte
+
+	// Signal is the signal that killed the command, if any.
+	Signal int
+
+	// Worker identifies where the command ran.
+	Worker protocol.Worker
 
 	Timing Timing
+	// Usage is the AWS usage attributable to this invocation:
+	// the Lambda request and the runtime's S3 traffic. The
+	// client's own uploads are not included, since the store
+	// shares them between invocations.
+	Usage protocol.UsageMetrics
+}
+
+// ErrorCategory classifies why an invocation failed, so that clients
+// can decide whether to retry or fall back without parsing
+// InvokeErr.
+type ErrorCategory int
+
+const (
+	// NoError means the invocation ran, though the command may
+	// have exited nonzero
+	NoError ErrorCategory = iota
+	// Throttled means Lambda refused the request because we're
+	// over the account's concurrency or rate limits
+	Throttled
+	// Timeout means the function ran out of time, or the caller's
+	// deadline passed
+	Timeout
+	// FunctionError means the function failed without returning
+	// a result, e.g. because the runtime crashed
+	FunctionError
+	// InfraError means talking to Lambda or S3 failed
+	InfraError
+	// MissingOutput means the command exited successfully, but
+	// didn't produce every output it was asked for
+	MissingOutput
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case NoError:
+		return "none"
+	case Throttled:
+		return "throttled"
+	case Timeout:
+		return "timeout"
+	case FunctionError:
+		return "function error"
+	case InfraError:
+		return "infrastructure error"
+	case MissingOutput:
+		return "missing output"
+	default:
+		return fmt.Sprintf("ErrorCategory(%d)", int(c))
+	}
+}
+
+// InvokeError is the error described by a reply's InvokeErr and
+// ErrorCategory.
+type InvokeError struct {
+	Category ErrorCategory
+	Message  string
+}
+
+func (e *InvokeError) Error() string {
+	return e.Message
+}
+
+// ExitCode is the status a local process should exit with to
+// report how the command exited: its exit status, or 128 plus the
+// signal that killed it, as shells report.
+func (r *InvokeWithFilesReply) ExitCode() int {
+	if r.Signal != 0 {
+		return 128 + r.Signal
+	}
+	return r.ExitStatus
+}
+
+// Err returns the reply's invocation error, or nil if there was
+// none.
+func (r *InvokeWithFilesReply) Err() error {
+	if r.InvokeErr == "" {
+		return nil
+	}
+	return &InvokeError{Category: r.ErrorCategory, Message: r.InvokeErr}
+}
+
+type BatchInvokeWithFilesArgs struct {
+	Jobs []InvokeWithFilesArgs
+}
+
+type BatchInvokeWithFilesReply struct {
+	// Results are in the same order as the request's Jobs
+	Results []BatchInvokeResult
+}
+
+type BatchInvokeResult struct {
+	// Err is set if the job failed in a way that would have
+	// made InvokeWithFiles return an error
+	Err   string
+	Reply InvokeWithFilesReply
 }
 
 type Timing struct {
@@ -71,6 +205,14 @@ type Stats struct {
 	OtherErrors    uint64
 	ExitStatuses   [256]uint64
 
+	// The current goroutine and open file counts, sampled when
+	// the stats are fetched, and the most seen since the last
+	// reset. OpenFDs is -1 where we can't count them.
+	Goroutines    uint64
+	OpenFDs       int64
+	MaxGoroutines uint64
+	MaxOpenFDs    uint64
+
 	Usage AWSUsage
 }
 
@@ -80,6 +222,32 @@ type AWSUsage struct {
 	RemoteS3 protocol.StoreUsage
 }
 
+type GetConfigArgs struct{}
+type GetConfigReply struct {
+	Config Config
+}
+
+// Config is the daemon's effective configuration, after resolving
+// flags, environment variables, and the config file.
+type Config struct {
+	ServerPid          int
+	StoreURL           string
+	Region             string
+	S3Concurrency      int
+	MaxBandwidth       int64
+	IdleTimeout        time.Duration
+	LlamaCCConcurrency int64
+	MaxInFlight        int64
+	MaxInlineRequest   int
+	MaxInlineResponse  int
+	Function           string
+}
+
+type ReloadConfigArgs struct{}
+type ReloadConfigReply struct {
+	Config Config
+}
+
 type StatsArgs struct {
 	Reset bool
 }
@@ -87,6 +255,16 @@ type StatsReply struct {
 	Stats Stats
 }
 
+type SchedulingHintArgs struct{}
+type SchedulingHintReply struct {
+	// PreferLocal is set if remote capacity is nearly exhausted
+	// and local CPUs are idle, so new work should run locally.
+	PreferLocal bool
+	InFlight    uint64
+	MaxInFlight int64
+	LocalBusy   int64
+}
+
 type TraceSpansArgs struct {
 	Spans []tracing.Span
 }
@@ -0,0 +1,151 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ContentCache remembers the contents and attributes of files read
+// for upload, so that clients shipping the same files over and over
+// (e.g. the headers shared by every file in a build) don't re-read
+// them each time. It saves reads, not stats: every read stats the
+// file, and re-reads it if its mtime, size or mode has changed,
+// because a build may regenerate a header between two compiles that
+// ship it. Since mtimes are coarse, a file rewritten in place can
+// look unchanged, so an entry is also re-read once it is older than
+// TTL. Entries hold whole files, so MaxBytes bounds the heap they
+// use.
+type ContentCache struct {
+	TTL time.Duration
+	// MaxBytes bounds the total size of cached files. Zero means
+	// defaultContentCacheBytes.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*contentEntry
+	bytes   int64
+}
+
+type contentEntry struct {
+	mode    os.FileMode
+	mtime   time.Time
+	size    int64
+	data    []byte
+	fetched time.Time
+}
+
+const defaultContentCacheBytes = 256 << 20
+
+// NewContentCache returns a cache whose entries are re-read after ttl
+// even if the file looks unchanged.
+func NewContentCache(ttl time.Duration) *ContentCache {
+	return &ContentCache{TTL: ttl}
+}
+
+type contentCacheKey struct{}
+
+// WithContentCache returns a context in which List's upload methods
+// read files through cache.
+func WithContentCache(ctx context.Context, cache *ContentCache) context.Context {
+	return context.WithValue(ctx, contentCacheKey{}, cache)
+}
+
+func contentCacheFrom(ctx context.Context) *ContentCache {
+	cache, _ := ctx.Value(contentCacheKey{}).(*ContentCache)
+	return cache
+}
+
+// Read returns the contents and mode of file, from the cache if it
+// is still valid.
+func (c *ContentCache) Read(file string) ([]byte, os.FileMode, error) {
+	now := time.Now()
+	st, err := os.Stat(file)
+	if err != nil {
+		c.forget(file)
+		return nil, 0, fmt.Errorf("stat %q: %w", file, err)
+	}
+	c.mu.Lock()
+	ent := c.entries[file]
+	if ent != nil && ent.mtime.Equal(st.ModTime()) && ent.size == st.Size() && ent.mode == st.Mode() &&
+		now.Sub(ent.fetched) < c.TTL {
+		c.mu.Unlock()
+		return ent.data, ent.mode, nil
+	}
+	c.mu.Unlock()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.forget(file)
+		return nil, 0, fmt.Errorf("reading file %q: %w", file, err)
+	}
+	if int64(len(data)) == st.Size() {
+		// Otherwise the file changed under us, and st doesn't
+		// describe data
+		c.store(file, &contentEntry{
+			mode:    st.Mode(),
+			mtime:   st.ModTime(),
+			size:    st.Size(),
+			data:    data,
+			fetched: now,
+		})
+	}
+	return data, st.Mode(), nil
+}
+
+func (c *ContentCache) forget(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ent, ok := c.entries[file]; ok {
+		c.bytes -= ent.size
+		delete(c.entries, file)
+	}
+}
+
+func (c *ContentCache) store(file string, ent *contentEntry) {
+	max := c.MaxBytes
+	if max == 0 {
+		max = defaultContentCacheBytes
+	}
+	if ent.size > max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*contentEntry)
+	}
+	if old, ok := c.entries[file]; ok {
+		c.bytes -= old.size
+		delete(c.entries, file)
+	}
+	// Evict arbitrary entries to make room; the working set of a
+	// build is usually far smaller than the cache.
+	for path, old := range c.entries {
+		if c.bytes+ent.size <= max {
+			break
+		}
+		c.bytes -= old.size
+		delete(c.entries, path)
+	}
+	c.entries[file] = ent
+	c.bytes += ent.size
+}
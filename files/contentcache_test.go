@@ -0,0 +1,86 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentCache(t *testing.T) {
+	file := path.Join(t.TempDir(), "a.h")
+	require.NoError(t, ioutil.WriteFile(file, []byte("one"), 0644))
+	st, err := os.Stat(file)
+	require.NoError(t, err)
+
+	cache := NewContentCache(time.Hour)
+	data, mode, err := cache.Read(file)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+	assert.Equal(t, st.Mode(), mode)
+
+	// Even within the TTL, a change in size or mtime re-reads the
+	// file
+	require.NoError(t, ioutil.WriteFile(file, []byte("two!"), 0644))
+	require.NoError(t, os.Chtimes(file, st.ModTime(), st.ModTime()))
+	data, _, err = cache.Read(file)
+	require.NoError(t, err)
+	assert.Equal(t, "two!", string(data))
+
+	later := st.ModTime().Add(time.Second)
+	require.NoError(t, ioutil.WriteFile(file, []byte("two?"), 0644))
+	require.NoError(t, os.Chtimes(file, later, later))
+	data, _, err = cache.Read(file)
+	require.NoError(t, err)
+	assert.Equal(t, "two?", string(data))
+
+	// An unchanged mtime and size trust the cached contents until
+	// the TTL expires
+	require.NoError(t, ioutil.WriteFile(file, []byte("two."), 0644))
+	require.NoError(t, os.Chtimes(file, later, later))
+	data, _, err = cache.Read(file)
+	require.NoError(t, err)
+	assert.Equal(t, "two?", string(data))
+
+	cache.TTL = 0
+	data, _, err = cache.Read(file)
+	require.NoError(t, err)
+	assert.Equal(t, "two.", string(data))
+
+	require.NoError(t, os.Remove(file))
+	_, _, err = cache.Read(file)
+	assert.Error(t, err)
+	assert.Empty(t, cache.entries)
+}
+
+func TestContentCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache := &ContentCache{TTL: time.Hour, MaxBytes: 10}
+	for _, name := range []string{"a", "b", "c"} {
+		file := path.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(file, []byte("1234"), 0644))
+		_, _, err := cache.Read(file)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, cache.bytes, int64(10))
+	}
+	assert.Len(t, cache.entries, 2)
+	assert.Contains(t, cache.entries, path.Join(dir, "c"))
+}
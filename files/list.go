@@ -41,6 +41,9 @@ type LocalFile struct {
 type Mapped struct {
 	Local  LocalFile
 	Remote string
+	// Optional marks an output that the command may legitimately
+	// not produce, so that Missing doesn't report it.
+	Optional bool
 }
 
 type List []Mapped
@@ -66,6 +69,9 @@ func (f *List) Set(v string) error {
 	if path.IsAbs(dest) {
 		return fmt.Errorf("-file: cannot expose file at absolute path: %q", dest)
 	}
+	if files.IsGlob(path.Dir(dest)) {
+		return fmt.Errorf("%q: wildcards are only supported in the last path element", dest)
+	}
 	*f = f.Append(Mapped{Local: LocalFile{Path: source}, Remote: dest})
 	return nil
 }
@@ -74,78 +80,267 @@ func (f List) Append(mapped ...Mapped) List {
 	return append(f, mapped...)
 }
 
-func uploadWorker(ctx context.Context, store store.Store, jobs <-chan Mapped, out chan<- *protocol.FileAndPath) {
-	for file := range jobs {
-		data, mode, err := func() ([]byte, os.FileMode, error) {
-			if file.Local.Bytes != nil {
-				if file.Local.Path != "" {
-					panic("MappedFile: got both Path and Bytes")
-				}
-				return file.Local.Bytes, file.Local.Mode, nil
-			} else {
-				data, err := ioutil.ReadFile(file.Local.Path)
-				if err != nil {
-					return nil, 0, fmt.Errorf("reading file %q: %w", file.Local.Path, err)
-				}
-				st, err := os.Stat(file.Local.Path)
-				if err != nil {
-					return nil, 0, fmt.Errorf("stat %q: %w", file.Local.Path, err)
-				}
-				return data, st.Mode(), nil
-			}
-		}()
-		var blob *protocol.Blob
-		if err == nil {
-			blob, err = files.NewBlob(ctx, store, data)
+// read returns the file's contents and mode. If the contents are
+// mapped into memory (see WithMmapThreshold), unmap is non-nil, and
+// must be called once they are no longer needed.
+func (f *LocalFile) read(ctx context.Context) (data []byte, mode os.FileMode, unmap func(), err error) {
+	if f.Bytes != nil {
+		if f.Path != "" {
+			panic("MappedFile: got both Path and Bytes")
 		}
-		if err != nil {
-			blob = &protocol.Blob{Err: err.Error()}
-		}
-		out <- &protocol.FileAndPath{
-			File: protocol.File{Blob: *blob, Mode: mode},
-			Path: file.Remote,
+		return f.Bytes, f.Mode, nil, nil
+	}
+	if cache := contentCacheFrom(ctx); cache != nil {
+		data, mode, err := cache.Read(f.Path)
+		return data, mode, nil, err
+	}
+	if threshold := mmapThresholdFrom(ctx); threshold > 0 {
+		return readMapped(f.Path, threshold)
+	}
+	data, err = ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("reading file %q: %w", f.Path, err)
+	}
+	st, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("stat %q: %w", f.Path, err)
+	}
+	return data, st.Mode(), nil, nil
+}
+
+func uploadOne(ctx context.Context, store store.Store, maxInline int, file *Mapped) protocol.FileAndPath {
+	data, mode, unmap, err := file.Local.read(ctx)
+	var blob *protocol.Blob
+	if err == nil {
+		blob, err = files.NewBlob(ctx, store, data, maxInline)
+	}
+	if unmap != nil {
+		if err == nil {
+			detach(blob)
 		}
+		unmap()
+	}
+	if err != nil {
+		blob = &protocol.Blob{Err: err.Error()}
+	}
+	return protocol.FileAndPath{
+		File: protocol.File{Blob: *blob, Mode: mode},
+		Path: file.Remote,
 	}
 }
 
 const uploadConcurrency = 32
 
-func (f List) Upload(ctx context.Context, store store.Store, files protocol.FileList) (protocol.FileList, error) {
-	var wg sync.WaitGroup
-	jobs := make(chan Mapped)
-	out := make(chan *protocol.FileAndPath)
+// dedup drops files that repeat an earlier path-to-path mapping.
+func (f List) dedup() List {
+	type key struct{ local, remote string }
+	seen := make(map[key]struct{}, len(f))
+	out := make(List, 0, len(f))
+	for _, file := range f {
+		if file.Local.Path != "" {
+			k := key{file.Local.Path, file.Remote}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+		}
+		out = append(out, file)
+	}
+	return out
+}
+
+// Upload uploads all files in the list to the store, and appends the
+// resulting references to `files`. Files smaller than maxInline bytes
+// are passed inline instead of uploaded. The references are appended
+// in list order, regardless of which uploads finish first, so the
+// same inputs always produce the same FileList. If ctx is cancelled,
+// Upload stops starting new files and returns ctx.Err().
+func (f List) Upload(ctx context.Context, store store.Store, maxInline int, files protocol.FileList) (protocol.FileList, error) {
+	f = f.dedup()
+	results := make(protocol.FileList, len(f))
 
+	var wg sync.WaitGroup
+	jobs := make(chan int)
 	go func() {
 		defer close(jobs)
-		for _, file := range f {
-			jobs <- file
+		for i := range f {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	for i := 0; i < uploadConcurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			uploadWorker(ctx, store, jobs, out)
+			for idx := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				results[idx] = uploadOne(ctx, store, maxInline, &f[idx])
+			}
 		}()
 	}
-	go func() {
-		wg.Wait()
-		close(out)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(files, results...), nil
+}
+
+// packSize is the size of the objects UploadPacked packs files
+// into.
+const packSize = 1 << 20
+
+// UploadPacked is like Upload, but packs files too large to inline
+// into shared objects of about packSize bytes, passing each file as
+// a slice of one. This makes far fewer store requests for many small
+// files, but identical files are deduplicated less well between
+// invocations.
+func (f List) UploadPacked(ctx context.Context, store store.Store, maxInline int, out protocol.FileList) (protocol.FileList, error) {
+	f = f.dedup()
+	datas := make([][]byte, len(f))
+	results := make(protocol.FileList, len(f))
+	unmaps := make([]func(), len(f))
+	defer func() {
+		for _, unmap := range unmaps {
+			if unmap != nil {
+				unmap()
+			}
+		}
 	}()
-	for file := range out {
-		files = append(files, *file)
+	for i := range f {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results[i].Path = f[i].Remote
+		data, mode, unmap, err := f[i].Local.read(ctx)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		datas[i] = data
+		unmaps[i] = unmap
+		results[i].Mode = mode
+	}
+	blobs := files.NewPackedBlobs(ctx, store, datas, maxInline, packSize)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	for i := range results {
+		if results[i].Err == "" {
+			results[i].Blob = blobs[i]
+			if unmaps[i] != nil {
+				detach(&results[i].Blob)
+			}
+		}
+	}
+	return append(out, results...), nil
+}
 
-	return files, nil
+// UploadAsArchive packs every file in the list into a single tar
+// archive and uploads that, trading a request per file for one
+// larger transfer.
+func (f List) UploadAsArchive(ctx context.Context, store store.Store, maxInline int) (*protocol.Blob, error) {
+	entries := make([]files.ArchiveEntry, 0, len(f))
+	for _, file := range f.dedup() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, mode, unmap, err := file.Local.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if unmap != nil {
+			defer unmap()
+		}
+		entries = append(entries, files.ArchiveEntry{Path: file.Remote, Data: data, Mode: mode})
+	}
+	archive, err := files.BuildArchive(entries)
+	if err != nil {
+		return nil, err
+	}
+	return files.NewBlob(ctx, store, archive, maxInline)
 }
 
-func (f List) TransformToLocal(ctx context.Context, files protocol.FileList) (ok protocol.FileList, bad protocol.FileList) {
-	byPath := make(map[string]string)
+// outputMap resolves the paths returned by the remote to the local
+// paths they are mapped to.
+type outputMap struct {
+	exact map[string]string
+	globs []Mapped
+}
+
+func (f List) outputMap() *outputMap {
+	m := &outputMap{exact: make(map[string]string, len(f))}
+	for _, out := range f {
+		if files.IsGlob(out.Remote) {
+			m.globs = append(m.globs, out)
+		} else {
+			m.exact[out.Remote] = out.Local.Path
+		}
+	}
+	return m
+}
+
+// localPath returns the local path for a file the remote returned,
+// or false if nothing in the list matches it. A glob entry maps
+// matches into the directory of its local path.
+func (m *outputMap) localPath(remote string) (string, bool) {
+	if local, ok := m.exact[remote]; ok {
+		return local, true
+	}
+	for _, out := range m.globs {
+		if ok, _ := path.Match(out.Remote, remote); ok {
+			return path.Join(path.Dir(out.Local.Path), path.Base(remote)), true
+		}
+	}
+	return "", false
+}
+
+// ExtractArchive writes each file in an output archive to the local
+// path it is mapped to. It returns the remote paths of the files it
+// wrote, and of any files the list doesn't mention.
+func (f List) ExtractArchive(data []byte) (extracted, unexpected []string, err error) {
+	outputs := f.outputMap()
+	err = files.ReadArchive(data, func(ent *files.ArchiveEntry) error {
+		local, found := outputs.localPath(ent.Path)
+		if !found {
+			unexpected = append(unexpected, ent.Path)
+			return nil
+		}
+		extracted = append(extracted, ent.Path)
+		return files.WriteFileAtomic(local, ent.Data, ent.Mode)
+	})
+	return extracted, unexpected, err
+}
+
+// Missing returns the remote paths of the list's non-optional
+// entries that don't appear in returned. A glob entry may match
+// nothing, so it is never missing.
+func (f List) Missing(returned []string) []string {
+	got := make(map[string]struct{}, len(returned))
+	for _, r := range returned {
+		got[r] = struct{}{}
+	}
+	var missing []string
 	for _, out := range f {
-		byPath[out.Remote] = out.Local.Path
+		if out.Optional || files.IsGlob(out.Remote) {
+			continue
+		}
+		if _, ok := got[out.Remote]; !ok {
+			missing = append(missing, out.Remote)
+		}
 	}
+	return missing
+}
+
+func (f List) TransformToLocal(ctx context.Context, files protocol.FileList) (ok protocol.FileList, bad protocol.FileList) {
+	outputs := f.outputMap()
 	for _, out := range files {
-		if local, found := byPath[out.Path]; found {
+		if local, found := outputs.localPath(out.Path); found {
 			out.Path = local
 			ok = append(ok, out)
 		} else {
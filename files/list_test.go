@@ -0,0 +1,113 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/teststore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadOrder(t *testing.T) {
+	dir := t.TempDir()
+	var list List
+	var want []string
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("f%03d", i)
+		local := path.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(local, []byte(name), 0644))
+		list = list.Append(Mapped{Local: LocalFile{Path: local}, Remote: name})
+		want = append(want, name)
+	}
+	// A repeated mapping is only sent once
+	list = list.Append(list[7])
+
+	ctx := context.Background()
+	st := store.InMemory()
+	first, err := list.Upload(ctx, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+	var got []string
+	for _, f := range first {
+		got = append(got, f.Path)
+	}
+	assert.Equal(t, want, got)
+
+	again, err := list.Upload(ctx, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+}
+
+func TestUploadCancelled(t *testing.T) {
+	var list List
+	for i := 0; i < 100; i++ {
+		list = list.Append(Mapped{
+			Local:  LocalFile{Bytes: []byte(fmt.Sprintf("file %d", i))},
+			Remote: fmt.Sprintf("f%03d", i),
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st := teststore.New(nil)
+	_, err := list.Upload(ctx, st, 0, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, st.Ops())
+
+	_, err = list.UploadAsArchive(ctx, st, 0)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, st.Ops())
+}
+
+func TestMissing(t *testing.T) {
+	outputs := List{
+		{Remote: "a.o"},
+		{Remote: "a.d"},
+		{Remote: "a.dwo", Optional: true},
+	}
+	assert.Empty(t, outputs.Missing([]string{"a.o", "a.d"}))
+	assert.Equal(t, []string{"a.d"}, outputs.Missing([]string{"a.o", "extra"}))
+}
+
+func TestTransformGlob(t *testing.T) {
+	var outputs List
+	require.NoError(t, outputs.Set("build/*.o"))
+	require.NoError(t, outputs.Set("out/*.dwo:build/*.dwo"))
+	require.NoError(t, outputs.Set("main.o:build/main.o"))
+	assert.Error(t, outputs.Set("*/x.o"))
+
+	returned := protocol.FileList{
+		{Path: "build/main.o"},
+		{Path: "build/a.o"},
+		{Path: "build/a.dwo"},
+		{Path: "build/a.d"},
+	}
+	ok, bad := outputs.TransformToLocal(context.Background(), returned)
+	var local []string
+	for _, f := range ok {
+		local = append(local, f.Path)
+	}
+	assert.Equal(t, []string{"main.o", "build/a.o", "out/a.dwo"}, local)
+	require.Equal(t, 1, len(bad))
+	assert.Equal(t, "build/a.d", bad[0].Path)
+	assert.Equal(t, []string{"build/main.o"}, outputs.Missing(nil))
+}
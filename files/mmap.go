@@ -0,0 +1,77 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+type mmapThresholdKey struct{}
+
+// WithMmapThreshold returns a context in which List's upload methods
+// map files of at least threshold bytes into memory, rather than
+// copying them onto the heap. The mapping is released once the
+// upload returns, so the store must not retain the data it is given
+// without copying it. A file truncated while it is mapped
+// crashes the process with SIGBUS. Files read through a ContentCache
+// are never mapped.
+func WithMmapThreshold(ctx context.Context, threshold int64) context.Context {
+	return context.WithValue(ctx, mmapThresholdKey{}, threshold)
+}
+
+func mmapThresholdFrom(ctx context.Context) int64 {
+	threshold, _ := ctx.Value(mmapThresholdKey{}).(int64)
+	return threshold
+}
+
+// readMapped reads file, mapping it instead if it is a regular file
+// of at least threshold bytes. unmap is nil unless the data is
+// mapped.
+func readMapped(file string, threshold int64) (data []byte, mode os.FileMode, unmap func(), err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("reading file %q: %w", file, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("stat %q: %w", file, err)
+	}
+	if st.Mode().IsRegular() && st.Size() >= threshold && st.Size() > 0 {
+		data, unmap, err := mapFile(f, st.Size())
+		if err == nil {
+			return data, st.Mode(), unmap, nil
+		}
+		// Fall back to reading it
+	}
+	data, err = ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("reading file %q: %w", file, err)
+	}
+	return data, st.Mode(), nil, nil
+}
+
+// detach copies blob's inline data, if any, so that it outlives a
+// mapping it was made from.
+func detach(blob *protocol.Blob) {
+	if blob.Bytes != nil {
+		blob.Bytes = append([]byte(nil), blob.Bytes...)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadMapped(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var list List
+	for name, data := range map[string][]byte{
+		"big":   big,
+		"small": []byte("small"),
+		"empty": {},
+	} {
+		local := path.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(local, data, 0644))
+		list = list.Append(Mapped{Local: LocalFile{Path: local}, Remote: name})
+	}
+
+	data, _, unmap, err := readMapped(path.Join(dir, "big"), 1024)
+	require.NoError(t, err)
+	require.NotNil(t, unmap)
+	assert.Equal(t, big, data)
+	unmap()
+
+	ctx := context.Background()
+	st := store.InMemory()
+	want, err := list.Upload(ctx, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+
+	mapped := WithMmapThreshold(ctx, 1)
+	got, err := list.Upload(mapped, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	packed, err := list.UploadPacked(ctx, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+	got, err = list.UploadPacked(mapped, st, protocol.MaxInlineBlob, nil)
+	require.NoError(t, err)
+	assert.Equal(t, packed, got)
+
+	archive, err := list.UploadAsArchive(ctx, st, protocol.MaxInlineBlob)
+	require.NoError(t, err)
+	gotArchive, err := list.UploadAsArchive(mapped, st, protocol.MaxInlineBlob)
+	require.NoError(t, err)
+	assert.Equal(t, archive, gotArchive)
+}
@@ -31,7 +31,10 @@ import (
 )
 
 type InvokeArgs struct {
-	Function   string
+	Function string
+	// Qualifier optionally selects a published version or alias
+	// of Function. If empty, we invoke $LATEST.
+	Qualifier  string
 	ReturnLogs bool
 	Spec       protocol.InvocationSpec
 }
@@ -55,14 +58,84 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 	ctx, span := tracing.StartSpan(ctx, "llama.Invoke")
 	defer span.End()
 	span.AddField("function", args.Function)
+	if args.Qualifier != "" {
+		span.AddField("qualifier", args.Qualifier)
+	}
 
 	if span.WillSubmit() {
 		args.Spec.Trace = span.Propagation()
 	}
+	args.Spec.Version = args.Spec.MinVersion()
+
+	key := runtimeKey(svc, args)
+	out, compressed, err := invokeOnce(ctx, svc, st, span, args, canCompress(key))
+	if err == nil && compressed && out.Response.Version < compressedVersion {
+		// The function has been redeployed with a runtime
+		// that doesn't understand compressed specs, so it ran
+		// its command without our arguments. Try again; see
+		// compressedVersion.
+		log.Printf("%s: runtime (protocol version %d) does not support compressed requests; "+
+			"it ran the command without arguments, running it again uncompressed",
+			args.Function, out.Response.Version)
+		runtimeVersions.Delete(key)
+		out, _, err = invokeOnce(ctx, svc, st, span, args, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	runtimeVersions.Store(key, out.Response.Version)
+
+	if out.Response.Spans != nil {
+		gets := files.AppendGet(nil, out.Response.Spans)
+		st.GetObjects(ctx, gets)
+		spandata, err, _ := files.ReadBlob(out.Response.Spans, gets)
+		if err == nil {
+			spandata, err = snappy.Decode(nil, spandata)
+		}
+		var spans []tracing.Span
+		if err == nil {
+			err = json.Unmarshal(spandata, &spans)
+		}
+		if err != nil {
+			log.Printf("error receiving traces: %s", err.Error())
+			span.AddField("remote_spans_lost", true)
+		} else {
+			span.AddField("remote_spans", len(spans))
+			tracing.SubmitAll(ctx, spans)
+		}
+	}
+	if out.Response.InlineSpans != nil {
+		span.AddField("remote_spans", len(out.Response.InlineSpans))
+		tracing.SubmitAll(ctx, out.Response.InlineSpans)
+	}
+
+	// These aren't "worker_id" etc, since this span ran here,
+	// not on the worker. See `llama trace -skew`.
+	span.AddField("remote_request_id", out.Response.Worker.RequestId)
+	span.AddField("remote_log_stream", out.Response.Worker.LogStream)
+	span.AddField("remote_worker_id", out.Response.Worker.WorkerId)
+	span.AddField("e2e_ms", out.Response.Times.E2E.Milliseconds())
+	span.AddField("fetch_ms", out.Response.Times.Fetch.Milliseconds())
+	span.AddField("exec_ms", out.Response.Times.Exec.Milliseconds())
+	span.AddField("upload_ms", out.Response.Times.Upload.Milliseconds())
+	span.AddField("cold_start", out.Response.Times.ColdStart)
+
+	return out, nil
+}
 
-	payload, err := json.Marshal(&args.Spec)
+// invokeOnce sends args to Lambda, compressing the spec if compress
+// is set, and reports whether it did.
+func invokeOnce(ctx context.Context, svc *lambda.Lambda, st store.Store,
+	span *tracing.SpanBuilder, args *InvokeArgs, compress bool) (*InvokeResult, bool, error) {
+	payload, compressed, err := encodePayload(span, &args.Spec, compress)
 	if err != nil {
-		return nil, fmt.Errorf("marshal: %w", err)
+		return nil, false, err
+	}
+	if len(payload) > maxPayloadBytes {
+		payload, compressed, err = spillPayload(ctx, st, span, &args.Spec, payload, compressed, compress)
+		if err != nil {
+			return nil, false, err
+		}
 	}
 
 	span.AddField("payload_bytes", len(payload))
@@ -71,15 +144,18 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 		FunctionName: &args.Function,
 		Payload:      payload,
 	}
+	if args.Qualifier != "" {
+		input.Qualifier = &args.Qualifier
+	}
 	if args.ReturnLogs {
 		input.LogType = aws.String(lambda.LogTypeTail)
 	}
 
 	var out InvokeResult
 
-	resp, err := svc.Invoke(&input)
+	resp, err := svc.InvokeWithContext(ctx, &input)
 	if err != nil {
-		return nil, fmt.Errorf("Invoke(): %w", err)
+		return nil, false, fmt.Errorf("Invoke(): %w", err)
 	}
 	if resp.LogResult != nil {
 		logs, _ := base64.StdEncoding.DecodeString(*resp.LogResult)
@@ -87,7 +163,7 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 	}
 
 	if resp.FunctionError != nil {
-		return nil, &ErrorReturn{
+		return nil, false, &ErrorReturn{
 			Payload: resp.Payload,
 			Logs:    out.Logs,
 		}
@@ -96,36 +172,7 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 	span.AddField("response_bytes", len(resp.Payload))
 
 	if err := json.Unmarshal(resp.Payload, &out.Response); err != nil {
-		return nil, fmt.Errorf("unmarshal: %q", err)
-	}
-
-	if out.Response.Spans != nil {
-		gets := files.AppendGet(nil, out.Response.Spans)
-		st.GetObjects(ctx, gets)
-		spandata, err, _ := files.ReadBlob(out.Response.Spans, gets)
-		if err == nil {
-			spandata, err = snappy.Decode(nil, spandata)
-		}
-		if err != nil {
-			log.Printf("error receiving traces: %s", err.Error())
-		} else {
-			var spans []tracing.Span
-			if json.Unmarshal(spandata, &spans) == nil {
-				tracing.SubmitAll(ctx, spans)
-			}
-		}
-	}
-	if out.Response.InlineSpans != nil {
-		tracing.SubmitAll(ctx, out.Response.InlineSpans)
+		return nil, false, fmt.Errorf("unmarshal: %q", err)
 	}
-
-	span.AddField("e2e_ms", out.Response.Times.E2E.Milliseconds())
-	span.AddField("fetch_ms", out.Response.Times.Fetch.Milliseconds())
-	span.AddField("exec_ms", out.Response.Times.Exec.Milliseconds())
-	span.AddField("upload_ms", out.Response.Times.Upload.Milliseconds())
-	if out.Response.Times.ColdStart {
-		span.AddField("cold_start", true)
-	}
-
-	return &out, nil
+	return &out, compressed, nil
 }
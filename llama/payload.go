@@ -0,0 +1,166 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+)
+
+const (
+	// Request payloads larger than this are sent compressed.
+	// Smaller payloads are sent as plain JSON, since compression
+	// is unlikely to buy us much.
+	compressThreshold = 16 * 1024
+
+	// Lambda rejects synchronous invocations with payloads over
+	// 6MB. Leave a little bit of slack.
+	maxPayloadBytes = 6*1024*1024 - 4*1024
+
+	// compressedVersion is the first protocol version whose
+	// runtime understands compressed specs. Older runtimes ignore
+	// the compressed spec and run their command without
+	// arguments. We only compress for a function whose runtime
+	// has already reported this version, but if the function is
+	// redeployed with an older runtime, the next compressed job
+	// runs twice: once without arguments, and again, uncompressed,
+	// once Invoke sees the old version in the response. The first
+	// run's side effects, if any, are not undone.
+	compressedVersion = 2
+)
+
+// runtimeVersions holds the protocol version each function's runtime
+// last reported, keyed by runtimeKey.
+var runtimeVersions sync.Map
+
+func runtimeKey(svc *lambda.Lambda, args *InvokeArgs) string {
+	return aws.StringValue(svc.Config.Region) + "/" + args.Function + ":" + args.Qualifier
+}
+
+// canCompress reports whether the runtime behind key is known to
+// understand compressed specs. Until a function has answered us, we
+// send it plain JSON.
+func canCompress(key string) bool {
+	v, ok := runtimeVersions.Load(key)
+	return ok && v.(int) >= compressedVersion
+}
+
+// encodePayload encodes spec, compressing it if compress is set and
+// that makes it smaller. It reports whether it did.
+func encodePayload(span *tracing.SpanBuilder, spec *protocol.InvocationSpec, compress bool) ([]byte, bool, error) {
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshal: %w", err)
+	}
+
+	if compress && len(payload) > compressThreshold {
+		compressed, err := protocol.CompressSpec(spec)
+		if err != nil {
+			return nil, false, fmt.Errorf("compress: %w", err)
+		}
+		cpayload, err := json.Marshal(compressed)
+		if err != nil {
+			return nil, false, fmt.Errorf("marshal: %w", err)
+		}
+		if len(cpayload) < len(payload) {
+			span.AddField("uncompressed_payload_bytes", len(payload))
+			return cpayload, true, nil
+		}
+	}
+	return payload, false, nil
+}
+
+func inlineSize(b *protocol.Blob) int {
+	if b.Bytes != nil {
+		return base64.StdEncoding.EncodedLen(len(b.Bytes))
+	}
+	return len(b.String)
+}
+
+func inlineData(b *protocol.Blob) []byte {
+	if b.Bytes != nil {
+		return b.Bytes
+	}
+	return []byte(b.String)
+}
+
+// spillPayload moves inline blobs out of spec and into the object
+// store, largest first, until the encoded payload fits inside
+// Lambda's request size limit. If we run out of blobs to spill, we
+// return the too-large payload and let Lambda report the error. Like
+// encodePayload, it reports whether the payload it returns is
+// compressed; compressed says whether the one passed in was.
+func spillPayload(ctx context.Context, st store.Store, span *tracing.SpanBuilder,
+	spec *protocol.InvocationSpec, payload []byte, compressed, compress bool) ([]byte, bool, error) {
+	ctx, sb := tracing.StartSpan(ctx, "spill_payload")
+	defer sb.End()
+
+	// The file list and blobs may be shared with other
+	// invocations (see `llama xargs`), so make private copies
+	// before modifying them.
+	spec.Files = append(protocol.FileList(nil), spec.Files...)
+	var blobs []*protocol.Blob
+	for _, b := range []**protocol.Blob{&spec.Stdin, &spec.Script, &spec.Archive} {
+		if *b == nil {
+			continue
+		}
+		blob := **b
+		*b = &blob
+		if inlineSize(*b) > 0 {
+			blobs = append(blobs, *b)
+		}
+	}
+	for i := range spec.Files {
+		if inlineSize(&spec.Files[i].Blob) > 0 {
+			blobs = append(blobs, &spec.Files[i].Blob)
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return inlineSize(blobs[i]) > inlineSize(blobs[j])
+	})
+
+	spilled := 0
+	for len(payload) > maxPayloadBytes && len(blobs) > 0 {
+		excess := len(payload) - maxPayloadBytes
+		for excess > 0 && len(blobs) > 0 {
+			b := blobs[0]
+			blobs = blobs[1:]
+			excess -= inlineSize(b)
+			id, err := st.Store(ctx, inlineData(b))
+			if err != nil {
+				return nil, false, fmt.Errorf("spilling payload: %w", err)
+			}
+			*b = protocol.Blob{Ref: id}
+			spilled += 1
+		}
+		var err error
+		payload, compressed, err = encodePayload(span, spec, compress)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	sb.AddField("spilled", spilled)
+	return payload, compressed, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillPayload(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	_, span := tracing.StartSpan(ctx, "test")
+
+	// Incompressible data, so that compression can't save us.
+	var fl protocol.FileList
+	for i := 0; i < 100; i++ {
+		data := make([]byte, 80*1024)
+		rand.Reader.Read(data)
+		fl = append(fl, protocol.FileAndPath{
+			Path: fmt.Sprintf("file-%d", i),
+			File: protocol.File{Blob: protocol.Blob{Bytes: data}},
+		})
+	}
+	shared := fl
+	spec := protocol.InvocationSpec{Files: fl}
+
+	payload, compressed, err := encodePayload(span, &spec, true)
+	require.NoError(t, err)
+	require.Greater(t, len(payload), maxPayloadBytes)
+
+	payload, _, err = spillPayload(ctx, st, span, &spec, payload, compressed, true)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), maxPayloadBytes)
+
+	spilled := 0
+	for i, f := range spec.Files {
+		if f.Ref != "" {
+			spilled++
+		}
+		got, err := files.Read(ctx, st, &f.Blob)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(shared[i].Bytes, got), "file %d: bad contents", i)
+		assert.NotNil(t, shared[i].Bytes, "must not modify the caller's file list")
+	}
+	assert.Greater(t, spilled, 0)
+	assert.Less(t, spilled, len(spec.Files))
+}
+
+func TestSpillPayloadArchive(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	_, span := tracing.StartSpan(ctx, "test")
+
+	data := make([]byte, 5*1024*1024)
+	rand.Reader.Read(data)
+	archive := &protocol.Blob{Bytes: data}
+	spec := protocol.InvocationSpec{
+		Script:  &protocol.Blob{String: "#!/bin/sh\n"},
+		Archive: archive,
+	}
+
+	payload, compressed, err := encodePayload(span, &spec, true)
+	require.NoError(t, err)
+	require.Greater(t, len(payload), maxPayloadBytes)
+
+	payload, _, err = spillPayload(ctx, st, span, &spec, payload, compressed, true)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), maxPayloadBytes)
+
+	assert.NotEqual(t, "", spec.Archive.Ref)
+	assert.Equal(t, "#!/bin/sh\n", spec.Script.String, "only the largest blob is spilled")
+	got, err := files.Read(ctx, st, spec.Archive)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+	assert.NotNil(t, archive.Bytes, "must not modify the caller's archive")
+}
+
+func TestCompressForNewRuntimes(t *testing.T) {
+	_, span := tracing.StartSpan(context.Background(), "test")
+	spec := protocol.InvocationSpec{
+		Args: []string{strings.Repeat("x", 2*compressThreshold)},
+	}
+
+	key := "us-west-2/test-compress:"
+	assert.False(t, canCompress(key))
+	payload, compressed, err := encodePayload(span, &spec, canCompress(key))
+	require.NoError(t, err)
+	assert.False(t, compressed)
+	assert.Greater(t, len(payload), compressThreshold)
+
+	runtimeVersions.Store(key, 1)
+	assert.False(t, canCompress(key))
+	runtimeVersions.Store(key, protocol.Version)
+	assert.True(t, canCompress(key))
+
+	payload, compressed, err = encodePayload(span, &spec, canCompress(key))
+	require.NoError(t, err)
+	assert.True(t, compressed)
+	assert.Less(t, len(payload), compressThreshold)
+}
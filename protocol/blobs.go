@@ -18,6 +18,8 @@ import (
 	"os"
 )
 
+// MaxInlineBlob is the default size below which blobs are passed
+// inline in requests and responses, instead of via the object store.
 const MaxInlineBlob = 100
 
 type Blob struct {
@@ -25,6 +27,11 @@ type Blob struct {
 	Bytes  []byte `json:"b,omitempty"`
 	Ref    string `json:"r,omitempty"`
 	Err    string `json:"e,omitempty"`
+	// If Length is nonzero, the blob is only the Length bytes
+	// of Ref starting at Offset. This lets many small files
+	// share one stored object.
+	Offset int64 `json:"o,omitempty"`
+	Length int64 `json:"l,omitempty"`
 }
 
 type File struct {
@@ -0,0 +1,100 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// CacheKey returns a hash of everything that determines what spec
+// computes: its arguments, the contents of its inputs, and the
+// outputs it asks for. Volatile fields such as Trace are ignored.
+// Inputs are identified by content, so the key doesn't depend on the
+// order of Files or on which blobs happened to be inlined. The spec
+// must not be compressed.
+func (spec *InvocationSpec) CacheKey() string {
+	h, _ := blake2b.New256(nil)
+	writeField(h, "args")
+	for _, arg := range spec.Args {
+		writeField(h, arg)
+	}
+	writeField(h, "stdin")
+	writeField(h, blobKey(spec.Stdin))
+	if spec.Script != nil {
+		writeField(h, "script")
+		writeField(h, blobKey(spec.Script))
+	}
+	writeField(h, "archive")
+	writeField(h, blobKey(spec.Archive))
+
+	files := append(FileList(nil), spec.Files...)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	writeField(h, "files")
+	for i := range files {
+		writeField(h, files[i].Path)
+		writeField(h, strconv.FormatUint(uint64(files[i].Mode), 8))
+		writeField(h, blobKey(&files[i].Blob))
+	}
+
+	outputs := append([]string(nil), spec.Outputs...)
+	sort.Strings(outputs)
+	writeField(h, "outputs")
+	for _, out := range outputs {
+		writeField(h, out)
+	}
+	writeField(h, strconv.FormatBool(spec.ArchiveOutputs))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField writes a length-prefixed string, so that adjacent
+// fields can't run together.
+func writeField(h hash.Hash, s string) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+	h.Write([]byte(s))
+}
+
+// blobKey identifies a blob by the hash of its contents, matching the
+// object store's IDs without their encoding suffix.
+func blobKey(b *Blob) string {
+	switch {
+	case b == nil:
+		return ""
+	case b.Err != "":
+		return "err:" + b.Err
+	case b.Ref != "" && b.Length != 0:
+		// We don't know a slice's own hash, so a file packed
+		// into an object keys differently than the same file
+		// stored alone.
+		return fmt.Sprintf("%s@%d+%d", strings.SplitN(b.Ref, ":", 2)[0], b.Offset, b.Length)
+	case b.Ref != "":
+		return strings.SplitN(b.Ref, ":", 2)[0]
+	case b.Bytes != nil:
+		sum := blake2b.Sum256(b.Bytes)
+		return hex.EncodeToString(sum[:])
+	default:
+		sum := blake2b.Sum256([]byte(b.String))
+		return hex.EncodeToString(sum[:])
+	}
+}
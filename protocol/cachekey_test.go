@@ -0,0 +1,69 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestCacheKey(t *testing.T) {
+	header := []byte("#define X 1\n")
+	sum := blake2b.Sum256(header)
+	ref := hex.EncodeToString(sum[:]) + ":zstd"
+
+	spec := InvocationSpec{
+		Args: []string{"gcc", "-c", "x.c"},
+		Files: FileList{
+			{Path: "x.c", File: File{Blob: Blob{String: "int x;\n"}}},
+			{Path: "x.h", File: File{Blob: Blob{Ref: ref}}},
+		},
+		Outputs: []string{"x.o", "x.d"},
+	}
+
+	same := InvocationSpec{
+		Version: Version,
+		Trace:   &tracing.Propagation{TraceId: "abc"},
+		Args:    []string{"gcc", "-c", "x.c"},
+		Files: FileList{
+			{Path: "x.h", File: File{Blob: Blob{Bytes: header}}},
+			{Path: "x.c", File: File{Blob: Blob{String: "int x;\n"}}},
+		},
+		Outputs:           []string{"x.d", "x.o"},
+		MaxInlineResponse: 1024,
+	}
+	assert.Equal(t, spec.CacheKey(), same.CacheKey())
+
+	args := spec
+	args.Args = []string{"gcc", "-c", "x.c", "-O2"}
+	assert.NotEqual(t, spec.CacheKey(), args.CacheKey())
+
+	split := spec
+	split.Args = []string{"gcc", "-c", "x.", "c"}
+	assert.NotEqual(t, spec.CacheKey(), split.CacheKey())
+
+	mode := spec
+	mode.Files = append(FileList(nil), spec.Files...)
+	mode.Files[0].Mode = 0755
+	assert.NotEqual(t, spec.CacheKey(), mode.CacheKey())
+
+	script := spec
+	script.Script = &Blob{String: "#!/bin/sh\n"}
+	assert.NotEqual(t, spec.CacheKey(), script.CacheKey())
+}
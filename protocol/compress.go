@@ -0,0 +1,75 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	encode *zstd.Encoder
+	decode *zstd.Decoder
+)
+
+func init() {
+	var err error
+	encode, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(fmt.Sprintf("zstd: init writer: %s", err.Error()))
+	}
+	decode, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(fmt.Sprintf("zstd: init reader: %s", err.Error()))
+	}
+}
+
+// CompressSpec returns a spec which wraps a zstd-compressed JSON
+// encoding of spec. The returned spec carries only the Version and
+// Compressed fields; the runtime recovers the original using
+// Decompress.
+func CompressSpec(spec *InvocationSpec) (*InvocationSpec, error) {
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &InvocationSpec{
+		Version:    spec.Version,
+		Compressed: encode.EncodeAll(payload, nil),
+	}, nil
+}
+
+// Decompress returns the spec wrapped by a spec produced by
+// CompressSpec. Specs which are not compressed are returned as-is, so
+// that raw JSON payloads continue to work.
+func (spec *InvocationSpec) Decompress() (*InvocationSpec, error) {
+	if spec.Compressed == nil {
+		return spec, nil
+	}
+	payload, err := decode.DecodeAll(spec.Compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing spec: %w", err)
+	}
+	var out InvocationSpec
+	if err := json.Unmarshal(payload, &out); err != nil {
+		return nil, fmt.Errorf("decoding compressed spec: %w", err)
+	}
+	if out.Compressed != nil {
+		return nil, fmt.Errorf("decoding compressed spec: nested compression")
+	}
+	return &out, nil
+}
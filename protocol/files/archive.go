@@ -0,0 +1,103 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveEntry is a single file in an archive blob.
+type ArchiveEntry struct {
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// BuildArchive packs entries into a tar archive. Archives carry no
+// timestamps or owners, so identical inputs produce identical
+// archives and dedupe in the store.
+func BuildArchive(entries []ArchiveEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range entries {
+		mode := ent.Mode.Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     ent.Path,
+			Mode:     int64(mode),
+			Size:     int64(len(ent.Data)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(ent.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadArchive calls fn for each regular file in a tar archive. It
+// rejects entries whose paths would escape the directory the archive
+// is unpacked into.
+func ReadArchive(data []byte, fn func(*ArchiveEntry) error) error {
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive: unsafe path %q", hdr.Name)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading archive: %s: %w", name, err)
+		}
+		if err := fn(&ArchiveEntry{Path: name, Data: body, Mode: os.FileMode(hdr.Mode).Perm()}); err != nil {
+			return err
+		}
+	}
+}
+
+// ExtractArchive unpacks a tar archive into root.
+func ExtractArchive(data []byte, root string) error {
+	return ReadArchive(data, func(ent *ArchiveEntry) error {
+		dest := path.Join(root, ent.Path)
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, ent.Data, ent.Mode)
+	})
+}
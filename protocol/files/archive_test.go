@@ -0,0 +1,60 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	entries := []ArchiveEntry{
+		{Path: "include/a.h", Data: []byte("#define A 1\n")},
+		{Path: "run.sh", Data: []byte("#!/bin/sh\n"), Mode: 0755},
+	}
+	data, err := BuildArchive(entries)
+	require.NoError(t, err)
+	again, err := BuildArchive(entries)
+	require.NoError(t, err)
+	assert.Equal(t, data, again, "archives are deterministic")
+
+	root := t.TempDir()
+	require.NoError(t, ExtractArchive(data, root))
+	got, err := ioutil.ReadFile(path.Join(root, "include/a.h"))
+	require.NoError(t, err)
+	assert.Equal(t, "#define A 1\n", string(got))
+	st, err := os.Stat(path.Join(root, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), st.Mode().Perm())
+}
+
+func TestArchiveUnsafePath(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644,
+	}))
+	require.NoError(t, tw.Close())
+
+	err := ExtractArchive(buf.Bytes(), t.TempDir())
+	assert.Error(t, err)
+}
@@ -21,19 +21,31 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"unicode/utf8"
 
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/store"
 )
 
+// AppendGet appends a request for b's object, if it has one, to
+// reqs. Consecutive blobs referencing the same object, such as slices
+// of one packed object, share a single request.
 func AppendGet(reqs []store.GetRequest, b *protocol.Blob) []store.GetRequest {
 	if b.Ref != "" {
+		if len(reqs) > 0 && reqs[len(reqs)-1].Id == b.Ref {
+			return reqs
+		}
 		reqs = append(reqs, store.GetRequest{Id: b.Ref})
 	}
 	return reqs
 }
 
+// ReadBlob returns b's contents, given the requests built by
+// AppendGet for b and the blobs before it, and returns the requests
+// left for the blobs after it. Because AppendGet shares a request
+// between consecutive blobs, the request for b's object stays at the
+// front of the returned list until a blob needs the next one.
 func ReadBlob(b *protocol.Blob, gets []store.GetRequest) ([]byte, error, []store.GetRequest) {
 	if b.Err != "" {
 		return nil, errors.New(b.Err), gets
@@ -45,16 +57,37 @@ func ReadBlob(b *protocol.Blob, gets []store.GetRequest) ([]byte, error, []store
 		return b.Bytes, nil, gets
 	}
 	if b.Ref != "" {
+		if gets[0].Id != b.Ref && len(gets) > 1 {
+			// gets[0] belonged to the previous blob
+			gets = gets[1:]
+		}
 		if gets[0].Id != b.Ref {
 			panic(fmt.Sprintf("ReadBlob: bad requests %s != %s", gets[0].Id, b.Ref))
 		}
-		return gets[0].Data, gets[0].Err, gets[1:]
+		if gets[0].Err != nil {
+			return nil, gets[0].Err, gets
+		}
+		data, err := slice(b, gets[0].Data)
+		return data, err, gets
 	}
 	return nil, nil, gets
 }
 
+// slice returns the part of a referenced object that b covers.
+func slice(b *protocol.Blob, data []byte) ([]byte, error) {
+	if b.Length == 0 {
+		return data, nil
+	}
+	if b.Offset < 0 || b.Length < 0 || b.Offset+b.Length > int64(len(data)) {
+		return nil, fmt.Errorf("blob range %d+%d outside object %s of %d bytes",
+			b.Offset, b.Length, b.Ref, len(data))
+	}
+	return data[b.Offset : b.Offset+b.Length], nil
+}
+
 func Read(ctx context.Context, st store.Store, b *protocol.Blob) ([]byte, error) {
 	gets := AppendGet(nil, b)
+	st.GetObjects(ctx, gets)
 	data, err, _ := ReadBlob(b, gets)
 	return data, err
 }
@@ -68,16 +101,57 @@ func FetchFile(f *protocol.File, where string, gets []store.GetRequest) (error,
 	if mode == 0 {
 		mode = 0644
 	}
-	return ioutil.WriteFile(where, data, mode), gets
+	return WriteFileAtomic(where, data, mode), gets
 }
 
-func NewBlob(ctx context.Context, store store.Store, bytes []byte) (*protocol.Blob, error) {
+// WriteFileAtomic writes data to a new temporary file beside path
+// and renames it into place, so that path never holds a partial
+// write. Concurrent writers to the same path each use their own
+// temporary file.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// inlineBlob returns an inline Blob for bytes, or nil if it is too
+// large to inline.
+func inlineBlob(bytes []byte, maxInline int) *protocol.Blob {
 	stringOk := utf8.Valid(bytes)
-	if stringOk && len(bytes) < protocol.MaxInlineBlob {
-		return &protocol.Blob{String: string(bytes)}, nil
+	if stringOk && len(bytes) < maxInline {
+		return &protocol.Blob{String: string(bytes)}
 	}
-	if base64.StdEncoding.EncodedLen(len(bytes)) < protocol.MaxInlineBlob {
-		return &protocol.Blob{Bytes: bytes}, nil
+	if base64.StdEncoding.EncodedLen(len(bytes)) < maxInline {
+		return &protocol.Blob{Bytes: bytes}
+	}
+	return nil
+}
+
+// NewBlob returns a Blob containing bytes. Blobs smaller than
+// maxInline are stored inline; larger ones are written to store and
+// passed by reference.
+func NewBlob(ctx context.Context, store store.Store, bytes []byte, maxInline int) (*protocol.Blob, error) {
+	if blob := inlineBlob(bytes, maxInline); blob != nil {
+		return blob, nil
 	}
 	id, err := store.Store(ctx, bytes)
 	if err != nil {
@@ -86,30 +160,128 @@ func NewBlob(ctx context.Context, store store.Store, bytes []byte) (*protocol.Bl
 	return &protocol.Blob{Ref: id}, nil
 }
 
-func ReadFile(ctx context.Context, store store.Store, path string) (*protocol.File, error) {
+// NewBlobs is like NewBlob, but uploads everything too large to
+// inline with a single StoreObjects call. Errors are reported in each
+// Blob's Err.
+func NewBlobs(ctx context.Context, st store.Store, datas [][]byte, maxInline int) []protocol.Blob {
+	out := make([]protocol.Blob, len(datas))
+	var reqs []store.StoreRequest
+	var idxs []int
+	for i, data := range datas {
+		if blob := inlineBlob(data, maxInline); blob != nil {
+			out[i] = *blob
+			continue
+		}
+		reqs = append(reqs, store.StoreRequest{Data: data})
+		idxs = append(idxs, i)
+	}
+	if len(reqs) == 0 {
+		return out
+	}
+	st.StoreObjects(ctx, reqs)
+	for i, req := range reqs {
+		if req.Err != nil {
+			out[idxs[i]] = protocol.Blob{Err: req.Err.Error()}
+		} else {
+			out[idxs[i]] = protocol.Blob{Ref: req.Id}
+		}
+	}
+	return out
+}
+
+// NewPackedBlobs is like NewBlobs, but concatenates the data too
+// large to inline into objects of up to about packSize bytes, and
+// returns slices of those objects. Data that doesn't share an object
+// is referenced whole.
+func NewPackedBlobs(ctx context.Context, st store.Store, datas [][]byte, maxInline int, packSize int) []protocol.Blob {
+	type member struct {
+		idx    int
+		offset int64
+	}
+	out := make([]protocol.Blob, len(datas))
+	var reqs []store.StoreRequest
+	var packs [][]member
+	var pack []byte
+	var members []member
+	flush := func() {
+		if len(members) > 0 {
+			reqs = append(reqs, store.StoreRequest{Data: pack})
+			packs = append(packs, members)
+		}
+		pack, members = nil, nil
+	}
+	for i, data := range datas {
+		if len(data) == 0 {
+			// The zero Blob reads as empty
+			continue
+		}
+		if blob := inlineBlob(data, maxInline); blob != nil {
+			out[i] = *blob
+			continue
+		}
+		if len(pack)+len(data) > packSize {
+			flush()
+		}
+		members = append(members, member{idx: i, offset: int64(len(pack))})
+		pack = append(pack, data...)
+	}
+	flush()
+	if len(reqs) == 0 {
+		return out
+	}
+	st.StoreObjects(ctx, reqs)
+	for i, req := range reqs {
+		for _, m := range packs[i] {
+			switch {
+			case req.Err != nil:
+				out[m.idx] = protocol.Blob{Err: req.Err.Error()}
+			case len(packs[i]) == 1:
+				out[m.idx] = protocol.Blob{Ref: req.Id}
+			default:
+				out[m.idx] = protocol.Blob{
+					Ref:    req.Id,
+					Offset: m.offset,
+					Length: int64(len(datas[m.idx])),
+				}
+			}
+		}
+	}
+	return out
+}
+
+// ReadLocal reads the contents and mode of a regular file.
+func ReadLocal(path string) ([]byte, os.FileMode, error) {
 	fh, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer fh.Close()
 	fi, err := fh.Stat()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if fi.Mode().IsDir() {
-		return nil, errors.New("ReadFile: got directory")
+		return nil, 0, errors.New("ReadFile: got directory")
 	}
 	bytes, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes, fi.Mode(), nil
+}
+
+func ReadFile(ctx context.Context, store store.Store, path string, maxInline int) (*protocol.File, error) {
+	bytes, mode, err := ReadLocal(path)
 	if err != nil {
 		return nil, err
 	}
-	blob, err := NewBlob(ctx, store, bytes)
+	blob, err := NewBlob(ctx, store, bytes, maxInline)
 	if err != nil {
 		return nil, err
 	}
 	return &protocol.File{
 		Blob: *blob,
-		Mode: fi.Mode(),
+		Mode: mode,
 	}, nil
 }
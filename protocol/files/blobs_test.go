@@ -0,0 +1,123 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/teststore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	out := path.Join(dir, "out.o")
+	// An existing read-only output is replaced, not written through
+	require.NoError(t, ioutil.WriteFile(out, []byte("old"), 0444))
+	// and so is anything left at the old fixed temporary name
+	other := path.Join(dir, "other")
+	require.NoError(t, ioutil.WriteFile(other, []byte("other"), 0644))
+	require.NoError(t, os.Symlink(other, out+".tmp"))
+
+	f := protocol.File{Blob: protocol.Blob{String: "new"}, Mode: 0755}
+	err, _ := FetchFile(&f, out, nil)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	st, err := os.Stat(out)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), st.Mode().Perm())
+
+	data, err = ioutil.ReadFile(other)
+	require.NoError(t, err)
+	assert.Equal(t, "other", string(data))
+	ents, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, ents, 3, "temporary file left behind")
+}
+
+func TestPackedBlobs(t *testing.T) {
+	ctx := context.Background()
+	st := teststore.New(nil)
+	datas := [][]byte{
+		[]byte("first file"),
+		[]byte("x"),
+		nil,
+		[]byte("second file"),
+		[]byte("a file too large to share an object"),
+		[]byte("third file"),
+	}
+	blobs := NewPackedBlobs(ctx, st, datas, 2, 32)
+	assert.Equal(t, "x", blobs[1].String)
+	assert.Equal(t, protocol.Blob{}, blobs[2])
+	assert.Equal(t, blobs[0].Ref, blobs[3].Ref)
+	assert.Equal(t, int64(10), blobs[3].Offset)
+	assert.Equal(t, int64(0), blobs[4].Length, "a lone object is referenced whole")
+	assert.Equal(t, int64(0), blobs[5].Length)
+
+	var gets []store.GetRequest
+	for i := range blobs {
+		gets = AppendGet(gets, &blobs[i])
+	}
+	assert.Equal(t, 3, len(gets))
+	st.GetObjects(ctx, gets)
+	for i := range blobs {
+		var data []byte
+		var err error
+		data, err, gets = ReadBlob(&blobs[i], gets)
+		require.NoError(t, err)
+		assert.Equal(t, string(datas[i]), string(data))
+	}
+
+	bad := blobs[3]
+	bad.Length = 100
+	_, err := Read(ctx, st, &bad)
+	assert.Error(t, err)
+}
+
+func TestNewBlobs(t *testing.T) {
+	ctx := context.Background()
+	st := teststore.New(nil)
+	st.FailStore(2)
+	datas := [][]byte{
+		[]byte("x"),
+		[]byte("first file"),
+		[]byte("second file"),
+		[]byte("first file"),
+	}
+	blobs := NewBlobs(ctx, st, datas, 2)
+	assert.Equal(t, protocol.Blob{String: "x"}, blobs[0])
+	assert.NotEqual(t, "", blobs[1].Ref)
+	assert.Equal(t, blobs[1].Ref, blobs[3].Ref)
+	assert.Equal(t, protocol.Blob{Err: teststore.ErrInjected.Error()}, blobs[2])
+	assert.Equal(t, 3, st.Count(teststore.OpStore, ""), "only data too large to inline is stored")
+
+	for _, i := range []int{0, 1, 3} {
+		data, err := Read(ctx, st, &blobs[i])
+		require.NoError(t, err)
+		assert.Equal(t, string(datas[i]), string(data))
+	}
+	_, err := Read(ctx, st, &blobs[2])
+	assert.EqualError(t, err, teststore.ErrInjected.Error())
+}
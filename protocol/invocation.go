@@ -15,28 +15,126 @@
 package protocol
 
 import (
+	"strings"
 	"time"
 
 	"github.com/nelhage/llama/tracing"
 )
 
+// Version is the version of the invocation protocol spoken by this
+// build of llama. It should be incremented whenever a change is made
+// to InvocationSpec or InvocationResponse that an older runtime would
+// silently misinterpret. Clients stamp each spec with the lowest
+// version whose features it uses (see MinVersion), so that older
+// runtimes still accept specs that don't need anything new.
+//
+// Version 2 added support for compressed specs.
+// Version 3 added input archives.
+// Version 4 added glob patterns in Outputs.
+// Version 5 added Script.
+// Version 6 added Blob byte ranges (Offset and Length).
+const Version = 6
+
 type InvocationSpec struct {
+	Version int                  `json:"version,omitempty"`
 	Trace   *tracing.Propagation `json:"trace,omitemptry"`
 	Args    []string             `json:"args"`
 	Stdin   *Blob                `json:"stdin,omitempty"`
-	Files   FileList             `json:"files,omitempty"`
-	Outputs []string             `json:"outputs,emitempty"`
+	// Script, if set, is written to an executable file in the
+	// job's working directory and run in place of the function's
+	// usual command, with Args as its arguments.
+	Script *Blob    `json:"script,omitempty"`
+	Files  FileList `json:"files,omitempty"`
+	// Archive, if set, is a tar archive of input files, unpacked
+	// into the job's working directory before Files are written.
+	// See files.BuildArchive.
+	Archive *Blob `json:"archive,omitempty"`
+	// Outputs are paths to return once the command exits. An
+	// output may be a glob pattern (see files.IsGlob), which
+	// returns every regular file that matches it.
+	Outputs []string `json:"outputs,emitempty"`
+
+	// MaxInlineResponse, if nonzero, overrides MaxInlineBlob for
+	// blobs returned in the response.
+	MaxInlineResponse int `json:"max_inline_response,omitempty"`
+
+	// ArchiveOutputs asks the runtime to return the outputs it
+	// finds as a single tar archive in OutputArchive. Older
+	// runtimes ignore it and return Outputs as usual, which
+	// clients must still handle.
+	ArchiveOutputs bool `json:"archive_outputs,omitempty"`
+
+	// If set, Compressed holds a zstd-compressed JSON encoding of
+	// the real spec, and all other fields except Version are
+	// ignored. See CompressSpec.
+	Compressed []byte `json:"zstd,omitempty"`
+}
+
+// MinVersion returns the lowest protocol version that understands
+// every feature spec uses.
+func (spec *InvocationSpec) MinVersion() int {
+	v := 1
+	need := func(min int) {
+		if min > v {
+			v = min
+		}
+	}
+	for _, b := range []*Blob{spec.Stdin, spec.Script, spec.Archive} {
+		if b != nil && (b.Offset != 0 || b.Length != 0) {
+			need(6)
+		}
+	}
+	for i := range spec.Files {
+		if spec.Files[i].Offset != 0 || spec.Files[i].Length != 0 {
+			need(6)
+		}
+	}
+	if spec.Script != nil {
+		need(5)
+	}
+	for _, out := range spec.Outputs {
+		// A glob pattern, as in files.IsGlob
+		if strings.ContainsAny(out, `*?[\`) {
+			need(4)
+		}
+	}
+	if spec.Archive != nil {
+		need(3)
+	}
+	return v
 }
 
 type InvocationResponse struct {
-	ExitStatus  int            `json:"status"`
-	Stdout      *Blob          `json:"stdout,omitempty"`
-	Stderr      *Blob          `json:"stderr,omitempty"`
-	Outputs     FileList       `json:"outputs,omitempty"`
-	InlineSpans []tracing.Span `json:"inlinespans,omitempty"`
-	Spans       *Blob          `json:"spans,omitempty"`
-	Usage       UsageMetrics   `json:"usage"`
-	Times       Timing         `json:"times"`
+	// Version is the protocol version of the runtime that
+	// answered. Runtimes from before Version 2 leave it zero.
+	Version    int      `json:"version,omitempty"`
+	ExitStatus int      `json:"status"`
+	Stdout     *Blob    `json:"stdout,omitempty"`
+	Stderr     *Blob    `json:"stderr,omitempty"`
+	Outputs    FileList `json:"outputs,omitempty"`
+	// OutputArchive holds the outputs, if the spec set
+	// ArchiveOutputs. Outputs then lists only files that could
+	// not be read.
+	OutputArchive *Blob          `json:"output_archive,omitempty"`
+	InlineSpans   []tracing.Span `json:"inlinespans,omitempty"`
+	Spans         *Blob          `json:"spans,omitempty"`
+	Usage         UsageMetrics   `json:"usage"`
+	Times         Timing         `json:"times"`
+
+	// Signal is the signal that killed the command, if any. The
+	// ExitStatus is then -1.
+	Signal int `json:"signal,omitempty"`
+
+	// Worker identifies where the command ran.
+	Worker Worker `json:"worker"`
+}
+
+// Worker identifies the Lambda request and container that ran an
+// invocation, to find it in the function's logs.
+type Worker struct {
+	RequestId string `json:"request_id,omitempty"`
+	LogStream string `json:"log_stream,omitempty"`
+	WorkerId  string `json:"worker_id,omitempty"`
 }
 
 type StoreUsage struct {
@@ -44,6 +142,10 @@ type StoreUsage struct {
 	Read_Requests  uint64
 	Xfer_In        uint64
 	Xfer_Out       uint64
+	// Lookups served by (or missing) the local disk cache, if
+	// the store has one
+	DiskCache_Hits   uint64
+	DiskCache_Misses uint64
 }
 
 type LambdaUsage struct {
@@ -0,0 +1,41 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinVersion(t *testing.T) {
+	cases := []struct {
+		spec InvocationSpec
+		want int
+	}{
+		{InvocationSpec{Args: []string{"true"}, Outputs: []string{"out.o"}}, 1},
+		{InvocationSpec{Archive: &Blob{Ref: "obj"}}, 3},
+		{InvocationSpec{Outputs: []string{"out/*.o"}}, 4},
+		{InvocationSpec{Script: &Blob{String: "#!/bin/sh\n"}, Archive: &Blob{Ref: "obj"}}, 5},
+		{InvocationSpec{Files: FileList{{
+			File: File{Blob: Blob{Ref: "obj", Offset: 10, Length: 5}},
+			Path: "a.h",
+		}}}, 6},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, tc.spec.MinVersion(), "%+v", tc.spec)
+		assert.LessOrEqual(t, tc.want, Version)
+	}
+}
@@ -14,15 +14,22 @@
 
 package storeutil
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type entry struct {
 	wait chan struct{}
 	ok   bool
+	done time.Time
 }
 
 type Cache struct {
 	sync.Mutex
+	// TTL, if nonzero, is how long the cache trusts that an
+	// object it has seen still exists in the store.
+	TTL  time.Duration
 	seen map[string]*entry
 }
 
@@ -33,6 +40,7 @@ type UploadHandle struct {
 
 func (u *UploadHandle) Complete() {
 	u.ent.ok = true
+	u.ent.done = time.Now()
 	u.resolved = true
 	close(u.ent.wait)
 }
@@ -54,6 +62,9 @@ func (c *Cache) HasObject(id string) bool {
 		return false
 	}
 	<-ent.wait
+	if ent.ok && c.TTL > 0 && time.Since(ent.done) > c.TTL {
+		return false
+	}
 	return ent.ok
 }
 
@@ -67,3 +78,11 @@ func (c *Cache) StartUpload(id string) UploadHandle {
 	c.seen[id] = ent
 	return UploadHandle{ent: ent}
 }
+
+// Forget removes id from the cache, so that the next upload of it
+// will not be skipped.
+func (c *Cache) Forget(id string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.seen, id)
+}
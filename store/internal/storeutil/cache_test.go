@@ -0,0 +1,39 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storeutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTTL(t *testing.T) {
+	var c Cache
+	c.TTL = time.Hour
+
+	assert.False(t, c.HasObject("a"))
+	u := c.StartUpload("a")
+	u.Complete()
+	assert.True(t, c.HasObject("a"))
+
+	u = c.StartUpload("b")
+	u.Rollback()
+	assert.False(t, c.HasObject("b"))
+
+	c.seen["a"].done = time.Now().Add(-2 * time.Hour)
+	assert.False(t, c.HasObject("a"))
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storeutil
+
+import "github.com/nelhage/llama/store"
+
+// Coalesce returns the distinct requests in gets, and a function
+// that, once they have been filled in, copies each result to every
+// request in gets for the same id. Duplicate requests then share a
+// single fetch, and the same Data.
+func Coalesce(gets []store.GetRequest) ([]store.GetRequest, func()) {
+	first := make(map[string]int, len(gets))
+	unique := make([]store.GetRequest, 0, len(gets))
+	slots := make([]int, len(gets))
+	for i, get := range gets {
+		idx, ok := first[get.Id]
+		if !ok {
+			idx = len(unique)
+			first[get.Id] = idx
+			unique = append(unique, store.GetRequest{Id: get.Id})
+		}
+		slots[i] = idx
+	}
+	return unique, func() {
+		for i, idx := range slots {
+			gets[i].Data = unique[idx].Data
+			gets[i].Err = unique[idx].Err
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storeutil
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	gets := []store.GetRequest{{Id: "a"}, {Id: "b"}, {Id: "a"}, {Id: "c"}, {Id: "b"}}
+	unique, fanOut := Coalesce(gets)
+	assert.Equal(t, []store.GetRequest{{Id: "a"}, {Id: "b"}, {Id: "c"}}, unique)
+
+	errMissing := errors.New("missing")
+	unique[0].Data = []byte("A")
+	unique[1].Err = errMissing
+	unique[2].Data = []byte("C")
+	fanOut()
+	assert.Equal(t, []store.GetRequest{
+		{Id: "a", Data: []byte("A")},
+		{Id: "b", Err: errMissing},
+		{Id: "a", Data: []byte("A")},
+		{Id: "c", Data: []byte("C")},
+		{Id: "b", Err: errMissing},
+	}, gets)
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storeutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1000)
+	now := l.last
+
+	// The bucket starts full
+	assert.Equal(t, time.Duration(0), l.reserve(now, 1000))
+	// and then runs at the configured rate
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now, 500))
+	assert.Equal(t, time.Duration(0), l.reserve(now.Add(2*time.Second), 500))
+	// Idle time doesn't bank more than a second's worth
+	assert.Equal(t, time.Second, l.reserve(now.Add(time.Hour), 2000))
+
+	assert.Nil(t, NewRateLimiter(0))
+}
@@ -33,6 +33,12 @@ func (s *inMemory) Store(ctx context.Context, obj []byte) (string, error) {
 	return id, nil
 }
 
+func (s *inMemory) StoreObjects(ctx context.Context, reqs []StoreRequest) {
+	for i := range reqs {
+		reqs[i].Id, reqs[i].Err = s.Store(ctx, reqs[i].Data)
+	}
+}
+
 func (s *inMemory) GetObjects(ctx context.Context, gets []GetRequest) {
 	for i := range gets {
 		id := gets[i].Id
@@ -44,6 +50,14 @@ func (s *inMemory) GetObjects(ctx context.Context, gets []GetRequest) {
 	}
 }
 
+func (s *inMemory) Contains(ctx context.Context, ids []string) []bool {
+	out := make([]bool, len(ids))
+	for i, id := range ids {
+		_, out[i] = s.objects[id]
+	}
+	return out
+}
+
 func (s *inMemory) FetchAWSUsage(u *protocol.StoreUsage) {}
 
 func InMemory() Store {
@@ -0,0 +1,112 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Objects compressed with a dictionary have IDs ending in
+// ":zstd-dict-HASH", where the dictionary is itself stored as
+// "HASH:zstd". Readers need no configuration to decode them; they
+// fetch the dictionary the ID names.
+const dictCodingPrefix = "zstd-dict-"
+
+type dictionaries struct {
+	mu       sync.Mutex
+	encode   *zstd.Encoder
+	decoders map[string]*zstd.Decoder
+}
+
+// DictionaryOf returns the ID of the dictionary needed to decode the
+// object id, or "" if it doesn't need one.
+func DictionaryOf(id string) string {
+	colon := strings.IndexByte(id, ':')
+	if colon < 0 || !strings.HasPrefix(id[colon+1:], dictCodingPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(id[colon+1:], dictCodingPrefix) + ":zstd"
+}
+
+// dictionaryHash returns the hash a dictionary's ID records, or an
+// error if the dictionary isn't stored in a way readers can find.
+func dictionaryHash(id string) (string, error) {
+	hash := strings.TrimSuffix(id, ":zstd")
+	if hash == id || strings.Contains(hash, ":") {
+		return "", fmt.Errorf("dictionary %q: must be an object stored without a dictionary, ending in :zstd", id)
+	}
+	return hash, nil
+}
+
+// encoder returns the encoder for new objects, and the coding their
+// IDs should record. The dictionary, if any, is loaded on first use.
+func (s *Store) encoder(ctx context.Context, usage *usageMetrics) (string, *zstd.Encoder, error) {
+	if s.opts.Dictionary == "" {
+		return "zstd", s.encode, nil
+	}
+	hash, err := dictionaryHash(s.opts.Dictionary)
+	if err != nil {
+		return "", nil, err
+	}
+	s.dicts.mu.Lock()
+	defer s.dicts.mu.Unlock()
+	if s.dicts.encode == nil {
+		dict, err := s.getOne(ctx, s.opts.Dictionary, usage)
+		if err != nil {
+			return "", nil, fmt.Errorf("loading dictionary %s: %w", s.opts.Dictionary, err)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(s.level), zstd.WithEncoderDict(dict))
+		if err != nil {
+			return "", nil, fmt.Errorf("dictionary %s: %w", s.opts.Dictionary, err)
+		}
+		s.dicts.encode = enc
+	}
+	return dictCodingPrefix + hash, s.dicts.encode, nil
+}
+
+// decoder returns a decoder for objects with the given coding,
+// fetching the dictionary it names if we haven't yet.
+func (s *Store) decoder(ctx context.Context, coding string, usage *usageMetrics) (*zstd.Decoder, error) {
+	if coding == "zstd" {
+		return s.decode, nil
+	}
+	if !strings.HasPrefix(coding, dictCodingPrefix) {
+		return nil, fmt.Errorf("unknown compression %s", coding)
+	}
+	hash := strings.TrimPrefix(coding, dictCodingPrefix)
+	s.dicts.mu.Lock()
+	defer s.dicts.mu.Unlock()
+	if dec, ok := s.dicts.decoders[hash]; ok {
+		return dec, nil
+	}
+	dict, err := s.getOne(ctx, hash+":zstd", usage)
+	if err != nil {
+		return nil, fmt.Errorf("loading dictionary %s: %w", hash, err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		return nil, fmt.Errorf("dictionary %s: %w", hash, err)
+	}
+	if s.dicts.decoders == nil {
+		s.dicts.decoders = make(map[string]*zstd.Decoder)
+	}
+	s.dicts.decoders[hash] = dec
+	return dec, nil
+}
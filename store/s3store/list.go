@@ -0,0 +1,109 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3store
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ObjectInfo describes an object found by listing the store.
+type ObjectInfo struct {
+	Id           string
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// maxDeleteBatch is the most keys S3 accepts in a single
+// DeleteObjects call.
+const maxDeleteBatch = 1000
+
+// prefix returns the S3 key prefix all of the store's objects live
+// under.
+func (s *Store) prefix() string {
+	prefix := strings.TrimPrefix(s.url.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// ListObjects calls fn for every object in the store, in both the
+// flat and sharded layouts. It stops and returns the first error fn
+// returns.
+func (s *Store) ListObjects(ctx context.Context, fn func(*ObjectInfo) error) error {
+	var fnErr error
+	err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &s.url.Host,
+		Prefix: aws.String(s.prefix()),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			info := ObjectInfo{
+				Id:           path.Base(*obj.Key),
+				Key:          *obj.Key,
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			}
+			if fnErr = fn(&info); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// DeleteObjects deletes the listed objects from the store, in
+// batches.
+func (s *Store) DeleteObjects(ctx context.Context, objs []ObjectInfo) error {
+	for len(objs) > 0 {
+		batch := objs
+		if len(batch) > maxDeleteBatch {
+			batch = batch[:maxDeleteBatch]
+		}
+		objs = objs[len(batch):]
+
+		del := &s3.Delete{Quiet: aws.Bool(true)}
+		for i := range batch {
+			del.Objects = append(del.Objects, &s3.ObjectIdentifier{Key: aws.String(batch[i].Key)})
+		}
+		out, err := s.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: &s.url.Host,
+			Delete: del,
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("deleting %s: %s (and %d other errors)",
+				aws.StringValue(e.Key), aws.StringValue(e.Message), len(out.Errors)-1)
+		}
+		for i := range batch {
+			s.seen.Forget(batch[i].Id)
+		}
+	}
+	return nil
+}
@@ -17,14 +17,18 @@ package s3store
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -41,9 +45,33 @@ import (
 )
 
 type Options struct {
+	// DisableHeadCheck skips checking whether an object already
+	// exists before uploading it. Objects this process has
+	// already stored or fetched are never checked or uploaded.
 	DisableHeadCheck bool
-	DiskCachePath    string
-	DiskCacheBytes   uint64
+	// SeenTTL, if nonzero, limits how long this process trusts
+	// that an object it has stored or fetched still exists.
+	SeenTTL        time.Duration
+	DiskCachePath  string
+	DiskCacheBytes uint64
+	// ShardKeys stores each object under a subdirectory named for
+	// the first byte of its hash (e.g. obj/ab/abcd...), instead
+	// of directly under the store's prefix.
+	ShardKeys bool
+	// MaxBytesPerSec, if positive, limits the rate of uploads,
+	// and separately of downloads, to this many bytes per second.
+	MaxBytesPerSec int64
+	// CompressionLevel is the zstd level (1-22) objects are
+	// compressed at, as near as the encoder supports; zero
+	// means zstd's default. Faster levels
+	// save CPU, slower ones bandwidth. Object IDs don't depend
+	// on it.
+	CompressionLevel int
+	// Dictionary, if set, is the ID of a zstd dictionary in this
+	// store to compress new objects with. It must have been
+	// stored without a dictionary, so its ID ends in ":zstd".
+	// Objects stored with it can be read by any store.
+	Dictionary string
 }
 
 type Store struct {
@@ -55,6 +83,16 @@ type Store struct {
 	seen storeutil.Cache
 	disk *diskcache.Cache
 
+	// encode and decode are safe for concurrent use through
+	// EncodeAll and DecodeAll.
+	encode *zstd.Encoder
+	decode *zstd.Decoder
+	level  zstd.EncoderLevel
+	dicts  dictionaries
+
+	upLimit   *storeutil.RateLimiter
+	downLimit *storeutil.RateLimiter
+
 	metricsMu sync.Mutex
 	metrics   usageMetrics
 }
@@ -64,23 +102,8 @@ type usageMetrics struct {
 	WriteRequests uint64
 	XferIn        uint64
 	XferOut       uint64
-}
-
-var (
-	encode *zstd.Encoder
-	decode *zstd.Decoder
-)
-
-func init() {
-	var err error
-	encode, err = zstd.NewWriter(nil)
-	if err != nil {
-		panic(fmt.Sprintf("zstd: init writer: %s", err.Error()))
-	}
-	decode, err = zstd.NewReader(nil)
-	if err != nil {
-		panic(fmt.Sprintf("zstd: init reader: %s", err.Error()))
-	}
+	DiskHits      uint64
+	DiskMisses    uint64
 }
 
 func (s *Store) FetchAWSUsage(u *protocol.StoreUsage) {
@@ -90,6 +113,8 @@ func (s *Store) FetchAWSUsage(u *protocol.StoreUsage) {
 	u.Read_Requests += s.metrics.ReadRequests
 	u.Xfer_In += s.metrics.XferIn
 	u.Xfer_Out += s.metrics.XferOut
+	u.DiskCache_Hits += s.metrics.DiskHits
+	u.DiskCache_Misses += s.metrics.DiskMisses
 	s.metrics = usageMetrics{}
 }
 
@@ -100,6 +125,8 @@ func (s *Store) addUsage(add *usageMetrics) {
 	s.metrics.WriteRequests += add.WriteRequests
 	s.metrics.XferOut += add.XferOut
 	s.metrics.XferIn += add.XferIn
+	s.metrics.DiskHits += add.DiskHits
+	s.metrics.DiskMisses += add.DiskMisses
 }
 
 func FromSession(s *session.Session, address string) (*Store, error) {
@@ -124,36 +151,81 @@ func FromSessionAndOptions(s *session.Session, address string, opts Options) (*S
 		disk = diskcache.New(opts.DiskCachePath, opts.DiskCacheBytes)
 	}
 
-	return &Store{
+	if opts.Dictionary != "" {
+		if _, err := dictionaryHash(opts.Dictionary); err != nil {
+			return nil, err
+		}
+	}
+
+	level := zstd.SpeedDefault
+	if opts.CompressionLevel != 0 {
+		level = zstd.EncoderLevelFromZstd(opts.CompressionLevel)
+	}
+	encode, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, fmt.Errorf("zstd: init writer: %w", err)
+	}
+	decode, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: init reader: %w", err)
+	}
+
+	st := &Store{
 		opts:    opts,
 		session: s,
 		s3:      svc,
 		url:     u,
 		disk:    disk,
-	}, nil
+		encode:  encode,
+		decode:  decode,
+		level:   level,
+
+		upLimit:   storeutil.NewRateLimiter(opts.MaxBytesPerSec),
+		downLimit: storeutil.NewRateLimiter(opts.MaxBytesPerSec),
+	}
+	st.seen.TTL = opts.SeenTTL
+	return st, nil
+}
+
+func (s *Store) key(id string) string {
+	if s.opts.ShardKeys && len(id) > 2 {
+		return path.Join(s.url.Path, id[:2], id)
+	}
+	return path.Join(s.url.Path, id)
 }
 
 func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
 	ctx, span := tracing.StartSpan(ctx, "s3.store")
 	defer span.End()
-	id := storeutil.HashObject(obj) + ":zstd"
 
+	var usage usageMetrics
+	defer s.addUsage(&usage)
+
+	coding, enc, err := s.encoder(ctx, &usage)
+	if err != nil {
+		return "", err
+	}
+	id := storeutil.HashObject(obj) + ":" + coding
+	if err := s.storeOne(ctx, span, id, enc, obj, &usage); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *Store) storeOne(ctx context.Context, span *tracing.SpanBuilder, id string, enc *zstd.Encoder, obj []byte, usage *usageMetrics) error {
 	span.AddField("object_id", id)
 	if s.seen.HasObject(id) {
-		return id, nil
+		return nil
 	}
 
-	key := aws.String(path.Join(s.url.Path, id))
+	key := aws.String(s.key(id))
 	var err error
 
-	var usage usageMetrics
-	defer s.addUsage(&usage)
-
 	upload := s.seen.StartUpload(id)
 	defer upload.Rollback()
 
 	if !s.opts.DisableHeadCheck {
-		usage.ReadRequests += 1
+		atomic.AddUint64(&usage.ReadRequests, 1)
 		_, err = s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 			Bucket: &s.url.Host,
 			Key:    key,
@@ -161,72 +233,167 @@ func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
 		if err == nil {
 			upload.Complete()
 			span.AddField("s3.exists", true)
-			return id, nil
+			return nil
 		}
 		if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
 			// 404 not found -- do the upload
 		} else {
-			return "", err
+			return err
 		}
 	}
 
-	compressed := encode.EncodeAll(obj, nil)
+	compressed := enc.EncodeAll(obj, nil)
 	span.AddField("s3.write_bytes", len(compressed))
 
-	usage.WriteRequests += 1
+	// The SDK reads the body once to hash it before sending it,
+	// so charge the limiter for the upload up front rather than
+	// as it is read.
+	if err := s.upLimit.Wait(ctx, len(compressed)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&usage.WriteRequests, 1)
 	_, err = s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Body:   bytes.NewReader(compressed),
 		Bucket: &s.url.Host,
 		Key:    key,
+		Metadata: map[string]*string{
+			lengthMetadata: aws.String(strconv.Itoa(len(obj))),
+		},
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
-	s.metrics.XferIn += uint64(len(obj))
+	atomic.AddUint64(&usage.XferIn, uint64(len(obj)))
 	upload.Complete()
-	return id, nil
+	return nil
+}
+
+// StoreObjects stores a batch of objects concurrently. Objects that
+// appear more than once in the batch are only checked for and
+// uploaded once.
+func (s *Store) StoreObjects(ctx context.Context, reqs []store.StoreRequest) {
+	ctx, span := tracing.StartSpan(ctx, "s3.store_objects")
+	defer span.End()
+	span.AddField("objects", len(reqs))
+
+	var usage usageMetrics
+	defer s.addUsage(&usage)
+
+	coding, enc, err := s.encoder(ctx, &usage)
+	if err != nil {
+		for i := range reqs {
+			reqs[i].Err = err
+		}
+		return
+	}
+
+	byId := make(map[string][]int)
+	var ids []string
+	for i := range reqs {
+		id := storeutil.HashObject(reqs[i].Data) + ":" + coding
+		if _, ok := byId[id]; !ok {
+			ids = append(ids, id)
+		}
+		byId[id] = append(byId[id], i)
+	}
+	span.AddField("unique_objects", len(ids))
+
+	jobs := make(chan string)
+	go func() {
+		defer close(jobs)
+		for _, id := range ids {
+			jobs <- id
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < getConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				idxs := byId[id]
+				ctx, span := tracing.StartSpan(ctx, "s3.store")
+				err := s.storeOne(ctx, span, id, enc, reqs[idxs[0]].Data, &usage)
+				span.End()
+				for _, idx := range idxs {
+					if err != nil {
+						reqs[idx].Err = err
+					} else {
+						reqs[idx].Id = id
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 const getConcurrency = 32
 
-func (s *Store) getFromS3(ctx context.Context, id string, usage *usageMetrics) ([]byte, error) {
+// lengthMetadata is the S3 metadata key recording an object's
+// uncompressed length.
+const lengthMetadata = "Llama-Length"
+
+// ErrTruncated is returned (wrapped) when an object read from S3 is
+// shorter than it should be, as opposed to having the wrong contents.
+var ErrTruncated = errors.New("truncated read")
+
+// getFromS3 returns the raw body of an object, along with its
+// expected uncompressed length, or -1 if it was stored without one.
+func (s *Store) getFromS3(ctx context.Context, id string, usage *usageMetrics) ([]byte, int, error) {
 	ctx, span := tracing.StartSpan(ctx, "s3.get_one")
 	defer span.End()
 
 	atomic.AddUint64(&usage.ReadRequests, 1)
 	resp, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &s.url.Host,
-		Key:    aws.String(path.Join(s.url.Path, id)),
+		Key:    aws.String(s.key(id)),
 	})
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(s.downLimit.LimitReader(ctx, resp.Body))
 	resp.Body.Close()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// The connection closed before Content-Length bytes
+		return nil, -1, fmt.Errorf("%q: %w: %s", id, ErrTruncated, err.Error())
+	}
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 
 	span.AddField("s3.read_bytes", len(body))
 	atomic.AddUint64(&usage.XferOut, uint64(len(body)))
 
-	if s.disk != nil {
-		s.disk.Put(id, body)
+	if resp.ContentLength != nil && int64(len(body)) != *resp.ContentLength {
+		return nil, -1, fmt.Errorf("%q: %w: got %d bytes, expected %d",
+			id, ErrTruncated, len(body), *resp.ContentLength)
 	}
-	return body, nil
+	length := -1
+	if meta, ok := resp.Metadata[lengthMetadata]; ok && meta != nil {
+		if n, err := strconv.Atoi(*meta); err == nil {
+			length = n
+		}
+	}
+	return body, length, nil
 }
 
-func (s *Store) decompress(id string, body []byte) (string, []byte, error) {
+func (s *Store) decompress(ctx context.Context, id string, body []byte, usage *usageMetrics) (string, []byte, error) {
 	expectHash := id
 	colon := strings.IndexRune(id, ':')
 	if colon > 0 {
 		expectHash = id[:colon]
-		coding := id[colon+1:]
-		if coding != "zstd" {
-			return expectHash, nil, fmt.Errorf("%q: unknown compression %s", id, coding)
+		dec, err := s.decoder(ctx, id[colon+1:], usage)
+		if err != nil {
+			return expectHash, nil, fmt.Errorf("%q: %w", id, err)
+		}
+		body, err = dec.DecodeAll(body, nil)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The body ended partway through a frame. Corrupt
+			// frames also decode short, so don't compare
+			// lengths here.
+			return expectHash, nil, fmt.Errorf("%q: %w: decoding: %s", id, ErrTruncated, err.Error())
 		}
-		var err error
-		body, err = decode.DecodeAll(body, nil)
 		if err != nil {
 			return expectHash, nil, fmt.Errorf("%q: decoding:  %w", id, err)
 		}
@@ -236,36 +403,101 @@ func (s *Store) decompress(id string, body []byte) (string, []byte, error) {
 
 func (s *Store) getOne(ctx context.Context, id string, usage *usageMetrics) ([]byte, error) {
 	var body []byte
+	length := -1
+	fromS3 := false
 	if s.disk != nil {
 		body, _ = s.disk.Get(id)
+		if body != nil {
+			atomic.AddUint64(&usage.DiskHits, 1)
+		} else {
+			atomic.AddUint64(&usage.DiskMisses, 1)
+		}
 	}
 	if body == nil {
 		var err error
-		body, err = s.getFromS3(ctx, id, usage)
+		body, length, err = s.getFromS3(ctx, id, usage)
 		if err != nil {
 			return nil, err
 		}
+		fromS3 = true
 	}
+	raw := body
 
-	hash, body, err := s.decompress(id, body)
+	hash, body, err := s.decompress(ctx, id, body, usage)
 	if err != nil {
 		return nil, err
 	}
 
+	if length >= 0 && len(body) != length {
+		return nil, fmt.Errorf("object store %w: %s decoded to %d bytes, expected %d",
+			ErrTruncated, id, len(body), length)
+	}
 	gotHash := storeutil.HashObject(body)
 	if gotHash != hash {
 		return nil, fmt.Errorf("object store mismatch: got csum=%s expected %s", gotHash, id)
 	}
+	if fromS3 && s.disk != nil {
+		s.disk.Put(id, raw)
+	}
 	u := s.seen.StartUpload(id)
 	u.Complete()
 
 	return body, nil
 }
 
-func (s *Store) GetObjects(ctx context.Context, gets []store.GetRequest) {
+// Contains checks for objects with HEAD requests, skipping any that
+// we've recently seen in the bucket. Objects we can't check count as
+// absent.
+func (s *Store) Contains(ctx context.Context, ids []string) []bool {
+	ctx, span := tracing.StartSpan(ctx, "s3.contains")
+	defer span.End()
+	span.AddField("objects", len(ids))
+
+	var usage usageMetrics
+	defer s.addUsage(&usage)
+
+	out := make([]bool, len(ids))
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range ids {
+			jobs <- i
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < getConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if s.seen.HasObject(ids[idx]) {
+					out[idx] = true
+					continue
+				}
+				atomic.AddUint64(&usage.ReadRequests, 1)
+				_, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+					Bucket: &s.url.Host,
+					Key:    aws.String(s.key(ids[idx])),
+				})
+				if err == nil {
+					out[idx] = true
+					u := s.seen.StartUpload(ids[idx])
+					u.Complete()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func (s *Store) GetObjects(ctx context.Context, all []store.GetRequest) {
 	ctx, span := tracing.StartSpan(ctx, "s3.get_objects")
 	defer span.End()
-	span.AddField("objects", len(gets))
+	span.AddField("objects", len(all))
+	gets, fanOut := storeutil.Coalesce(all)
+	defer fanOut()
+	span.AddField("unique_objects", len(gets))
 	grp, ctx := errgroup.WithContext(ctx)
 	jobs := make(chan int)
 
@@ -0,0 +1,263 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/internal/storeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeObject struct {
+	body   []byte
+	length string
+	// short, if set, is served in place of body while still
+	// claiming body's Content-Length.
+	short []byte
+}
+
+// fakeS3 is just enough of S3 to serve path-style HEAD, GET and PUT
+// requests for a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	puts    map[string]int
+	// failPuts holds paths to refuse uploads to
+	failPuts map[string]bool
+	// unavailable is how many more uploads to fail with a
+	// retryable error
+	unavailable int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		f.puts[r.URL.Path]++
+		if f.failPuts[r.URL.Path] {
+			http.Error(w, "injected failure", http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.unavailable > 0 {
+			f.unavailable--
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		f.objects[r.URL.Path] = &fakeObject{
+			body:   body,
+			length: r.Header.Get("X-Amz-Meta-" + lengthMetadata),
+		}
+	case "HEAD", "GET":
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if obj.length != "" {
+			w.Header().Set("X-Amz-Meta-"+lengthMetadata, obj.length)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		if r.Method == "HEAD" {
+			return
+		}
+		if obj.short != nil {
+			w.Write(obj.short)
+		} else {
+			w.Write(obj.body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func fakePath(st *Store, id string) string {
+	return "/" + st.url.Host + st.key(id)
+}
+
+func (f *fakeS3) object(t *testing.T, st *Store, id string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[fakePath(st, id)]
+	require.True(t, ok, "no object %s", id)
+	return obj
+}
+
+func newFakeStore(t *testing.T, opts Options) (*fakeS3, *Store) {
+	fake := &fakeS3{
+		objects:  make(map[string]*fakeObject),
+		puts:     make(map[string]int),
+		failPuts: make(map[string]bool),
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(1),
+	})
+	require.NoError(t, err)
+	st, err := FromSessionAndOptions(sess, "s3://bucket/obj/", opts)
+	require.NoError(t, err)
+	return fake, st
+}
+
+// testData returns compressible data big enough to span several
+// zstd blocks.
+func testData() []byte {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte('a' + r.Intn(4))
+	}
+	return data
+}
+
+func TestGetTruncated(t *testing.T) {
+	ctx := context.Background()
+	fake, st := newFakeStore(t, Options{})
+	data := testData()
+
+	for _, tc := range []struct {
+		name      string
+		damage    func(obj *fakeObject)
+		truncated bool
+	}{
+		{"short body", func(obj *fakeObject) { obj.body = obj.body[:len(obj.body)/2] }, true},
+		{"one byte", func(obj *fakeObject) { obj.body = obj.body[:1] }, true},
+		{"short read", func(obj *fakeObject) { obj.short = obj.body[:len(obj.body)/2] }, true},
+		{"corrupt", func(obj *fakeObject) { obj.body[len(obj.body)/3] ^= 0xff }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Each case stores a distinct object, so none
+			// is served from a previous read.
+			data[0]++
+			id, err := st.Store(ctx, data)
+			require.NoError(t, err)
+			obj := fake.object(t, st, id)
+			obj.body = append([]byte(nil), obj.body...)
+			tc.damage(obj)
+
+			_, err = store.Get(ctx, st, id)
+			require.Error(t, err)
+			assert.Equal(t, tc.truncated, errors.Is(err, ErrTruncated), "err=%v", err)
+		})
+	}
+
+	data[0]++
+	id, err := st.Store(ctx, data)
+	require.NoError(t, err)
+	got, err := store.Get(ctx, st, id)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestStoreObjects(t *testing.T) {
+	ctx := context.Background()
+	fake, st := newFakeStore(t, Options{})
+
+	a, b := []byte("object a"), []byte("object b")
+	reqs := []store.StoreRequest{{Data: a}, {Data: b}, {Data: a}, {Data: append([]byte(nil), a...)}}
+	st.StoreObjects(ctx, reqs)
+	for _, req := range reqs {
+		require.NoError(t, req.Err)
+	}
+	assert.Equal(t, reqs[0].Id, reqs[2].Id)
+	assert.Equal(t, reqs[0].Id, reqs[3].Id)
+	assert.NotEqual(t, reqs[0].Id, reqs[1].Id)
+	assert.Equal(t, 1, fake.puts[fakePath(st, reqs[0].Id)], "duplicates are uploaded once")
+	assert.Equal(t, 1, fake.puts[fakePath(st, reqs[1].Id)])
+
+	gets := []store.GetRequest{{Id: reqs[0].Id}, {Id: reqs[1].Id}}
+	st.GetObjects(ctx, gets)
+	require.NoError(t, gets[0].Err)
+	require.NoError(t, gets[1].Err)
+	assert.Equal(t, a, gets[0].Data)
+	assert.Equal(t, b, gets[1].Data)
+}
+
+func TestStoreObjectsError(t *testing.T) {
+	ctx := context.Background()
+	fake, st := newFakeStore(t, Options{})
+
+	a, b := []byte("object a"), []byte("object b")
+	bad := storeutil.HashObject(a) + ":zstd"
+	fake.failPuts[fakePath(st, bad)] = true
+
+	reqs := []store.StoreRequest{{Data: a}, {Data: b}, {Data: a}}
+	st.StoreObjects(ctx, reqs)
+	assert.Error(t, reqs[0].Err)
+	assert.Error(t, reqs[2].Err, "the error reaches every request for the object")
+	assert.Equal(t, "", reqs[0].Id)
+	assert.Equal(t, "", reqs[2].Id)
+	require.NoError(t, reqs[1].Err)
+	assert.NotEqual(t, "", reqs[1].Id)
+	assert.Equal(t, 1, fake.puts[fakePath(st, bad)])
+
+	// A failed upload isn't remembered as stored
+	delete(fake.failPuts, fakePath(st, bad))
+	reqs = []store.StoreRequest{{Data: a}}
+	st.StoreObjects(ctx, reqs)
+	require.NoError(t, reqs[0].Err)
+	assert.Equal(t, bad, reqs[0].Id)
+	assert.Equal(t, 2, fake.puts[fakePath(st, bad)])
+}
+
+func TestStoreRateLimit(t *testing.T) {
+	ctx := context.Background()
+	const rate = 200 << 10
+	fake, st := newFakeStore(t, Options{MaxBytesPerSec: rate})
+	// A retried upload is only charged once
+	fake.unavailable = 1
+
+	r := rand.New(rand.NewSource(1))
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		// Random data doesn't compress, so each object sends
+		// about rate bytes.
+		data := make([]byte, rate)
+		r.Read(data)
+		_, err := st.Store(ctx, data)
+		require.NoError(t, err)
+	}
+	// The bucket starts with a second's worth of bytes, so only
+	// the second object waits.
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(900*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(1800*time.Millisecond), "uploads charged more than once")
+}
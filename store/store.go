@@ -27,14 +27,45 @@ type GetRequest struct {
 	Err  error
 }
 
+type StoreRequest struct {
+	Data []byte
+	Id   string
+	Err  error
+}
+
 var ErrNotExists = errors.New("Requested object does not exist")
 
 type Store interface {
 	Store(ctx context.Context, obj []byte) (string, error)
+	// GetObjects fills in each request's Data or Err. Requests
+	// for the same id may share one fetch, and the same Data, so
+	// callers must not modify it.
 	GetObjects(ctx context.Context, gets []GetRequest)
+	// StoreObjects stores a batch of objects, filling in each
+	// request's Id or Err
+	StoreObjects(ctx context.Context, reqs []StoreRequest)
+	// Contains reports whether each of ids is present in the
+	// store. Stores with no cheaper way to check can use
+	// ContainsByGet.
+	Contains(ctx context.Context, ids []string) []bool
 	FetchAWSUsage(u *protocol.StoreUsage)
 }
 
+// ContainsByGet implements Contains by fetching every object, for
+// stores with no native existence check.
+func ContainsByGet(ctx context.Context, st Store, ids []string) []bool {
+	gets := make([]GetRequest, len(ids))
+	for i, id := range ids {
+		gets[i].Id = id
+	}
+	st.GetObjects(ctx, gets)
+	out := make([]bool, len(ids))
+	for i := range gets {
+		out[i] = gets[i].Err == nil
+	}
+	return out
+}
+
 func Get(ctx context.Context, st Store, id string) ([]byte, error) {
 	gets := []GetRequest{{Id: id}}
 	st.GetObjects(ctx, gets)
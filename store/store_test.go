@@ -0,0 +1,34 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContains(t *testing.T) {
+	ctx := context.Background()
+	st := InMemory()
+	id, err := st.Store(ctx, []byte("present"))
+	require.NoError(t, err)
+
+	ids := []string{id, "missing"}
+	assert.Equal(t, []bool{true, false}, st.Contains(ctx, ids))
+	assert.Equal(t, []bool{true, false}, ContainsByGet(ctx, st, ids))
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package teststore provides a Store wrapper for tests, which records
+// every operation and can inject failures.
+package teststore
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// ErrInjected is the error returned by failures set up with FailGet
+// and FailStore.
+var ErrInjected = errors.New("teststore: injected failure")
+
+type OpKind string
+
+const (
+	OpStore    OpKind = "store"
+	OpGet      OpKind = "get"
+	OpContains OpKind = "contains"
+)
+
+// Op records one object's part in an operation. A batch call records
+// one Op per object.
+type Op struct {
+	Kind OpKind
+	Id   string
+	Err  error
+}
+
+// Store wraps another Store, recording each operation. Gets and
+// stores are numbered from 1, per object, in the order they reach
+// the store.
+type Store struct {
+	inner store.Store
+
+	mu         sync.Mutex
+	ops        []Op
+	gets       int
+	stores     int
+	failGets   map[int]error
+	failStores map[int]error
+}
+
+// New returns a Store wrapping inner, or a fresh in-memory store if
+// inner is nil.
+func New(inner store.Store) *Store {
+	if inner == nil {
+		inner = store.InMemory()
+	}
+	return &Store{
+		inner:      inner,
+		failGets:   make(map[int]error),
+		failStores: make(map[int]error),
+	}
+}
+
+// FailGet makes the nth object get fail with ErrInjected.
+func (s *Store) FailGet(n ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range n {
+		s.failGets[i] = ErrInjected
+	}
+}
+
+// FailStore makes the nth object store fail with ErrInjected.
+func (s *Store) FailStore(n ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range n {
+		s.failStores[i] = ErrInjected
+	}
+}
+
+// Ops returns the operations recorded so far.
+func (s *Store) Ops() []Op {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Op(nil), s.ops...)
+}
+
+// Count returns how many recorded operations were of the given
+// kind and, if id is nonempty, for that object.
+func (s *Store) Count(kind OpKind, id string) int {
+	n := 0
+	for _, op := range s.Ops() {
+		if op.Kind == kind && (id == "" || op.Id == id) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Store) record(op Op) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+func (s *Store) nextStore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stores++
+	return s.failStores[s.stores]
+}
+
+func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
+	if err := s.nextStore(); err != nil {
+		s.record(Op{Kind: OpStore, Err: err})
+		return "", err
+	}
+	id, err := s.inner.Store(ctx, obj)
+	s.record(Op{Kind: OpStore, Id: id, Err: err})
+	return id, err
+}
+
+func (s *Store) StoreObjects(ctx context.Context, reqs []store.StoreRequest) {
+	for i := range reqs {
+		reqs[i].Id, reqs[i].Err = s.Store(ctx, reqs[i].Data)
+	}
+}
+
+func (s *Store) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	var pass []store.GetRequest
+	var idxs []int
+	s.mu.Lock()
+	for i := range gets {
+		s.gets++
+		if err, ok := s.failGets[s.gets]; ok {
+			gets[i].Data, gets[i].Err = nil, err
+			continue
+		}
+		pass = append(pass, store.GetRequest{Id: gets[i].Id})
+		idxs = append(idxs, i)
+	}
+	s.mu.Unlock()
+
+	s.inner.GetObjects(ctx, pass)
+	for j, i := range idxs {
+		gets[i].Data, gets[i].Err = pass[j].Data, pass[j].Err
+	}
+	for i := range gets {
+		s.record(Op{Kind: OpGet, Id: gets[i].Id, Err: gets[i].Err})
+	}
+}
+
+func (s *Store) Contains(ctx context.Context, ids []string) []bool {
+	out := s.inner.Contains(ctx, ids)
+	for _, id := range ids {
+		s.record(Op{Kind: OpContains, Id: id})
+	}
+	return out
+}
+
+func (s *Store) FetchAWSUsage(u *protocol.StoreUsage) {
+	s.inner.FetchAWSUsage(u)
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package teststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailures(t *testing.T) {
+	ctx := context.Background()
+	st := New(nil)
+	st.FailStore(1)
+	st.FailGet(2)
+
+	_, err := st.Store(ctx, []byte("obj"))
+	assert.Equal(t, ErrInjected, err)
+	id, err := st.Store(ctx, []byte("obj"))
+	require.NoError(t, err)
+
+	gets := []store.GetRequest{{Id: id}, {Id: id}, {Id: id}}
+	st.GetObjects(ctx, gets)
+	assert.NoError(t, gets[0].Err)
+	assert.Equal(t, ErrInjected, gets[1].Err)
+	assert.Equal(t, "obj", string(gets[2].Data))
+
+	assert.Equal(t, []Op{
+		{Kind: OpStore, Err: ErrInjected},
+		{Kind: OpStore, Id: id},
+		{Kind: OpGet, Id: id},
+		{Kind: OpGet, Id: id, Err: ErrInjected},
+		{Kind: OpGet, Id: id},
+	}, st.Ops())
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BatchTracer is a Tracer that can accept many spans at once more
+// cheaply than one at a time. SubmitAll uses it when it can.
+type BatchTracer interface {
+	Tracer
+	SubmitBatch(spans []Span)
+}
+
+// Stats counts the spans a tracer has handled.
+type Stats struct {
+	// Submitted is every span submitted so far
+	Submitted uint64
+	// Dropped is spans that were never recorded, because the
+	// tracer's context ended or writing them out failed
+	Dropped uint64
+}
+
+const (
+	batchSize     = 256
+	flushInterval = time.Second
+)
+
+// batcher collects submitted spans on a background goroutine and
+// passes them to flush in batches: once batchSize spans are waiting,
+// every flushInterval, and on close. After flush fails, later spans
+// are dropped.
+type batcher struct {
+	submitted uint64
+	dropped   uint64
+
+	ch    chan []Span
+	done  <-chan struct{}
+	flush func([]Span) error
+	wg    errgroup.Group
+}
+
+func newBatcher(done <-chan struct{}, flush func([]Span) error) *batcher {
+	b := &batcher{
+		ch:    make(chan []Span, bufferSize),
+		done:  done,
+		flush: flush,
+	}
+	b.wg.Go(b.run)
+	return b
+}
+
+func (b *batcher) submit(spans []Span) {
+	atomic.AddUint64(&b.submitted, uint64(len(spans)))
+	select {
+	case <-b.done:
+		atomic.AddUint64(&b.dropped, uint64(len(spans)))
+	case b.ch <- spans:
+	}
+}
+
+func (b *batcher) stats() Stats {
+	return Stats{
+		Submitted: atomic.LoadUint64(&b.submitted),
+		Dropped:   atomic.LoadUint64(&b.dropped),
+	}
+}
+
+func (b *batcher) close() error {
+	close(b.ch)
+	return b.wg.Wait()
+}
+
+func (b *batcher) run() error {
+	var pending []Span
+	var err error
+	write := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err == nil {
+			err = b.flush(pending)
+		}
+		if err != nil {
+			atomic.AddUint64(&b.dropped, uint64(len(pending)))
+		}
+		pending = nil
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case spans, ok := <-b.ch:
+			if !ok {
+				write()
+				return err
+			}
+			pending = append(pending, spans...)
+			if len(pending) >= batchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-b.done:
+			atomic.AddUint64(&b.dropped, uint64(len(pending)))
+			return err
+		}
+	}
+}
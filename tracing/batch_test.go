@@ -0,0 +1,93 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriterTracerBatches(t *testing.T) {
+	var w countingWriter
+	ctx, wt := WithWriterTracer(context.Background(), &w)
+	var spans []Span
+	for i := 0; i < 100; i++ {
+		spans = append(spans, Span{SpanId: fmt.Sprintf("%d", i)})
+	}
+	SubmitAll(ctx, spans)
+	_, span := StartSpan(ctx, "last")
+	span.End()
+	require.NoError(t, wt.Close())
+
+	assert.Equal(t, 1, w.writes)
+	dec := json.NewDecoder(&w.Buffer)
+	var got []string
+	for dec.More() {
+		var s Span
+		require.NoError(t, dec.Decode(&s))
+		got = append(got, s.SpanId)
+	}
+	require.Equal(t, 101, len(got))
+	assert.Equal(t, "0", got[0])
+	assert.Equal(t, span.Id(), got[100])
+}
+
+func TestMemoryTracerCollects(t *testing.T) {
+	spans, err := CollectSpans(context.Background(), func(ctx context.Context) error {
+		for i := 0; i < 2*batchSize+1; i++ {
+			_, span := StartSpan(ctx, "span")
+			span.End()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2*batchSize+1, len(spans))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestTracerStats(t *testing.T) {
+	ctx, wt := WithWriterTracer(context.Background(), failingWriter{})
+	SubmitAll(ctx, make([]Span, 10))
+	assert.Error(t, wt.Close())
+	assert.Equal(t, Stats{Submitted: 10, Dropped: 10}, wt.Stats())
+
+	mt := NewMemoryTracer(context.Background())
+	mt.SubmitBatch(make([]Span, 5))
+	assert.Equal(t, uint64(5), mt.Stats().Submitted)
+	assert.Equal(t, 5, len(mt.Close()))
+	assert.Equal(t, uint64(0), mt.Stats().Dropped)
+}
@@ -91,7 +91,9 @@ func StartSpanInTrace(ctx context.Context, name, trace, parent string) (context.
 
 func SubmitAll(ctx context.Context, spans []Span) {
 	tracer, ok := TracerFromContext(ctx)
-	if ok {
+	if bt, batch := tracer.(BatchTracer); batch {
+		bt.SubmitBatch(spans)
+	} else if ok {
 		for _, span := range spans {
 			tracer.Submit(&span)
 		}
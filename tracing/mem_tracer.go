@@ -16,40 +16,36 @@ package tracing
 
 import (
 	"context"
-
-	"golang.org/x/sync/errgroup"
 )
 
 type MemoryTracer struct {
 	spans []Span
-	ch    chan Span
-	wg    *errgroup.Group
-}
-
-func (tr *MemoryTracer) writer() error {
-	for s := range tr.ch {
-		tr.spans = append(tr.spans, s)
-	}
-	return nil
+	b     *batcher
 }
 
 func NewMemoryTracer(ctx context.Context) *MemoryTracer {
-	grp, ctx := errgroup.WithContext(ctx)
-	tr := &MemoryTracer{
-		ch: make(chan Span, bufferSize),
-		wg: grp,
-	}
-	tr.wg.Go(tr.writer)
+	tr := &MemoryTracer{}
+	tr.b = newBatcher(nil, func(spans []Span) error {
+		tr.spans = append(tr.spans, spans...)
+		return nil
+	})
 	return tr
 }
 
 func (mt *MemoryTracer) Submit(span *Span) {
-	mt.ch <- *span
+	mt.b.submit([]Span{*span})
+}
+
+func (mt *MemoryTracer) SubmitBatch(spans []Span) {
+	mt.b.submit(append([]Span(nil), spans...))
+}
+
+func (mt *MemoryTracer) Stats() Stats {
+	return mt.b.stats()
 }
 
 func (mt *MemoryTracer) Close() []Span {
-	close(mt.ch)
-	mt.wg.Wait()
+	mt.b.close()
 	return mt.spans
 }
 
@@ -0,0 +1,182 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsdTracer reports spans as statsd metrics, in the DogStatsD
+// dialect, instead of recording them. Each span becomes a timing
+// `llama.<name>.duration_ms`, plus a timing for each of its numeric
+// fields named `*_ms` and a count `llama.<name>.errors` if it has an
+// "error" field. Metrics are tagged with the span's statsdTagFields.
+type StatsdTracer struct {
+	conn net.Conn
+	tags []string
+	b    *batcher
+}
+
+// statsdTagFields are the span fields reported as tags
+var statsdTagFields = []string{"function", "qualifier", "region", "cold_start"}
+
+// statsdPacketSize keeps packets within a typical Ethernet MTU
+const statsdPacketSize = 1432
+
+// NewStatsdTracer returns a tracer that sends metrics over UDP to the
+// statsd server at addr, tagging every metric with tags (e.g.
+// "env:prod").
+func NewStatsdTracer(ctx context.Context, addr string, tags []string) (*StatsdTracer, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	st := &StatsdTracer{conn: conn, tags: tags}
+	st.b = newBatcher(ctx.Done(), st.write)
+	return st, nil
+}
+
+func (st *StatsdTracer) Submit(span *Span) {
+	st.b.submit([]Span{*span})
+}
+
+func (st *StatsdTracer) SubmitBatch(spans []Span) {
+	st.b.submit(append([]Span(nil), spans...))
+}
+
+func (st *StatsdTracer) Stats() Stats {
+	return st.b.stats()
+}
+
+func (st *StatsdTracer) Close() error {
+	err := st.b.close()
+	st.conn.Close()
+	return err
+}
+
+func (st *StatsdTracer) write(spans []Span) error {
+	var packet bytes.Buffer
+	send := func() {
+		// statsd is best-effort; a missing server mustn't stop
+		// us from sending later metrics.
+		st.conn.Write(packet.Bytes())
+		packet.Reset()
+	}
+	for i := range spans {
+		for _, line := range statsdMetrics(&spans[i], st.tags) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+				send()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	if packet.Len() > 0 {
+		send()
+	}
+	return nil
+}
+
+func statsdMetrics(span *Span, tags []string) []string {
+	name := "llama." + statsdName(strings.TrimPrefix(span.Name, "llama."))
+	tags = append(tags[:len(tags):len(tags)], statsdTags(span)...)
+	var suffix string
+	if len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	out := []string{fmt.Sprintf("%s.duration_ms:%d|ms%s", name, span.Duration.Milliseconds(), suffix)}
+	var keys []string
+	for k := range span.Fields {
+		if strings.HasSuffix(k, "_ms") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := toFloat(span.Fields[k]); ok {
+			out = append(out, fmt.Sprintf("%s.%s:%s|ms%s",
+				name, statsdName(k), strconv.FormatFloat(v, 'f', -1, 64), suffix))
+		}
+	}
+	if _, ok := span.Fields["error"]; ok {
+		out = append(out, fmt.Sprintf("%s.errors:1|c%s", name, suffix))
+	}
+	return out
+}
+
+func statsdTags(span *Span) []string {
+	var out []string
+	for _, field := range statsdTagFields {
+		if v, ok := span.Fields[field]; ok {
+			val := strings.Map(func(r rune) rune {
+				if r == ',' || r == '|' || r == '#' {
+					return '_'
+				}
+				return r
+			}, fmt.Sprint(v))
+			out = append(out, field+":"+val)
+		}
+	}
+	return out
+}
+
+// statsdName turns a span or field name like "InvokeWithFiles" into
+// a metric name like "invoke_with_files".
+func statsdName(name string) string {
+	var out strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if i > 0 {
+				prev := name[i-1]
+				if (prev >= 'a' && prev <= 'z') || (prev >= '0' && prev <= '9') {
+					out.WriteByte('_')
+				}
+			}
+			out.WriteRune(r - 'A' + 'a')
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_':
+			out.WriteRune(r)
+		default:
+			out.WriteByte('_')
+		}
+	}
+	return out.String()
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsdMetrics(t *testing.T) {
+	span := Span{
+		Name:     "llama.Invoke",
+		Duration: 1500 * time.Millisecond,
+		Fields: map[string]interface{}{
+			"function":   "gcc",
+			"cold_start": true,
+			"e2e_ms":     int64(1200),
+			"exec_ms":    float64(900.5),
+			"payload":    100,
+			"error":      "boom",
+		},
+	}
+	assert.Equal(t, []string{
+		"llama.invoke.duration_ms:1500|ms|#env:test,function:gcc,cold_start:true",
+		"llama.invoke.e2e_ms:1200|ms|#env:test,function:gcc,cold_start:true",
+		"llama.invoke.exec_ms:900.5|ms|#env:test,function:gcc,cold_start:true",
+		"llama.invoke.errors:1|c|#env:test,function:gcc,cold_start:true",
+	}, statsdMetrics(&span, []string{"env:test"}))
+
+	span = Span{Name: "InvokeWithFiles", Duration: time.Second}
+	assert.Equal(t, []string{"llama.invoke_with_files.duration_ms:1000|ms"}, statsdMetrics(&span, nil))
+}
+
+func TestStatsdTracer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	st, err := NewStatsdTracer(context.Background(), conn.LocalAddr().String(), nil)
+	require.NoError(t, err)
+	var spans []Span
+	for i := 0; i < 100; i++ {
+		spans = append(spans, Span{Name: "s3.store", Duration: time.Millisecond})
+	}
+	SubmitAll(WithTracer(context.Background(), Tee(st)), spans)
+	require.NoError(t, st.Close())
+
+	var lines []string
+	buf := make([]byte, 64<<10)
+	for len(lines) < len(spans) {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, n, statsdPacketSize)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Len(t, lines, len(spans))
+	assert.Equal(t, "llama.s3.store.duration_ms:1|ms", lines[0])
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+type tee []Tracer
+
+// Tee returns a Tracer that submits every span to each of tracers.
+func Tee(tracers ...Tracer) Tracer {
+	return tee(tracers)
+}
+
+func (t tee) Submit(span *Span) {
+	for _, tr := range t {
+		tr.Submit(span)
+	}
+}
+
+func (t tee) SubmitBatch(spans []Span) {
+	for _, tr := range t {
+		if bt, ok := tr.(BatchTracer); ok {
+			bt.SubmitBatch(spans)
+			continue
+		}
+		for i := range spans {
+			tr.Submit(&spans[i])
+		}
+	}
+}
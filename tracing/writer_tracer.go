@@ -15,64 +15,56 @@
 package tracing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
-
-	"golang.org/x/sync/errgroup"
 )
 
 type WriterTracer struct {
-	ctx context.Context
-	w   io.Writer
-	ch  chan Span
-	wg  *errgroup.Group
+	w io.Writer
+	b *batcher
 }
 
 func (wt *WriterTracer) Submit(span *Span) {
-	select {
-	case <-wt.ctx.Done():
-	case wt.ch <- *span:
-	}
+	wt.b.submit([]Span{*span})
+}
+
+func (wt *WriterTracer) SubmitBatch(spans []Span) {
+	wt.b.submit(append([]Span(nil), spans...))
+}
+
+func (wt *WriterTracer) Stats() Stats {
+	return wt.b.stats()
 }
 
 func (wt *WriterTracer) Close() error {
-	close(wt.ch)
-	err := wt.wg.Wait()
+	err := wt.b.close()
 	if cl, ok := wt.w.(io.WriteCloser); ok {
 		cl.Close()
 	}
 	return err
 }
 
-func (wt *WriterTracer) writer(ctx context.Context) error {
-	encoder := json.NewEncoder(wt.w)
-	for {
-		select {
-		case span, ok := <-wt.ch:
-			if !ok {
-				return nil
-			}
-			if err := encoder.Encode(&span); err != nil {
-				return nil
-			}
-		case <-ctx.Done():
-			return ctx.Err()
+// write encodes a batch of spans and writes them with a single
+// Write.
+func (wt *WriterTracer) write(spans []Span) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range spans {
+		if err := encoder.Encode(&spans[i]); err != nil {
+			return err
 		}
 	}
+	_, err := wt.w.Write(buf.Bytes())
+	return err
 }
 
 const bufferSize = 64
 
 func WithWriterTracer(ctx context.Context, w io.Writer) (context.Context, *WriterTracer) {
-	wg, ctx := errgroup.WithContext(ctx)
-	wt := &WriterTracer{
-		ctx: ctx,
-		wg:  wg,
-		w:   w,
-		ch:  make(chan Span, bufferSize),
-	}
-	wt.wg.Go(func() error { return wt.writer(ctx) })
+	wt := &WriterTracer{w: w}
+	wt.b = newBatcher(ctx.Done(), wt.write)
 	return WithTracer(ctx, wt), wt
 }
 